@@ -0,0 +1,546 @@
+package mix
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Adapters below are lightweight Sources, that transform other Sources
+// without Session mixing. Adapters, that compute samples, return internal
+// buffer, so they are not concurrent. Clone them for other goroutines.
+
+// Slice returns Source with length samples of src starting at offset.
+// Zero length means up to the end of src.
+func Slice(src Source, offset, length Tz) (Source, error) {
+	sLen := src.Length()
+	if offset < 0 || offset > sLen {
+		return nil, errors.New("Invalid offset")
+	}
+	if length < 0 || length > sLen-offset {
+		return nil, errors.New("Invalid length")
+	}
+	if length == 0 {
+		length = sLen - offset
+		if sLen == Infinite {
+			length = Infinite
+		}
+	}
+	return &sliceSource{src, offset, length}, nil
+}
+
+type sliceSource struct {
+	src            Source
+	offset, length Tz
+}
+
+func (s *sliceSource) Samples(channel int, offset, length Tz) Buffer {
+	return s.src.Samples(channel, s.offset+offset, length)
+}
+
+func (s *sliceSource) SampleRate() Tz {
+	return s.src.SampleRate()
+}
+
+func (s *sliceSource) NumChannels() int {
+	return s.src.NumChannels()
+}
+
+func (s *sliceSource) Length() Tz {
+	return s.length
+}
+
+func (s *sliceSource) Err() error {
+	return SourceErr(s.src)
+}
+
+func (s *sliceSource) Concurrent() bool {
+	return IsConcurrent(s.src)
+}
+
+func (s *sliceSource) Preallocate(chunkSize Tz) {
+	Preallocate(s.src, chunkSize)
+}
+
+func (s *sliceSource) Clone() Source {
+	return s.DeepClone(Source.Clone)
+}
+
+func (s *sliceSource) DeepClone(clone func(Source) Source) Source {
+	return &sliceSource{clone(s.src), s.offset, s.length}
+}
+
+// Concat returns Source, that plays srcs one after another.
+// All srcs must have the same sample rate and number of channels.
+// Only the last one may be unbounded.
+func Concat(srcs ...Source) (Source, error) {
+	if len(srcs) == 0 {
+		return nil, errors.New("Nothing to concatenate")
+	}
+	c := &concatSource{
+		srcs:   srcs,
+		begins: make([]Tz, len(srcs)),
+		buffer: make([]Buffer, srcs[0].NumChannels()),
+	}
+	for i, src := range srcs {
+		if src.SampleRate() != srcs[0].SampleRate() {
+			return nil, errors.New("Sources have different sample rates")
+		}
+		if src.NumChannels() != srcs[0].NumChannels() {
+			return nil, errors.New("Sources have different number of channels")
+		}
+		if c.length == Infinite {
+			return nil, errors.New("Only the last source may be unbounded")
+		}
+		c.begins[i] = c.length
+		if IsUnbounded(src) {
+			c.length = Infinite
+		} else {
+			c.length += src.Length()
+		}
+	}
+	return c, nil
+}
+
+type concatSource struct {
+	srcs   []Source
+	begins []Tz
+	length Tz
+	buffer []Buffer // for chunks that span several sources
+}
+
+func (c *concatSource) find(offset Tz) int {
+	return sort.Search(len(c.begins), func(i int) bool {
+		return c.begins[i] > offset
+	}) - 1
+}
+
+func (c *concatSource) Samples(channel int, offset, length Tz) Buffer {
+	i := c.find(offset)
+	if i == c.find(offset+length-1) {
+		return c.srcs[i].Samples(channel, offset-c.begins[i], length)
+	}
+
+	if Tz(cap(c.buffer[channel])) < length {
+		c.buffer[channel] = NewBuffer(length)
+	}
+	res := c.buffer[channel][0:length]
+	for dst := res; len(dst) > 0; i++ {
+		off := offset - c.begins[i]
+		part := Tz(len(dst))
+		if i+1 < len(c.srcs) && off+part > c.srcs[i].Length() {
+			part = c.srcs[i].Length() - off
+		}
+		copy(dst, c.srcs[i].Samples(channel, off, part))
+		dst = dst[part:]
+		offset += part
+	}
+	return res
+}
+
+func (c *concatSource) SampleRate() Tz {
+	return c.srcs[0].SampleRate()
+}
+
+func (c *concatSource) NumChannels() int {
+	return c.srcs[0].NumChannels()
+}
+
+func (c *concatSource) Length() Tz {
+	return c.length
+}
+
+func (c *concatSource) Err() error {
+	for _, src := range c.srcs {
+		if err := SourceErr(src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *concatSource) Preallocate(chunkSize Tz) {
+	preallocate(c.buffer, chunkSize)
+	for _, src := range c.srcs {
+		Preallocate(src, chunkSize)
+	}
+}
+
+func (c *concatSource) Clone() Source {
+	return c.DeepClone(Source.Clone)
+}
+
+func (c *concatSource) DeepClone(clone func(Source) Source) Source {
+	srcs := make([]Source, len(c.srcs))
+	for i, src := range c.srcs {
+		srcs[i] = clone(src)
+	}
+	res, _ := Concat(srcs...)
+	return res
+}
+
+// MonoToStereo returns stereo Source, that plays mono src in both channels.
+func MonoToStereo(src Source) (Source, error) {
+	if src.NumChannels() != 1 {
+		return nil, errors.New("Source is not mono")
+	}
+	return &channelSource{src, []int{0, 0}}, nil
+}
+
+// ExtractChannel returns mono Source with given channel of src.
+func ExtractChannel(src Source, channel int) (Source, error) {
+	if channel < 0 || channel >= src.NumChannels() {
+		return nil, fmt.Errorf("Invalid channel %d", channel)
+	}
+	return &channelSource{src, []int{channel}}, nil
+}
+
+// SwapChannels returns stereo Source with left and right channels
+// of src swapped.
+func SwapChannels(src Source) (Source, error) {
+	if src.NumChannels() != 2 {
+		return nil, errors.New("Source is not stereo")
+	}
+	return &channelSource{src, []int{1, 0}}, nil
+}
+
+// channelSource maps its channels to channels of src without copying.
+type channelSource struct {
+	src      Source
+	channels []int
+}
+
+func (c *channelSource) Samples(channel int, offset, length Tz) Buffer {
+	return c.src.Samples(c.channels[channel], offset, length)
+}
+
+func (c *channelSource) SampleRate() Tz {
+	return c.src.SampleRate()
+}
+
+func (c *channelSource) NumChannels() int {
+	return len(c.channels)
+}
+
+func (c *channelSource) Length() Tz {
+	return c.src.Length()
+}
+
+func (c *channelSource) Err() error {
+	return SourceErr(c.src)
+}
+
+func (c *channelSource) Concurrent() bool {
+	return IsConcurrent(c.src)
+}
+
+func (c *channelSource) Preallocate(chunkSize Tz) {
+	Preallocate(c.src, chunkSize)
+}
+
+func (c *channelSource) Clone() Source {
+	return c.DeepClone(Source.Clone)
+}
+
+func (c *channelSource) DeepClone(clone func(Source) Source) Source {
+	return &channelSource{clone(c.src), c.channels}
+}
+
+// Matrix returns Source, which channel i is sum of src channels j
+// multiplied by m[i][j]. Every row of m must have src.NumChannels() gains.
+func Matrix(src Source, m [][]float32) (Source, error) {
+	if len(m) == 0 {
+		return nil, errors.New("Empty matrix")
+	}
+	for i, row := range m {
+		if len(row) != src.NumChannels() {
+			return nil, fmt.Errorf("Matrix row %d has %d gains for %d channels",
+				i, len(row), src.NumChannels())
+		}
+	}
+	return &matrixSource{src, m, make([]Buffer, len(m))}, nil
+}
+
+type matrixSource struct {
+	src    Source
+	m      [][]float32
+	buffer []Buffer
+}
+
+func (s *matrixSource) Samples(channel int, offset, length Tz) Buffer {
+	if Tz(cap(s.buffer[channel])) < length {
+		s.buffer[channel] = NewBuffer(length)
+	}
+	res := s.buffer[channel][0:length]
+	res.Zero()
+	for j, g := range s.m[channel] {
+		if g != 0 {
+			res.MixGain(s.src.Samples(j, offset, length), g)
+		}
+	}
+	return res
+}
+
+func (s *matrixSource) SampleRate() Tz {
+	return s.src.SampleRate()
+}
+
+func (s *matrixSource) NumChannels() int {
+	return len(s.m)
+}
+
+func (s *matrixSource) Length() Tz {
+	return s.src.Length()
+}
+
+func (s *matrixSource) Err() error {
+	return SourceErr(s.src)
+}
+
+func (s *matrixSource) Preallocate(chunkSize Tz) {
+	preallocate(s.buffer, chunkSize)
+	Preallocate(s.src, chunkSize)
+}
+
+func (s *matrixSource) Clone() Source {
+	return s.DeepClone(Source.Clone)
+}
+
+func (s *matrixSource) DeepClone(clone func(Source) Source) Source {
+	return &matrixSource{clone(s.src), s.m, make([]Buffer, len(s.m))}
+}
+
+// Gain returns Source with all samples of src multiplied by gain.
+func Gain(src Source, gain float32) Source {
+	return &gainSource{src, gain, make([]Buffer, src.NumChannels())}
+}
+
+type gainSource struct {
+	src    Source
+	gain   float32
+	buffer []Buffer
+}
+
+func (s *gainSource) Samples(channel int, offset, length Tz) Buffer {
+	if Tz(cap(s.buffer[channel])) < length {
+		s.buffer[channel] = NewBuffer(length)
+	}
+	res := s.buffer[channel][0:length]
+	res.CopyGain(s.src.Samples(channel, offset, length), s.gain)
+	return res
+}
+
+func (s *gainSource) SampleRate() Tz {
+	return s.src.SampleRate()
+}
+
+func (s *gainSource) NumChannels() int {
+	return s.src.NumChannels()
+}
+
+func (s *gainSource) Length() Tz {
+	return s.src.Length()
+}
+
+func (s *gainSource) Err() error {
+	return SourceErr(s.src)
+}
+
+func (s *gainSource) Preallocate(chunkSize Tz) {
+	preallocate(s.buffer, chunkSize)
+	Preallocate(s.src, chunkSize)
+}
+
+func (s *gainSource) Clone() Source {
+	return s.DeepClone(Source.Clone)
+}
+
+func (s *gainSource) DeepClone(clone func(Source) Source) Source {
+	return Gain(clone(s.src), s.gain)
+}
+
+// FadeOut returns Source, that plays src until pos and then linearly fades
+// it out during fade samples. Returned Source ends after fade.
+func FadeOut(src Source, pos, fade Tz) Source {
+	if fade < 0 {
+		fade = 0
+	}
+	return &fadeSource{src, pos, fade, make([]Buffer, src.NumChannels())}
+}
+
+type fadeSource struct {
+	src       Source
+	pos, fade Tz
+	buffer    []Buffer
+}
+
+func (s *fadeSource) Samples(channel int, offset, length Tz) Buffer {
+	if offset+length <= s.pos {
+		return s.src.Samples(channel, offset, length)
+	}
+	if Tz(cap(s.buffer[channel])) < length {
+		s.buffer[channel] = NewBuffer(length)
+	}
+	res := s.buffer[channel][0:length]
+	// Samples after fade are silent, even if src goes on, so players,
+	// that read whole chunks past Length, do not hear it.
+	n := s.Length() - offset
+	if n > length {
+		n = length
+	}
+	if n <= 0 {
+		res.Zero()
+		return res
+	}
+	copy(res, s.src.Samples(channel, offset, n))
+	res[n:].Zero()
+	beg := s.pos - offset
+	if beg < 0 {
+		beg = 0
+	}
+	if s.fade == 0 {
+		res[beg:n].Zero()
+		return res
+	}
+	gain := func(i Tz) float32 {
+		return 1 - float32(offset+i-s.pos)/float32(s.fade)
+	}
+	res[beg:n].LinearRamp(gain(beg), gain(n))
+	return res
+}
+
+func (s *fadeSource) SampleRate() Tz {
+	return s.src.SampleRate()
+}
+
+func (s *fadeSource) NumChannels() int {
+	return s.src.NumChannels()
+}
+
+func (s *fadeSource) Length() Tz {
+	if l := s.src.Length(); l < s.pos+s.fade {
+		return l
+	}
+	return s.pos + s.fade
+}
+
+func (s *fadeSource) Err() error {
+	return SourceErr(s.src)
+}
+
+func (s *fadeSource) Preallocate(chunkSize Tz) {
+	preallocate(s.buffer, chunkSize)
+	Preallocate(s.src, chunkSize)
+}
+
+func (s *fadeSource) Clone() Source {
+	return s.DeepClone(Source.Clone)
+}
+
+func (s *fadeSource) DeepClone(clone func(Source) Source) Source {
+	return FadeOut(clone(s.src), s.pos, s.fade)
+}
+
+// Reverse returns Source, that plays src backwards.
+func Reverse(src Source) (Source, error) {
+	if IsUnbounded(src) {
+		return nil, errors.New("Can't reverse unbounded source")
+	}
+	return &reverseSource{src, make([]Buffer, src.NumChannels())}, nil
+}
+
+type reverseSource struct {
+	src    Source
+	buffer []Buffer
+}
+
+func (s *reverseSource) Samples(channel int, offset, length Tz) Buffer {
+	if Tz(cap(s.buffer[channel])) < length {
+		s.buffer[channel] = NewBuffer(length)
+	}
+	res := s.buffer[channel][0:length]
+	src := s.src.Samples(channel, s.src.Length()-offset-length, length)
+	for i, v := range src {
+		res[len(res)-1-i] = v
+	}
+	return res
+}
+
+func (s *reverseSource) SampleRate() Tz {
+	return s.src.SampleRate()
+}
+
+func (s *reverseSource) NumChannels() int {
+	return s.src.NumChannels()
+}
+
+func (s *reverseSource) Length() Tz {
+	return s.src.Length()
+}
+
+func (s *reverseSource) Err() error {
+	return SourceErr(s.src)
+}
+
+func (s *reverseSource) Preallocate(chunkSize Tz) {
+	preallocate(s.buffer, chunkSize)
+	Preallocate(s.src, chunkSize)
+}
+
+func (s *reverseSource) Clone() Source {
+	return s.DeepClone(Source.Clone)
+}
+
+func (s *reverseSource) DeepClone(clone func(Source) Source) Source {
+	return &reverseSource{clone(s.src), make([]Buffer, len(s.buffer))}
+}
+
+// Silence returns Source of given length, sample rate and number of channels,
+// that contains only zeros. Length may be Infinite.
+func Silence(length, sampleRate Tz, numChannels int) Source {
+	return &silenceSource{length: length, rate: sampleRate, channels: numChannels}
+}
+
+type silenceSource struct {
+	length, rate Tz
+	channels     int
+	buffer       Buffer // shared by all channels, never written except growth
+}
+
+func (s *silenceSource) Samples(channel int, offset, length Tz) Buffer {
+	if Tz(len(s.buffer)) < length {
+		s.buffer = NewBuffer(length)
+	}
+	return s.buffer[0:length]
+}
+
+func (s *silenceSource) SampleRate() Tz {
+	return s.rate
+}
+
+func (s *silenceSource) NumChannels() int {
+	return s.channels
+}
+
+func (s *silenceSource) Length() Tz {
+	return s.length
+}
+
+func (s *silenceSource) Preallocate(chunkSize Tz) {
+	if Tz(len(s.buffer)) < chunkSize {
+		s.buffer = NewBuffer(chunkSize)
+	}
+}
+
+func (s *silenceSource) Clone() Source {
+	return Silence(s.length, s.rate, s.channels)
+}
+
+// preallocate grows buffers to chunkSize samples.
+func preallocate(buffers []Buffer, chunkSize Tz) {
+	for c := range buffers {
+		if Tz(cap(buffers[c])) < chunkSize {
+			buffers[c] = NewBuffer(chunkSize)
+		}
+	}
+}
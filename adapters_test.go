@@ -0,0 +1,167 @@
+package mix
+
+import (
+	"testing"
+)
+
+func rampSource(channels int, n Tz) MemSource {
+	res := MemSource{Rate: rate, Data: make([]Buffer, channels)}
+	for c := range res.Data {
+		res.Data[c] = NewBuffer(n)
+		for i := range res.Data[c] {
+			res.Data[c][i] = float32(100*c + i)
+		}
+	}
+	return res
+}
+
+func expectSamples(t *testing.T, name string, src Source, channel int,
+	offset Tz, expect Buffer) {
+
+	t.Helper()
+	res := src.Samples(channel, offset, Tz(len(expect)))
+	if len(res) != len(expect) {
+		t.Errorf("%s: invalid length %d, expected %d", name, len(res), len(expect))
+		return
+	}
+	for i := range res {
+		if res[i] != expect[i] {
+			t.Errorf("%s: invalid samples %v, expected %v", name, res, expect)
+			return
+		}
+	}
+}
+
+func TestSlice(t *testing.T) {
+	src := rampSource(2, 10)
+	s, err := Slice(src, 3, 4)
+	if err != nil {
+		t.Fatal("Error while slicing:", err)
+	}
+	if s.Length() != 4 || s.NumChannels() != 2 || !IsConcurrent(s) {
+		t.Error("Invalid slice", s.Length(), s.NumChannels())
+	}
+	expectSamples(t, "Slice", s, 1, 1, Buffer{104, 105, 106})
+
+	if s, _ := Slice(src, 3, 0); s.Length() != 7 {
+		t.Error("Invalid length of slice to the end", s.Length())
+	}
+	if s, _ := Slice(Loop(src), 3, 0); !IsUnbounded(s) {
+		t.Error("Slice of unbounded source is bounded", s.Length())
+	}
+	if _, err := Slice(src, 3, 8); err == nil {
+		t.Error("Slice out of source is accepted")
+	}
+	if _, err := Slice(src, -1, 1); err == nil {
+		t.Error("Negative offset is accepted")
+	}
+}
+
+func TestConcat(t *testing.T) {
+	a := rampSource(1, 3)
+	b := rampSource(1, 4)
+	c, err := Concat(a, b, Loop(a))
+	if err != nil {
+		t.Fatal("Error while concatenating:", err)
+	}
+	if !IsUnbounded(c) {
+		t.Error("Concat with unbounded tail is bounded", c.Length())
+	}
+	expectSamples(t, "Concat inside", c, 0, 3, Buffer{0, 1, 2})
+	expectSamples(t, "Concat across", c, 0, 1, Buffer{1, 2, 0, 1, 2, 3, 0, 1, 2, 0})
+
+	if _, err := Concat(Loop(a), b); err == nil {
+		t.Error("Unbounded source in the middle is accepted")
+	}
+	if _, err := Concat(a, rampSource(2, 3)); err == nil {
+		t.Error("Sources with different channels are accepted")
+	}
+	if c, _ := Concat(a, b); c.Length() != 7 {
+		t.Error("Invalid length of concatenation", c.Length())
+	}
+}
+
+func TestChannelAdapters(t *testing.T) {
+	mono := rampSource(1, 5)
+	stereo := rampSource(2, 5)
+
+	s, err := MonoToStereo(mono)
+	if err != nil || s.NumChannels() != 2 {
+		t.Fatal("Invalid mono to stereo:", err)
+	}
+	expectSamples(t, "MonoToStereo", s, 1, 2, Buffer{2, 3})
+	if _, err := MonoToStereo(stereo); err == nil {
+		t.Error("Stereo source is accepted as mono")
+	}
+
+	e, err := ExtractChannel(stereo, 1)
+	if err != nil || e.NumChannels() != 1 {
+		t.Fatal("Invalid extracted channel:", err)
+	}
+	expectSamples(t, "ExtractChannel", e, 0, 0, Buffer{100, 101})
+	if _, err := ExtractChannel(stereo, 2); err == nil {
+		t.Error("Invalid channel is accepted")
+	}
+
+	w, err := SwapChannels(stereo)
+	if err != nil {
+		t.Fatal("Error while swapping channels:", err)
+	}
+	expectSamples(t, "SwapChannels", w, 0, 3, Buffer{103, 104})
+	expectSamples(t, "SwapChannels", w, 1, 3, Buffer{3, 4})
+
+	m, err := Matrix(stereo, [][]float32{{0.5, 0.5}, {1, 0}, {0, -1}})
+	if err != nil || m.NumChannels() != 3 {
+		t.Fatal("Invalid matrix:", err)
+	}
+	expectSamples(t, "Matrix", m, 0, 1, Buffer{51, 52})
+	expectSamples(t, "Matrix", m, 1, 1, Buffer{1, 2})
+	expectSamples(t, "Matrix", m, 2, 1, Buffer{-101, -102})
+	if _, err := Matrix(stereo, [][]float32{{1}}); err == nil {
+		t.Error("Matrix of invalid size is accepted")
+	}
+}
+
+func TestGainReverseSilence(t *testing.T) {
+	src := rampSource(2, 5)
+	expectSamples(t, "Gain", Gain(src, 2), 1, 3, Buffer{206, 208})
+
+	r, err := Reverse(src)
+	if err != nil {
+		t.Fatal("Error while reversing:", err)
+	}
+	expectSamples(t, "Reverse", r, 0, 0, Buffer{4, 3, 2})
+	expectSamples(t, "Reverse", r, 1, 3, Buffer{101, 100})
+	if _, err := Reverse(Loop(src)); err == nil {
+		t.Error("Unbounded source is reversed")
+	}
+
+	f := FadeOut(src, 2, 2)
+	if f.Length() != 4 {
+		t.Error("Invalid length of fade out", f.Length())
+	}
+	expectSamples(t, "FadeOut", f, 1, 0, Buffer{100, 101, 102, 51.5})
+	expectSamples(t, "FadeOut", FadeOut(src, 5, 2), 0, 1, Buffer{1, 2, 3, 4})
+	// Reads past the end of fade are silent, even if src goes on.
+	ones := MemSource{Rate: rate, Data: []Buffer{{1, 1, 1, 1}}}
+	expectSamples(t, "FadeOut", FadeOut(Loop(ones), 2, 2), 0, 0,
+		Buffer{1, 1, 1, 0.5, 0, 0, 0, 0, 0, 0})
+	expectSamples(t, "FadeOut", FadeOut(Loop(ones), 2, 0), 0, 1,
+		Buffer{1, 0, 0, 0})
+
+	s := Silence(Infinite, rate, 2)
+	if !IsUnbounded(s) || s.NumChannels() != 2 || s.SampleRate() != rate {
+		t.Error("Invalid silence", s.Length(), s.NumChannels(), s.SampleRate())
+	}
+	expectSamples(t, "Silence", s, 1, 1<<40, Buffer{0, 0, 0})
+
+	// Adapters must be usable as regions of Session.
+	stereo, _ := MonoToStereo(Gain(getTestSource(1), 0.5))
+	sess := NewSession(rate)
+	if err := sess.AddRegion(Region{Source: stereo, Volume: 1}); err != nil {
+		t.Fatal("Error while adding adapter region:", err)
+	}
+	if sess.Samples(0, 0, 1)[0] == 0 {
+		t.Error("Adapter region is silent")
+	}
+}
@@ -0,0 +1,151 @@
+package mix
+
+import (
+	"container/list"
+	"errors"
+)
+
+// EnableCache makes Session keep rendered audio in blocks of blockSize samples,
+// so nested Session is not mixed again when it is played several times or
+// read at random positions. At most maxBlocks blocks are kept, least recently
+// used ones are dropped. Cache is invalidated when regions of Session or
+// its nested Sessions change.
+// Zero maxBlocks disables cache.
+//
+// Blocks are mixed at their own boundaries, so cached output may differ from
+// uncached one by float rounding in fades.
+func (s *Session) EnableCache(blockSize Tz, maxBlocks int) {
+	if maxBlocks <= 0 || blockSize <= 0 {
+		s.cache = nil
+		return
+	}
+	s.cache = newRenderCache(blockSize, maxBlocks)
+}
+
+// Bounce renders Session from 0 to Length() into MemSource.
+// Position of Session is not changed.
+func (s *Session) Bounce() (MemSource, error) {
+	const chunk = 1 << 16
+	if s.Length() == Infinite {
+		return MemSource{}, errors.New("Can't bounce unbounded session")
+	}
+	clone := s.Clone().(*Session)
+	clone.cache = nil
+	clone.buffer = nil
+	clone.SetPosition(0)
+
+	length := s.Length()
+	if length < 0 {
+		length = 0
+	}
+	res := MemSource{
+		Rate: s.sampleRate,
+		Data: make([]Buffer, numChannels),
+	}
+	for c := range res.Data {
+		res.Data[c] = NewBuffer(length)
+	}
+	for off := Tz(0); off < length; off += chunk {
+		end := off + chunk
+		if end > length {
+			end = length
+		}
+		clone.mix([]Buffer{res.Data[0][off:end], res.Data[1][off:end]})
+	}
+	return res, clone.Err()
+}
+
+type renderCache struct {
+	blockSize Tz
+	maxBlocks int
+	version   int
+	blocks    map[Tz]*list.Element
+	lru       *list.List // of *cacheBlock, most recent first
+	buffer    []Buffer   // for requests that span several blocks
+}
+
+type cacheBlock struct {
+	index Tz
+	data  []Buffer
+}
+
+func newRenderCache(blockSize Tz, maxBlocks int) *renderCache {
+	return &renderCache{
+		blockSize: blockSize,
+		maxBlocks: maxBlocks,
+		blocks:    make(map[Tz]*list.Element),
+		lru:       list.New(),
+		buffer:    make([]Buffer, numChannels),
+	}
+}
+
+func (c *renderCache) samples(s *Session, channel int, offset, length Tz) Buffer {
+	if v := s.treeVersion(); c.version != v {
+		c.blocks = make(map[Tz]*list.Element)
+		c.lru.Init()
+		c.version = v
+	}
+
+	first := floorDiv(offset, c.blockSize)
+	last := floorDiv(offset+length-1, c.blockSize)
+	if first == last || length == 0 {
+		b := c.block(s, first)
+		off := offset - first*c.blockSize
+		return b.data[channel][off : off+length]
+	}
+
+	if Tz(cap(c.buffer[channel])) < length {
+		c.buffer[channel] = NewBuffer(length)
+	}
+	res := c.buffer[channel][0:length]
+	for i := first; i <= last; i++ {
+		b := c.block(s, i)
+		beg := i * c.blockSize
+		src := b.data[channel]
+		if beg < offset {
+			src = src[offset-beg:]
+		} else {
+			res = res[beg-offset:]
+		}
+		copy(res, src)
+		res = c.buffer[channel][0:length]
+	}
+	return res
+}
+
+func (c *renderCache) block(s *Session, index Tz) *cacheBlock {
+	if e, ok := c.blocks[index]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cacheBlock)
+	}
+
+	var b *cacheBlock
+	if c.lru.Len() >= c.maxBlocks {
+		// Reuse memory of least recently used block.
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		b = e.Value.(*cacheBlock)
+		delete(c.blocks, b.index)
+		for _, d := range b.data {
+			d.Zero()
+		}
+	} else {
+		b = &cacheBlock{data: make([]Buffer, numChannels)}
+		for i := range b.data {
+			b.data[i] = NewBuffer(c.blockSize)
+		}
+	}
+	b.index = index
+	s.SetPosition(index * c.blockSize)
+	s.mix(b.data)
+	c.blocks[index] = c.lru.PushFront(b)
+	return b
+}
+
+func floorDiv(a, b Tz) Tz {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
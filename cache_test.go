@@ -0,0 +1,83 @@
+package mix
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRenderCache(t *testing.T) {
+	cached := getRenderSession()
+	cached.EnableCache(4096, 4)
+	plain := getRenderSession()
+
+	offsets := []Tz{0, 5000, -300, 100000, 4090, 4000, 123456, 5000, 0}
+	for _, off := range offsets {
+		for _, l := range []Tz{1, 10, 4096, 10000} {
+			for c := 0; c < numChannels; c++ {
+				exp := plain.Samples(c, off, l)
+				act := cached.Samples(c, off, l)
+				if Tz(len(act)) != l {
+					t.Fatal("Invalid length of cached samples", len(act), l)
+				}
+				for i := range exp {
+					if math.Abs(float64(exp[i]-act[i])) > 1e-3 {
+						t.Fatal("Cached samples are different at",
+							off+Tz(i), exp[i], act[i])
+					}
+				}
+			}
+		}
+	}
+	if cached.cache.lru.Len() > 4 || len(cached.cache.blocks) > 4 {
+		t.Error("Cache is not bounded:", cached.cache.lru.Len())
+	}
+
+	// Cache must be invalidated by new regions.
+	cached.Samples(0, 0, 100)
+	cached.AddRegion(Region{Source: getTestSource(1), Begin: 0, Volume: 1})
+	plain.AddRegion(Region{Source: getTestSource(1), Begin: 0, Volume: 1})
+	exp := plain.Samples(0, 0, 100)[50]
+	act := cached.Samples(0, 0, 100)[50]
+	if math.Abs(float64(exp-act)) > 1e-3 {
+		t.Error("Cache is not invalidated by AddRegion", exp, act)
+	}
+
+	// And by new regions of nested Session, also wrapped one.
+	nested := NewSession(rate)
+	nested.AddRegion(Region{Source: getTestSource(1), Begin: 0, Volume: 0})
+	outer := NewSession(rate)
+	outer.AddRegion(Region{Source: Gain(nested, 1), Volume: 1})
+	outer.EnableCache(4096, 4)
+	outer.Samples(0, 0, 100)
+	nested.AddRegion(Region{Source: getTestSource(1), Begin: 0, Volume: 1})
+	if v := outer.Samples(0, 0, 100)[50]; v == 0 {
+		t.Error("Cache is not invalidated by AddRegion of nested Session")
+	}
+}
+
+func TestBounce(t *testing.T) {
+	s := getRenderSession()
+	s.SetPosition(1000)
+	b, err := s.Bounce()
+	if err != nil {
+		t.Fatal("Error while bouncing:", err)
+	}
+	if s.Position() != 1000 {
+		t.Error("Bounce changed session position", s.Position())
+	}
+	if b.Length() != s.Length() || b.SampleRate() != rate {
+		t.Fatal("Invalid bounced source", b.Length(), b.SampleRate())
+	}
+	for _, off := range []Tz{0, 77777, s.Length() - 100} {
+		for c := 0; c < numChannels; c++ {
+			exp := s.Samples(c, off, 100)
+			act := b.Samples(c, off, 100)
+			for i := range exp {
+				if math.Abs(float64(exp[i]-act[i])) > 1e-3 {
+					t.Fatal("Bounced samples are different at",
+						off+Tz(i), exp[i], act[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Command mixrender renders project file or MIDI file to WAV or raw PCM.
+//
+// Usage:
+//
+//	mixrender [flags] input.json|input.mid
+//
+// Examples:
+//
+//	mixrender examples/sample.json | aplay
+//	mixrender -o out.wav -bits 16 -rate 48000 -from 10s -to 1m examples/sample.json
+//	mixrender -kit kit.json -o song.wav song.mid
+//
+// MIDI files need a kit file, that maps note numbers to audio files:
+//
+//	{"36": "audio/kick.ogg", "38": "audio/snare.ogg"}
+package main
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/project"
+	"github.com/kikht/mix/sox"
+
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	output   = flag.String("o", "-", "output file, - for stdout")
+	format   = flag.String("format", "wav", "output format: wav or raw")
+	bits     = flag.String("bits", "32f", "sample format: 16, 24, 32 or 32f for float")
+	rate     = flag.Int("rate", 0, "output sample rate, session rate by default")
+	from     = flag.Duration("from", 0, "start of rendered range")
+	to       = flag.Duration("to", 0, "end of rendered range, end of session by default")
+	chunk    = flag.Int("chunk", 1<<16, "number of samples mixed at once")
+	workers  = flag.Int("j", 1, "number of parallel mixing workers")
+	kit      = flag.String("kit", "", "kit file for MIDI input")
+	quiet    = flag.Bool("q", false, "do not show progress")
+	progress = os.Stderr
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("mixrender: ")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mixrender [flags] input.json|input.mid")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(input string) error {
+	sess, err := load(input)
+	if err != nil {
+		return err
+	}
+
+	sampleFormat, err := parseSampleFormat(*bits)
+	if err != nil {
+		return err
+	}
+	begin := sess.DurationToTz(*from)
+	end := sess.Length()
+	if *to != 0 {
+		end = sess.DurationToTz(*to)
+	} else if end == mix.Infinite {
+		return errors.New("Session is unbounded, set end of range with -to")
+	}
+	if begin < 0 || end < begin {
+		return fmt.Errorf("Invalid range %v - %v", *from, *to)
+	}
+	if *chunk <= 0 {
+		return errors.New("Chunk size must be positive")
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	outRate := sess.SampleRate()
+	if *rate != 0 {
+		outRate = mix.Tz(*rate)
+	}
+	var enc mix.Encoder
+	switch *format {
+	case "wav":
+		enc = mix.NewWavEncoder(out, outRate, sess.NumChannels(), sampleFormat)
+	case "raw":
+		enc = mix.NewRawEncoder(out, sampleFormat)
+	default:
+		return fmt.Errorf("Unknown output format %s", *format)
+	}
+	if outRate != sess.SampleRate() {
+		enc = newResampler(enc, sess.SampleRate(), outRate, sess.NumChannels())
+	}
+	sess.SetEncoder(enc)
+
+	// Interrupted render is stopped after the current chunk, its output is
+	// finished, but exit status reports failure.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	cancel := make(chan struct{})
+	go func() {
+		<-sigs
+		close(cancel)
+	}()
+
+	sess.SetPosition(begin)
+	if *workers > 1 {
+		// Workers clone session once, so whole range is rendered at once
+		// and progress is reported by encoder.
+		counter := &progressEncoder{Encoder: enc, total: end - begin,
+			rate: sess.SampleRate(), last: time.Now()}
+		err = mix.RenderParallelCancel(sess, counter, end-begin, mix.Tz(*chunk),
+			*workers, cancel)
+	} else {
+		err = play(sess, begin, end, cancel)
+	}
+	if err != nil {
+		if !*quiet {
+			fmt.Fprintln(progress)
+		}
+		enc.Close()
+		return err
+	}
+	if !*quiet {
+		report(end-begin, end-begin, sess.SampleRate())
+		fmt.Fprintln(progress)
+	}
+	return enc.Close()
+}
+
+// play renders session from begin to end by chunks.
+func play(sess *mix.Session, begin, end mix.Tz, cancel <-chan struct{}) error {
+	block := mix.Tz(*chunk)
+	lastReport := time.Now()
+	for pos := begin; pos < end; pos += block {
+		length := block
+		if pos+length > end {
+			length = end - pos
+		}
+		select {
+		case <-cancel:
+			return mix.ErrCanceled
+		default:
+		}
+		if err := sess.Play(length); err != nil {
+			return err
+		}
+		if !*quiet && time.Since(lastReport) > 200*time.Millisecond {
+			lastReport = time.Now()
+			report(sess.Position()-begin, end-begin, sess.SampleRate())
+		}
+	}
+	return nil
+}
+
+// progressEncoder reports progress of parallel rendering, when samples
+// are encoded.
+type progressEncoder struct {
+	mix.Encoder
+	done, total, rate mix.Tz
+	last              time.Time
+}
+
+func (e *progressEncoder) Encode(buffer []mix.Buffer) error {
+	e.done += mix.Tz(len(buffer[0]))
+	if !*quiet && time.Since(e.last) > 200*time.Millisecond {
+		e.last = time.Now()
+		report(e.done, e.total, e.rate)
+	}
+	return e.Encoder.Encode(buffer)
+}
+
+func report(done, total, rate mix.Tz) {
+	percent := 100.0
+	if total > 0 {
+		percent = 100 * float64(done) / float64(total)
+	}
+	fmt.Fprintf(progress, "\rrendered %v of %v (%.0f%%)",
+		tzToDuration(done, rate), tzToDuration(total, rate), percent)
+}
+
+func tzToDuration(tz, rate mix.Tz) time.Duration {
+	return (time.Duration(tz) * time.Second / time.Duration(rate)).
+		Round(100 * time.Millisecond)
+}
+
+func parseSampleFormat(s string) (mix.SampleFormat, error) {
+	switch s {
+	case "16":
+		return mix.Int16, nil
+	case "24":
+		return mix.Int24, nil
+	case "32":
+		return mix.Int32, nil
+	case "32f":
+		return mix.Float32, nil
+	}
+	return 0, fmt.Errorf("Unsupported sample format %s", s)
+}
+
+func load(input string) (*mix.Session, error) {
+	switch strings.ToLower(filepath.Ext(input)) {
+	case ".json":
+		return project.LoadMix(input, loadFile)
+	case ".mid", ".midi":
+		if *kit == "" {
+			return nil, errors.New("MIDI input requires -kit")
+		}
+		return loadMidi(input, *kit)
+	}
+	return nil, fmt.Errorf("Unknown input type %s", input)
+}
+
+func loadFile(ref project.SourceRef) (mix.Source, error) {
+	if ref.Loader != "" && ref.Loader != "sox" {
+		return nil, fmt.Errorf("Unknown loader %s", ref.Loader)
+	}
+	return sox.Load(ref.Path)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/project"
+
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// loadMidi builds Session from note-on events of standard MIDI file.
+// Notes are played with samples from kit, velocity controls volume.
+func loadMidi(path, kitPath string) (*mix.Session, error) {
+	kit, rate, err := loadKit(kitPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := parseMidi(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	sess := mix.NewSession(rate)
+	for _, n := range notes {
+		src, ok := kit[n.key]
+		if !ok {
+			continue
+		}
+		err := sess.AddRegion(mix.Region{
+			Source: src,
+			Begin:  mix.DurationToTz(n.time, rate),
+			Volume: float32(n.velocity) / 127,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: note %d at %v: %s", path, n.key, n.time, err)
+		}
+	}
+	return sess, nil
+}
+
+func loadKit(path string) (map[byte]mix.Source, mix.Tz, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	var paths map[string]string
+	if err := json.NewDecoder(file).Decode(&paths); err != nil {
+		return nil, 0, fmt.Errorf("%s: %s", path, err)
+	}
+
+	var (
+		res  = make(map[byte]mix.Source)
+		rate mix.Tz
+		dir  = filepath.Dir(path)
+	)
+	for key, p := range paths {
+		note, err := strconv.ParseUint(key, 10, 7)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: invalid note %q", path, key)
+		}
+		src, err := project.Open(project.SourceRef{Path: p}, dir, loadFile)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: note %d: %s", path, note, err)
+		}
+		if rate == 0 {
+			rate = src.SampleRate()
+		} else if rate != src.SampleRate() {
+			return nil, 0, fmt.Errorf("%s: note %d: sample rate %d is different "+
+				"from %d", path, note, src.SampleRate(), rate)
+		}
+		res[byte(note)] = src
+	}
+	if rate == 0 {
+		return nil, 0, fmt.Errorf("%s: kit is empty", path)
+	}
+	return res, rate, nil
+}
+
+type midiNote struct {
+	time          time.Duration
+	key, velocity byte
+}
+
+type midiEvent struct {
+	tick  uint64
+	tempo uint32 // microseconds per quarter, 0 for notes
+	note  midiNote
+}
+
+var errMidiTruncated = errors.New("Truncated MIDI file")
+
+// parseMidi returns note-on events from standard MIDI file of format 0 or 1.
+func parseMidi(data []byte) ([]midiNote, error) {
+	chunk := func() (string, []byte, error) {
+		if len(data) < 8 {
+			return "", nil, errMidiTruncated
+		}
+		id := string(data[0:4])
+		size := binary.BigEndian.Uint32(data[4:8])
+		if uint64(len(data)-8) < uint64(size) {
+			return "", nil, errMidiTruncated
+		}
+		body := data[8 : 8+size]
+		data = data[8+size:]
+		return id, body, nil
+	}
+
+	id, header, err := chunk()
+	if err != nil {
+		return nil, err
+	}
+	if id != "MThd" || len(header) < 6 {
+		return nil, errors.New("Not a MIDI file")
+	}
+	format := binary.BigEndian.Uint16(header[0:2])
+	numTracks := int(binary.BigEndian.Uint16(header[2:4]))
+	division := binary.BigEndian.Uint16(header[4:6])
+	if format > 1 {
+		return nil, fmt.Errorf("Unsupported MIDI format %d", format)
+	}
+
+	var events []midiEvent
+	for track := 0; track < numTracks && len(data) > 0; track++ {
+		id, body, err := chunk()
+		if err != nil {
+			return nil, err
+		}
+		if id != "MTrk" {
+			continue
+		}
+		events, err = parseTrack(body, events)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %s", track, err)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].tick < events[j].tick
+	})
+
+	// Convert ticks to time using tempo map.
+	var (
+		res      []midiNote
+		tempo    = uint64(500000) // 120 bpm
+		lastTick uint64
+		elapsed  time.Duration
+	)
+	tickDuration := func(ticks uint64) time.Duration {
+		if division&0x8000 != 0 {
+			// SMPTE: frames per second and ticks per frame
+			fps := uint64(-int8(division >> 8))
+			tpf := uint64(division & 0xff)
+			return time.Duration(ticks * uint64(time.Second) / (fps * tpf))
+		}
+		return time.Duration(ticks * tempo * uint64(time.Microsecond) /
+			uint64(division))
+	}
+	if division == 0 {
+		return nil, errors.New("Invalid MIDI time division")
+	}
+	for _, e := range events {
+		elapsed += tickDuration(e.tick - lastTick)
+		lastTick = e.tick
+		if e.tempo != 0 {
+			tempo = uint64(e.tempo)
+			continue
+		}
+		n := e.note
+		n.time = elapsed
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+func parseTrack(data []byte, events []midiEvent) ([]midiEvent, error) {
+	var (
+		tick    uint64
+		status  byte
+		pos     int
+		readVar = func() (uint64, error) {
+			var v uint64
+			for i := 0; i < 4; i++ {
+				if pos >= len(data) {
+					return 0, errMidiTruncated
+				}
+				b := data[pos]
+				pos++
+				v = v<<7 | uint64(b&0x7f)
+				if b&0x80 == 0 {
+					return v, nil
+				}
+			}
+			return 0, errors.New("Invalid variable length value")
+		}
+	)
+
+	for pos < len(data) {
+		delta, err := readVar()
+		if err != nil {
+			return nil, err
+		}
+		tick += delta
+		if pos >= len(data) {
+			return nil, errMidiTruncated
+		}
+		if data[pos]&0x80 != 0 {
+			status = data[pos]
+			pos++
+		} else if status == 0 {
+			return nil, errors.New("Running status without previous status")
+		}
+
+		switch {
+		case status == 0xff:
+			if pos >= len(data) {
+				return nil, errMidiTruncated
+			}
+			typ := data[pos]
+			pos++
+			size, err := readVar()
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(data)-pos) < size {
+				return nil, errMidiTruncated
+			}
+			if typ == 0x51 && size == 3 {
+				b := data[pos : pos+3]
+				tempo := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+				events = append(events, midiEvent{tick: tick, tempo: tempo})
+			}
+			pos += int(size)
+			status = 0
+		case status == 0xf0 || status == 0xf7:
+			size, err := readVar()
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(data)-pos) < size {
+				return nil, errMidiTruncated
+			}
+			pos += int(size)
+			status = 0
+		default:
+			size := 2
+			if kind := status & 0xf0; kind == 0xc0 || kind == 0xd0 {
+				size = 1
+			}
+			if len(data)-pos < size {
+				return nil, errMidiTruncated
+			}
+			if status&0xf0 == 0x90 && data[pos+1] > 0 {
+				events = append(events, midiEvent{tick: tick,
+					note: midiNote{key: data[pos], velocity: data[pos+1]}})
+			}
+			pos += size
+		}
+	}
+	return events, nil
+}
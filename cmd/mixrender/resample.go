@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/kikht/mix"
+)
+
+// resampler is an Encoder, that converts sample rate with linear
+// interpolation and passes result to another Encoder.
+type resampler struct {
+	out  mix.Encoder
+	step float64 // input samples per output sample
+	pos  float64 // position of next output sample relative to current input
+	last []float32
+	buf  []mix.Buffer
+}
+
+func newResampler(out mix.Encoder, from, to mix.Tz, channels int) *resampler {
+	return &resampler{
+		out:  out,
+		step: float64(from) / float64(to),
+		last: make([]float32, channels),
+		buf:  make([]mix.Buffer, channels),
+	}
+}
+
+func (r *resampler) Encode(buffer []mix.Buffer) error {
+	if len(buffer) == 0 || len(buffer[0]) == 0 {
+		return nil
+	}
+	n := len(buffer[0])
+	for c, src := range buffer {
+		dst := r.buf[c][0:0]
+		pos := r.pos
+		for ; pos < float64(n-1); pos += r.step {
+			i := int(pos+1) - 1 // floor for pos >= -1
+			frac := float32(pos - float64(i))
+			prev := r.last[c]
+			if i >= 0 {
+				prev = src[i]
+			}
+			dst = append(dst, prev+(src[i+1]-prev)*frac)
+		}
+		r.buf[c] = dst
+		r.last[c] = src[n-1]
+		if c == len(buffer)-1 {
+			r.pos = pos - float64(n)
+		}
+	}
+	return r.out.Encode(r.buf)
+}
+
+func (r *resampler) Close() error {
+	return r.out.Close()
+}
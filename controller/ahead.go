@@ -37,7 +37,12 @@ func (c *AheadController) Mix() mix.Source {
 	return c.mix
 }
 
+// pos returns the earliest position, where mutation could be heard.
+// Players without mix.PositionPlayer are approximated by wall clock.
 func (c *AheadController) pos() mix.Tz {
+	if p, ok := c.player.(mix.PositionPlayer); ok {
+		return p.Position() + p.Latency()
+	}
 	if c.start.IsZero() {
 		c.start = time.Now()
 		return c.ahead
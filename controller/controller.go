@@ -2,10 +2,10 @@ package controller
 
 import (
 	"github.com/kikht/mix"
+	"github.com/kikht/mix/rtlog"
 	"github.com/kikht/mix/session"
 
 	"fmt"
-	"log"
 	"sort"
 )
 
@@ -23,30 +23,38 @@ type Controller struct {
 	ambience map[string]Ambience
 	music    map[string]Music
 	effect   map[string]Effect
+	volumes  [numCategories]*volume
+
+	zones        []string
+	categoryZone [numCategories]int
+	soundZone    map[string]int
 
 	lastAmbience string
+	onLabel      func(label string)
 }
 
 func NewController(fade mix.Tz, player mix.PlayerState) Controller {
 	return Controller{
-		fade:     fade,
-		ambience: make(map[string]Ambience),
-		music:    make(map[string]Music),
-		effect:   make(map[string]Effect),
-		player:   player,
+		fade:      fade,
+		ambience:  make(map[string]Ambience),
+		music:     make(map[string]Music),
+		effect:    make(map[string]Effect),
+		player:    player,
+		volumes:   [...]*volume{newVolume(), newVolume(), newVolume()},
+		soundZone: make(map[string]int),
 	}
 }
 
 func (c *Controller) AddAmbience(label string, sound mix.Source) {
-	c.ambience[label] = Ambience(sound)
+	c.ambience[label] = Ambience(c.withVolume(CategoryAmbience, sound))
 }
 
 func (c *Controller) AddMusic(label string, sound mix.Source, after string) {
-	c.music[label] = Music{sound, after}
+	c.music[label] = Music{c.withVolume(CategoryMusic, sound), after}
 }
 
 func (c *Controller) AddEffect(label string, sound mix.Source) {
-	c.effect[label] = Effect(sound)
+	c.effect[label] = Effect(c.withVolume(CategoryEffect, sound))
 }
 
 func (c *Controller) Actions() [][]string {
@@ -71,8 +79,11 @@ func (c *Controller) Ambience(label string) (mix.SourceMutator, error) {
 	if !ok {
 		return nil, fmt.Errorf("Ambience %s is not found", label)
 	}
-	c.lastAmbience = label
-	return session.NewAmbience(amb, c.fade, c.player.ChunkSize()), nil
+	c.setLabel(label)
+	return c.zoned(func(zone int) mix.SourceMutator {
+		return session.NewAmbience(c.routed(zone, CategoryAmbience, label, amb),
+			c.fade, c.player.ChunkSize())
+	}), nil
 }
 
 func (c *Controller) Music(label string) (mix.SourceMutator, error) {
@@ -89,8 +100,30 @@ func (c *Controller) Music(label string) (mix.SourceMutator, error) {
 		return nil, fmt.Errorf("Ambience %s after music %s is not found",
 			ambLabel, label)
 	}
+	c.setLabel(label)
+	return c.zoned(func(zone int) mix.SourceMutator {
+		return session.NewMusic(c.routed(zone, CategoryMusic, label, mus),
+			c.routed(zone, CategoryAmbience, ambLabel, amb),
+			c.fade, c.player.ChunkSize())
+	}), nil
+}
+
+// Label returns label of current ambience or music.
+func (c *Controller) Label() string {
+	return c.lastAmbience
+}
+
+// OnLabel sets function, that is called with label of ambience or music,
+// when it is started by action, e.g. to update stream metadata.
+func (c *Controller) OnLabel(f func(label string)) {
+	c.onLabel = f
+}
+
+func (c *Controller) setLabel(label string) {
 	c.lastAmbience = label
-	return session.NewMusic(mus, amb, c.fade, c.player.ChunkSize()), nil
+	if c.onLabel != nil {
+		c.onLabel(label)
+	}
 }
 
 func (c *Controller) Effect(label string) (mix.SourceMutator, error) {
@@ -101,14 +134,17 @@ func (c *Controller) Effect(label string) (mix.SourceMutator, error) {
 
 	//TODO: fix when it is the first action
 	mutator := func(cur mix.Source, pos mix.Tz) mix.Source {
-		log.Println("Generating effect", pos)
+		rtlog.Log("Generating effect", int64(pos))
+		chunkSize := c.player.ChunkSize()
 		var next *session.Session
 		next, ok := cur.(*session.Session)
 		if ok && next.Length() > pos {
 			next = next.Clone().(*session.Session)
 		} else {
 			next = session.NewSession(c.player.SampleRate(), true)
+			next.Preallocate(chunkSize)
 		}
+		mix.Preallocate(eff, chunkSize)
 		next.AddRegion(session.Region{
 			Source:  eff,
 			Begin:   pos,
@@ -119,7 +155,12 @@ func (c *Controller) Effect(label string) (mix.SourceMutator, error) {
 		})
 		return next
 	}
-	return mix.SourceMutatorFunc(mutator), nil
+	return c.zoned(func(zone int) mix.SourceMutator {
+		if !c.plays(zone, CategoryEffect, label) {
+			return mix.SourceMutatorFunc(keep)
+		}
+		return mix.SourceMutatorFunc(mutator)
+	}), nil
 }
 
 func (c *Controller) Action(label string) (mix.SourceMutator, error) {
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"github.com/kikht/mix"
+
+	"math"
+	"sync/atomic"
+)
+
+// Category is a kind of sounds of Controller, that share volume.
+type Category int
+
+const (
+	CategoryAmbience Category = iota
+	CategoryMusic
+	CategoryEffect
+	numCategories
+)
+
+// volume is gain of category, that could be changed while sounds are
+// played. It is stored as float32 bits.
+type volume struct {
+	bits uint32 // atomic
+}
+
+func newVolume() *volume {
+	return &volume{math.Float32bits(1)}
+}
+
+func (v *volume) get() float32 {
+	return math.Float32frombits(atomic.LoadUint32(&v.bits))
+}
+
+func (v *volume) set(gain float32) {
+	atomic.StoreUint32(&v.bits, math.Float32bits(gain))
+}
+
+// SetVolume sets gain of all sounds of category, including already playing
+// ones. Gain is ramped to the new one across the next rendered chunk, so that
+// change does not click. It is safe to call concurrently with playback.
+func (c *Controller) SetVolume(category Category, gain float32) {
+	c.volumes[category].set(gain)
+}
+
+// Volume returns gain of category.
+func (c *Controller) Volume(category Category) float32 {
+	return c.volumes[category].get()
+}
+
+// withVolume returns src, that is multiplied by current gain of category.
+func (c *Controller) withVolume(category Category, src mix.Source) mix.Source {
+	res := newVolumeSource(src, c.volumes[category])
+	res.Preallocate(c.player.ChunkSize())
+	return res
+}
+
+// volumeSource ramps gain from one chunk to the next one, so that changes
+// of volume do not click.
+type volumeSource struct {
+	src    mix.Source
+	volume *volume
+	buffer []mix.Buffer
+	gain   []float32 // gain at end of last chunk of every channel
+}
+
+func newVolumeSource(src mix.Source, volume *volume) *volumeSource {
+	res := &volumeSource{
+		src:    src,
+		volume: volume,
+		buffer: make([]mix.Buffer, src.NumChannels()),
+		gain:   make([]float32, src.NumChannels()),
+	}
+	for c := range res.gain {
+		res.gain[c] = volume.get()
+	}
+	return res
+}
+
+func (s *volumeSource) Samples(channel int, offset, length mix.Tz) mix.Buffer {
+	gain, prev := s.volume.get(), s.gain[channel]
+	s.gain[channel] = gain
+	if gain == 1 && prev == 1 {
+		return s.src.Samples(channel, offset, length)
+	}
+	if mix.Tz(cap(s.buffer[channel])) < length {
+		s.buffer[channel] = mix.NewBuffer(length)
+	}
+	res := s.buffer[channel][0:length]
+	if gain == prev {
+		res.CopyGain(s.src.Samples(channel, offset, length), gain)
+	} else {
+		copy(res, s.src.Samples(channel, offset, length))
+		res.LinearRamp(prev, gain)
+	}
+	return res
+}
+
+func (s *volumeSource) SampleRate() mix.Tz {
+	return s.src.SampleRate()
+}
+
+func (s *volumeSource) NumChannels() int {
+	return s.src.NumChannels()
+}
+
+func (s *volumeSource) Length() mix.Tz {
+	return s.src.Length()
+}
+
+func (s *volumeSource) Err() error {
+	return mix.SourceErr(s.src)
+}
+
+func (s *volumeSource) Preallocate(chunkSize mix.Tz) {
+	s.allocate(chunkSize)
+	mix.Preallocate(s.src, chunkSize)
+}
+
+func (s *volumeSource) allocate(chunkSize mix.Tz) {
+	for c := range s.buffer {
+		if mix.Tz(cap(s.buffer[c])) < chunkSize {
+			s.buffer[c] = mix.NewBuffer(chunkSize)
+		}
+	}
+}
+
+// Clone returns volumeSource with buffers of the same size, so that it does
+// not allocate, if original one does not.
+func (s *volumeSource) Clone() mix.Source {
+	res := newVolumeSource(s.src.Clone(), s.volume)
+	res.allocate(mix.Tz(cap(s.buffer[0])))
+	return res
+}
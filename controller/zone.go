@@ -0,0 +1,223 @@
+package controller
+
+import (
+	"github.com/kikht/mix"
+
+	"fmt"
+)
+
+// AddZone adds stereo output zone. Output of Controller with zones has
+// two channels per zone in order of AddZone, so every zone could be routed
+// to its own speakers, e.g. by ports of JACK stream. All zones are played
+// by the same player, so they stay sample-aligned. Sounds are played in
+// the first zone, unless they are routed elsewhere.
+func (c *Controller) AddZone(name string) error {
+	if _, ok := c.zone(name); ok {
+		return fmt.Errorf("Zone %s already exists", name)
+	}
+	c.zones = append(c.zones, name)
+	return nil
+}
+
+// Zones returns names of zones in order of their channels.
+func (c *Controller) Zones() []string {
+	return append([]string(nil), c.zones...)
+}
+
+// ChannelNames returns names of output channels, e.g. for ports of
+// stream: "<zone>_L" and "<zone>_R" for every zone.
+func (c *Controller) ChannelNames() []string {
+	if len(c.zones) == 0 {
+		return []string{"L", "R"}
+	}
+	res := make([]string, 0, 2*len(c.zones))
+	for _, name := range c.zones {
+		res = append(res, name+"_L", name+"_R")
+	}
+	return res
+}
+
+// NumChannels returns number of output channels of Controller.
+func (c *Controller) NumChannels() int {
+	if len(c.zones) == 0 {
+		return 2
+	}
+	return 2 * len(c.zones)
+}
+
+// RouteCategory plays all sounds of category in zone.
+func (c *Controller) RouteCategory(category Category, zone string) error {
+	z, ok := c.zone(zone)
+	if !ok {
+		return fmt.Errorf("Zone %s is not found", zone)
+	}
+	c.categoryZone[category] = z
+	return nil
+}
+
+// RouteSound plays sound with label in zone regardless of its category.
+func (c *Controller) RouteSound(label, zone string) error {
+	z, ok := c.zone(zone)
+	if !ok {
+		return fmt.Errorf("Zone %s is not found", zone)
+	}
+	c.soundZone[label] = z
+	return nil
+}
+
+func (c *Controller) zone(name string) (int, bool) {
+	for i, other := range c.zones {
+		if other == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// plays reports whether sound of category with label is played in zone.
+func (c *Controller) plays(zone int, category Category, label string) bool {
+	z, ok := c.soundZone[label]
+	if !ok {
+		z = c.categoryZone[category]
+	}
+	return z == zone || len(c.zones) == 0
+}
+
+// routed returns src as it is heard in zone: sounds of other zones are
+// replaced by silence of the same length.
+func (c *Controller) routed(zone int, category Category, label string,
+	src mix.Source) mix.Source {
+
+	if c.plays(zone, category, label) {
+		return src
+	}
+	return mix.Silence(src.Length(), src.SampleRate(), src.NumChannels())
+}
+
+// keep is mutator, that leaves current source of zone as it is.
+func keep(cur mix.Source, pos mix.Tz) mix.Source {
+	return cur
+}
+
+// zoned returns mutator, that applies mutator of every zone to its part
+// of current source. Source played before zones were used goes to the
+// first zone.
+func (c *Controller) zoned(gen func(zone int) mix.SourceMutator) mix.SourceMutator {
+	if len(c.zones) == 0 {
+		return gen(0)
+	}
+	numZones, rate := len(c.zones), c.player.SampleRate()
+	chunkSize := c.player.ChunkSize()
+	mutator := func(cur mix.Source, pos mix.Tz) mix.Source {
+		prev, ok := cur.(*zoneSource)
+		if !ok {
+			prev = &zoneSource{zones: make([]mix.Source, numZones)}
+			prev.zones[0] = cur
+		}
+		res := newZoneSource(rate, numZones)
+		res.allocate(chunkSize)
+		for z := range res.zones {
+			var zcur mix.Source
+			if z < len(prev.zones) {
+				zcur = prev.zones[z]
+			}
+			res.zones[z] = gen(z).Mutate(zcur, pos)
+		}
+		return res
+	}
+	return mix.SourceMutatorFunc(mutator)
+}
+
+// zoneSource plays stereo sources of zones side by side.
+type zoneSource struct {
+	rate   mix.Tz
+	zones  []mix.Source
+	buffer []mix.Buffer
+}
+
+func newZoneSource(sampleRate mix.Tz, numZones int) *zoneSource {
+	return &zoneSource{
+		rate:   sampleRate,
+		zones:  make([]mix.Source, numZones),
+		buffer: make([]mix.Buffer, 2*numZones),
+	}
+}
+
+// Samples returns samples of zone source, that are padded with silence
+// after its end.
+func (s *zoneSource) Samples(channel int, offset, length mix.Tz) mix.Buffer {
+	src := s.zones[channel/2]
+	if src != nil && offset+length <= src.Length() {
+		return src.Samples(channel%2%src.NumChannels(), offset, length)
+	}
+
+	if mix.Tz(cap(s.buffer[channel])) < length {
+		s.buffer[channel] = mix.NewBuffer(length)
+	}
+	res := s.buffer[channel][0:length]
+	res.Zero()
+	if src != nil && offset < src.Length() {
+		n := src.Length() - offset
+		copy(res, src.Samples(channel%2%src.NumChannels(), offset, n))
+	}
+	return res
+}
+
+func (s *zoneSource) SampleRate() mix.Tz {
+	return s.rate
+}
+
+func (s *zoneSource) NumChannels() int {
+	return 2 * len(s.zones)
+}
+
+func (s *zoneSource) Length() mix.Tz {
+	var res mix.Tz
+	for _, src := range s.zones {
+		if src != nil && src.Length() > res {
+			res = src.Length()
+		}
+	}
+	return res
+}
+
+func (s *zoneSource) Err() error {
+	for _, src := range s.zones {
+		if src == nil {
+			continue
+		}
+		if err := mix.SourceErr(src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *zoneSource) Preallocate(chunkSize mix.Tz) {
+	s.allocate(chunkSize)
+	for _, src := range s.zones {
+		if src != nil {
+			mix.Preallocate(src, chunkSize)
+		}
+	}
+}
+
+// allocate allocates own buffers of zoneSource. Sources of zones are not
+// preallocated, e.g. current ones, that are already played.
+func (s *zoneSource) allocate(chunkSize mix.Tz) {
+	for c := range s.buffer {
+		if mix.Tz(cap(s.buffer[c])) < chunkSize {
+			s.buffer[c] = mix.NewBuffer(chunkSize)
+		}
+	}
+}
+
+func (s *zoneSource) Clone() mix.Source {
+	res := newZoneSource(s.rate, len(s.zones))
+	for z, src := range s.zones {
+		if src != nil {
+			res.zones[z] = src.Clone()
+		}
+	}
+	return res
+}
@@ -0,0 +1,297 @@
+package mix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"syscall"
+)
+
+// Encoder writes audio data in some output format.
+type Encoder interface {
+	// Encode writes buffers, one per channel. All buffers must be of equal length.
+	Encode(buffer []Buffer) error
+	// Close finalizes output. It does not close underlying io.Writer.
+	Close() error
+}
+
+// SampleFormat defines how samples are stored in output.
+type SampleFormat int
+
+const (
+	Float32 SampleFormat = iota // 32-bit IEEE float
+	Int16                       // 16-bit signed integer
+	Int24                       // 24-bit signed integer
+	Int32                       // 32-bit signed integer
+)
+
+// Bits returns number of bits per sample.
+func (f SampleFormat) Bits() int {
+	switch f {
+	case Int16:
+		return 16
+	case Int24:
+		return 24
+	default:
+		return 32
+	}
+}
+
+func (f SampleFormat) String() string {
+	if f == Float32 {
+		return "float32"
+	}
+	return fmt.Sprintf("int%d", f.Bits())
+}
+
+// put stores little-endian sample v into b. Integer samples are clipped.
+func (f SampleFormat) put(b []byte, v float32) {
+	if f == Float32 {
+		binary.LittleEndian.PutUint32(b, math.Float32bits(v))
+		return
+	}
+	switch f {
+	case Int16:
+		binary.LittleEndian.PutUint16(b, uint16(f.integer(v)))
+	case Int24:
+		i := f.integer(v)
+		b[0], b[1], b[2] = byte(i), byte(i>>8), byte(i>>16)
+	case Int32:
+		binary.LittleEndian.PutUint32(b, uint32(f.integer(v)))
+	}
+}
+
+// integer converts sample v to integer sample of format. v is clamped to
+// [-1, 1].
+func (f SampleFormat) integer(v float32) int32 {
+	if v > 1 {
+		v = 1
+	} else if v < -1 {
+		v = -1
+	}
+	switch f {
+	case Int16:
+		return int32(int16(v * math.MaxInt16))
+	case Int24:
+		return int32(v * (1<<23 - 1))
+	default:
+		return int32(float64(v) * math.MaxInt32)
+	}
+}
+
+// NewRawEncoder creates Encoder that writes interleaved little-endian samples
+// without any header.
+func NewRawEncoder(w io.Writer, format SampleFormat) Encoder {
+	return &rawEncoder{out: bufio.NewWriter(w), format: format}
+}
+
+type rawEncoder struct {
+	out    *bufio.Writer
+	format SampleFormat
+	sample []byte
+}
+
+func (e *rawEncoder) Encode(buffer []Buffer) error {
+	if len(buffer) == 0 {
+		return nil
+	}
+	length := len(buffer[0])
+	for _, b := range buffer {
+		if len(b) != length {
+			return errors.New("Buffers of different length")
+		}
+	}
+
+	size := e.format.Bits() / 8
+	if len(e.sample) != size {
+		e.sample = make([]byte, size)
+	}
+	for i := 0; i < length; i++ {
+		for _, b := range buffer {
+			e.format.put(e.sample, b[i])
+			e.out.Write(e.sample)
+		}
+	}
+	return e.out.Flush()
+}
+
+func (e *rawEncoder) Close() error {
+	return e.out.Flush()
+}
+
+// NewWavEncoder creates Encoder that writes WAV file.
+// If w implements io.WriterAt, header is updated after each Encode,
+// so output is always a valid file. Otherwise header contains maximum
+// possible size, that is usual for streaming.
+func NewWavEncoder(w io.Writer, sampleRate Tz, numChannels int,
+	format SampleFormat) Encoder {
+
+	return &wavEncoder{
+		output:      w,
+		raw:         rawEncoder{out: bufio.NewWriter(w), format: format},
+		sampleRate:  sampleRate,
+		numChannels: numChannels,
+	}
+}
+
+type wavEncoder struct {
+	output      io.Writer
+	raw         rawEncoder
+	sampleRate  Tz
+	numChannels int
+	numOut      Tz
+	started     bool
+}
+
+func (e *wavEncoder) Encode(buffer []Buffer) error {
+	if len(buffer) != e.numChannels {
+		return fmt.Errorf("Expected %d channels, got %d",
+			e.numChannels, len(buffer))
+	}
+	if !e.started {
+		if _, err := e.output.Write(e.header(-1)); err != nil {
+			return err
+		}
+		e.started = true
+	}
+	if err := e.raw.Encode(buffer); err != nil {
+		return err
+	}
+	e.numOut += Tz(len(buffer[0]))
+	if err := e.updateHeader(); err != nil {
+		return errors.New("error while updating WAV header: " + err.Error())
+	}
+	return nil
+}
+
+func (e *wavEncoder) Close() error {
+	if !e.started {
+		// Write empty, but valid file.
+		e.started = true
+		_, err := e.output.Write(e.header(0))
+		return err
+	}
+	return e.updateHeader()
+}
+
+// WAV functions
+
+const (
+	formatPCM          = 1
+	formatFloat        = 3
+	sampleFormatSuffix = "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xAA\x00\x38\x9B\x71"
+
+	extSize        = 2 + 4 + 16
+	fmtSize        = 2 + 2 + 4 + 4 + 2 + 2 + 2 + extSize
+	riffSizeOff    = 4
+	riffHeaderSize = 4 + 4 + 4 + fmtSize + 4 + 4
+	dataSizeOff    = riffHeaderSize + 4
+)
+
+func (e *wavEncoder) blockAlign() Tz {
+	return Tz(e.numChannels * e.raw.format.Bits() / 8)
+}
+
+func (e *wavEncoder) sizes(numSamples Tz) (riffSize, dataSize uint32) {
+	if numSamples < 0 {
+		riffSize = math.MaxUint32
+		dataSize = riffSize - riffHeaderSize
+	} else {
+		dataSize = uint32(numSamples * e.blockAlign())
+		riffSize = dataSize + riffHeaderSize
+	}
+	return
+}
+
+func (e *wavEncoder) header(numSamples Tz) []byte {
+	var (
+		blockAlign         = e.blockAlign()
+		byteRate           = e.sampleRate * blockAlign
+		bits               = e.raw.format.Bits()
+		riffSize, dataSize = e.sizes(numSamples)
+		sampleFormat       = formatPCM
+	)
+	if e.raw.format == Float32 {
+		sampleFormat = formatFloat
+	}
+
+	//  0  4 "RIFF"
+	//  4  4 riffSize = header + samples * byteRate (or just maximum possible)
+	//  8  4 "WAVE"
+	// 12  4 "fmt "
+	// 16  4 fmtSize
+	// 20  2 smplFmt
+	// 22  2 numChan
+	// 24  4 smpRate
+	// 28  4 byteRate
+	// 32  2 block
+	// 34  2 bits
+	// 36  2 extSize
+	// 38  2 validBits
+	// 40  4 channelMask
+	// 44 16 format
+	// 60  4 "data"
+	// 64  4 dataSize = samples * byteRate
+	// 68  ...
+
+	buf := new(bytes.Buffer)
+	buf.Write([]byte("RIFF"))
+	binary.Write(buf, binary.LittleEndian, uint32(riffSize))
+	buf.Write([]byte("WAVE"))
+	buf.Write([]byte("fmt "))
+	binary.Write(buf, binary.LittleEndian, uint32(fmtSize))
+	binary.Write(buf, binary.LittleEndian, uint16(sampleFormat))
+	binary.Write(buf, binary.LittleEndian, uint16(e.numChannels))
+	binary.Write(buf, binary.LittleEndian, uint32(e.sampleRate))
+	binary.Write(buf, binary.LittleEndian, uint32(byteRate))
+	binary.Write(buf, binary.LittleEndian, uint16(blockAlign))
+	binary.Write(buf, binary.LittleEndian, uint16(bits))
+	binary.Write(buf, binary.LittleEndian, uint16(extSize))
+	binary.Write(buf, binary.LittleEndian, uint16(bits))
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	binary.Write(buf, binary.LittleEndian, uint16(sampleFormat))
+	buf.Write([]byte(sampleFormatSuffix))
+	buf.Write([]byte("data"))
+	binary.Write(buf, binary.LittleEndian, uint32(dataSize))
+
+	return buf.Bytes()
+}
+
+func (e *wavEncoder) updateHeader() error {
+	if w, ok := e.output.(io.WriterAt); ok {
+		var (
+			buf                = make([]byte, 4)
+			riffSize, dataSize = e.sizes(e.numOut)
+			err                error
+		)
+		binary.LittleEndian.PutUint32(buf, riffSize)
+		_, err = w.WriteAt(buf, riffSizeOff)
+		if err != nil {
+			if isPipeErr(err) {
+				return nil
+			}
+			return err
+		}
+		binary.LittleEndian.PutUint32(buf, dataSize)
+		_, err = w.WriteAt(buf, dataSizeOff)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isPipeErr(err error) bool {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	if err == syscall.ESPIPE {
+		return true
+	}
+	return false
+}
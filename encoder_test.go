@@ -0,0 +1,78 @@
+package mix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWavEncoderFormats(t *testing.T) {
+	buf := []Buffer{{0, 0.5, -1, 2}, {1, -0.5, 0, -2}}
+	tests := []struct {
+		format SampleFormat
+		tag    uint16
+		first  []byte // encoding of buf[0][1]
+	}{
+		{Float32, formatFloat, []byte{0, 0, 0, 0x3f}},
+		{Int16, formatPCM, []byte{0xff, 0x3f}},
+		{Int24, formatPCM, []byte{0xff, 0xff, 0x3f}},
+		{Int32, formatPCM, []byte{0xff, 0xff, 0xff, 0x3f}},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		enc := NewWavEncoder(&out, rate, 2, test.format)
+		if err := enc.Encode(buf); err != nil {
+			t.Fatal("Error while encoding:", err)
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal("Error while closing:", err)
+		}
+
+		data := out.Bytes()
+		size := test.format.Bits() / 8
+		if len(data) != riffHeaderSize+8+len(buf[0])*2*size {
+			t.Errorf("%v: invalid output length %d", test.format, len(data))
+			continue
+		}
+		if tag := binary.LittleEndian.Uint16(data[20:22]); tag != test.tag {
+			t.Errorf("%v: invalid format tag %d", test.format, tag)
+		}
+		if bits := binary.LittleEndian.Uint16(data[34:36]); int(bits) != test.format.Bits() {
+			t.Errorf("%v: invalid bits per sample %d", test.format, bits)
+		}
+		samples := data[riffHeaderSize+8:]
+		if got := samples[2*size : 3*size]; !bytes.Equal(got, test.first) {
+			t.Errorf("%v: invalid sample encoding %v, expected %v",
+				test.format, got, test.first)
+		}
+	}
+}
+
+func TestRawEncoderClip(t *testing.T) {
+	var out bytes.Buffer
+	enc := NewRawEncoder(&out, Int16)
+	enc.Encode([]Buffer{{2, -2}})
+	enc.Close()
+	data := out.Bytes()
+	if v := int16(binary.LittleEndian.Uint16(data[0:2])); v != 32767 {
+		t.Error("Invalid positive clip", v)
+	}
+	if v := int16(binary.LittleEndian.Uint16(data[2:4])); v != -32767 {
+		t.Error("Invalid negative clip", v)
+	}
+}
+
+func TestWavEncoderEmpty(t *testing.T) {
+	var out bytes.Buffer
+	enc := NewWavEncoder(&out, rate, 2, Int16)
+	if err := enc.Close(); err != nil {
+		t.Fatal("Error while closing:", err)
+	}
+	data := out.Bytes()
+	if len(data) != riffHeaderSize+8 {
+		t.Fatal("Invalid empty file length", len(data))
+	}
+	if size := binary.LittleEndian.Uint32(data[dataSizeOff:]); size != 0 {
+		t.Error("Invalid data size of empty file", size)
+	}
+}
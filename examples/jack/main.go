@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/kikht/mix"
 	"github.com/kikht/mix/examples"
 	"github.com/kikht/mix/jack"
 	"log"
@@ -8,10 +9,19 @@ import (
 
 func main() {
 	sess := examples.SampleSession("examples/audio/")
-	stream, err := jack.NewStream(sess.NumChannels())
+	client, err := jack.Open(jack.Config{Connect: jack.ConnectPhysical})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	stream, err := client.NewStream(sess.NumChannels())
 	if err == nil {
+		mix.Preallocate(sess, stream.ChunkSize())
 		stream.Play(sess)
 		<-stream.End()
+		if err := stream.Err(); err != nil {
+			log.Println(err)
+		}
 	} else {
 		log.Println(err)
 	}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/examples"
+	"github.com/kikht/mix/pipe"
+	"log"
+)
+
+func main() {
+	sess := examples.SampleSession("examples/audio/")
+	stream, err := pipe.Command(pipe.Config{NumChannels: sess.NumChannels()},
+		"aplay", "-q", "-")
+	if err == nil {
+		mix.Preallocate(sess, stream.ChunkSize())
+		stream.Play(sess)
+		<-stream.End()
+		if err := stream.Err(); err != nil {
+			log.Println(err)
+		}
+		stream.Close()
+	} else {
+		log.Println(err)
+	}
+}
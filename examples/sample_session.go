@@ -38,6 +38,9 @@ func SampleSession(audioPath string) *mix.Session {
 		drums.AddRegion(mix.Region{Source: snare, Begin: s, Volume: 1, Pan: 0.1})
 	}
 
+	// Drums are played in every bar, so keep them rendered.
+	drums.EnableCache(whole/4, 8)
+
 	sess.AddRegion(mix.Region{Source: drums, Begin: 0, Volume: 1, FadeIn: whole})
 	for b := mix.Tz(whole); b < (bars-1)*whole; b += whole {
 		sess.AddRegion(mix.Region{Source: drums, Begin: b, Volume: 1})
@@ -12,6 +12,9 @@ func main() {
 	if err == nil {
 		stream.Play(sess)
 		<-stream.End()
+		if err := stream.Err(); err != nil {
+			log.Println(err)
+		}
 	} else {
 		log.Println(err)
 	}
@@ -0,0 +1,329 @@
+package mix
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Minimum and maximum number of samples in FLAC frame. Longer buffers are
+// split, shorter ones are valid only at the end of stream.
+const (
+	flacMinBlock = 16
+	flacMaxBlock = 4096
+)
+
+// NewFlacEncoder creates Encoder that writes FLAC stream of Int16 or Int24
+// samples. Stream uses variable block size, each Encode writes frames of
+// 16 to 4096 samples, so that encoded audio is available without delay,
+// e.g. for live streaming. Buffers shorter than 16 samples are written as
+// short frames, that are valid only at the end of stream, so all Encode
+// calls except the last one should pass at least 16 samples.
+// Total length and MD5 sum are not stored.
+func NewFlacEncoder(w io.Writer, sampleRate Tz, numChannels int,
+	format SampleFormat) (Encoder, error) {
+
+	if format != Int16 && format != Int24 {
+		return nil, fmt.Errorf("FLAC does not support %s samples", format)
+	}
+	if numChannels < 1 || numChannels > 8 {
+		return nil, fmt.Errorf("FLAC does not support %d channels", numChannels)
+	}
+	if sampleRate <= 0 || sampleRate >= 1<<20 {
+		return nil, fmt.Errorf("FLAC does not support sample rate %d", sampleRate)
+	}
+	return &flacEncoder{
+		out:         bufio.NewWriter(w),
+		format:      format,
+		sampleRate:  sampleRate,
+		numChannels: numChannels,
+		samples:     make([]int32, flacMaxBlock),
+		residual:    make([]int32, flacMaxBlock),
+	}, nil
+}
+
+type flacEncoder struct {
+	out         *bufio.Writer
+	format      SampleFormat
+	sampleRate  Tz
+	numChannels int
+	numOut      Tz
+	started     bool
+
+	bits     bitWriter
+	samples  []int32 // current channel of frame
+	residual []int32
+}
+
+func (e *flacEncoder) Encode(buffer []Buffer) error {
+	if len(buffer) != e.numChannels {
+		return fmt.Errorf("Expected %d channels, got %d",
+			e.numChannels, len(buffer))
+	}
+	length := len(buffer[0])
+	for _, b := range buffer {
+		if len(b) != length {
+			return errors.New("Buffers of different length")
+		}
+	}
+	if !e.started {
+		e.out.Write(e.header())
+		e.started = true
+	}
+	for beg := 0; beg < length; {
+		end := beg + flacMaxBlock
+		if end > length {
+			end = length
+		} else if rest := length - end; rest > 0 && rest < flacMinBlock {
+			// Leave enough samples for the last frame.
+			end = length - flacMinBlock
+		}
+		e.frame(buffer, beg, end)
+		e.out.Write(e.bits.buf)
+		beg = end
+	}
+	return e.out.Flush()
+}
+
+func (e *flacEncoder) Close() error {
+	if !e.started {
+		// Write empty, but valid stream.
+		e.started = true
+		e.out.Write(e.header())
+	}
+	return e.out.Flush()
+}
+
+// header returns stream marker and STREAMINFO block.
+func (e *flacEncoder) header() []byte {
+	var b bitWriter
+	b.buf = append(b.buf, "fLaC"...)
+	b.write(1, 1)   // last metadata block
+	b.write(0, 7)   // STREAMINFO
+	b.write(34, 24) // block length
+	b.write(flacMinBlock, 16)
+	b.write(flacMaxBlock, 16)
+	b.write(0, 24) // unknown minimum frame size
+	b.write(0, 24) // unknown maximum frame size
+	b.write(uint64(e.sampleRate), 20)
+	b.write(uint64(e.numChannels-1), 3)
+	b.write(uint64(e.format.Bits()-1), 5)
+	b.write(0, 36) // unknown total samples
+	for i := 0; i < 4; i++ {
+		b.write(0, 32) // unknown MD5
+	}
+	return b.buf
+}
+
+// frame encodes samples [beg, end) of buffer to e.bits.
+func (e *flacEncoder) frame(buffer []Buffer, beg, end int) {
+	n := end - beg
+	b := &e.bits
+	b.reset()
+	b.write(0x3ffe, 14) // sync code
+	b.write(0, 1)
+	b.write(1, 1) // variable block size
+	b.write(7, 4) // block size is stored after coded number
+	b.write(0, 4) // sample rate from STREAMINFO
+	b.write(uint64(e.numChannels-1), 4)
+	if e.format == Int16 {
+		b.write(4, 3)
+	} else {
+		b.write(6, 3)
+	}
+	b.write(0, 1)
+	b.writeUTF8(uint64(e.numOut))
+	b.write(uint64(n-1), 16)
+	b.write(uint64(crc8(b.buf)), 8)
+
+	for _, buf := range buffer {
+		samples := e.samples[0:n]
+		for i, v := range buf[beg:end] {
+			samples[i] = e.format.integer(v)
+		}
+		e.subframe(samples)
+	}
+	b.align()
+	crc := crc16(b.buf)
+	b.write(uint64(crc), 16)
+	e.numOut += Tz(n)
+}
+
+// subframe encodes one channel with constant, fixed or verbatim coding,
+// whichever is the shortest.
+func (e *flacEncoder) subframe(samples []int32) {
+	b := &e.bits
+	bps := uint(e.format.Bits())
+	constant := true
+	for _, v := range samples[1:] {
+		if v != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		b.write(0, 8) // CONSTANT
+		b.writeSigned(samples[0], bps)
+		return
+	}
+
+	bestOrder, bestParam, bestSize := -1, uint(0), uint64(len(samples))*uint64(bps)
+	for order := 0; order <= 4 && order < len(samples); order++ {
+		param, size := riceParam(fixedResidual(samples, order, e.residual))
+		size += uint64(order) * uint64(bps)
+		if param <= 14 && size < bestSize {
+			bestOrder, bestParam, bestSize = order, param, size
+		}
+	}
+	if bestOrder < 0 {
+		b.write(2, 8) // VERBATIM
+		for _, v := range samples {
+			b.writeSigned(v, bps)
+		}
+		return
+	}
+
+	b.write(uint64(0x08|bestOrder)<<1, 8) // FIXED
+	for _, v := range samples[0:bestOrder] {
+		b.writeSigned(v, bps)
+	}
+	b.write(0, 2) // Rice coding with 4-bit parameter
+	b.write(0, 4) // single partition
+	b.write(uint64(bestParam), 4)
+	for _, r := range fixedResidual(samples, bestOrder, e.residual) {
+		u := uint64(zigzag(r))
+		b.writeUnary(u >> bestParam)
+		b.write(u&(1<<bestParam-1), bestParam)
+	}
+}
+
+// fixedResidual computes residual of fixed polynomial predictor of order.
+func fixedResidual(samples []int32, order int, residual []int32) []int32 {
+	res := residual[0 : len(samples)-order]
+	for i := range res {
+		j := i + order
+		switch order {
+		case 0:
+			res[i] = samples[j]
+		case 1:
+			res[i] = samples[j] - samples[j-1]
+		case 2:
+			res[i] = samples[j] - 2*samples[j-1] + samples[j-2]
+		case 3:
+			res[i] = samples[j] - 3*samples[j-1] + 3*samples[j-2] - samples[j-3]
+		case 4:
+			res[i] = samples[j] - 4*samples[j-1] + 6*samples[j-2] -
+				4*samples[j-3] + samples[j-4]
+		}
+	}
+	return res
+}
+
+// riceParam returns the best Rice parameter for residual and size of
+// coded residual in bits.
+func riceParam(residual []int32) (uint, uint64) {
+	var sum uint64
+	for _, r := range residual {
+		sum += uint64(zigzag(r))
+	}
+	var param uint
+	for n := uint64(len(residual)); n > 0 && n<<(param+1) < sum; {
+		param++
+	}
+	size := uint64(len(residual)) * uint64(param+1)
+	for _, r := range residual {
+		size += uint64(zigzag(r)) >> param
+	}
+	return param, size + 4
+}
+
+func zigzag(v int32) uint32 {
+	return uint32(v<<1) ^ uint32(v>>31)
+}
+
+// bitWriter writes big-endian bit fields to byte slice.
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) reset() {
+	b.buf, b.acc, b.nbits = b.buf[:0], 0, 0
+}
+
+// write writes n lowest bits of v, n <= 32.
+func (b *bitWriter) write(v uint64, n uint) {
+	b.acc = b.acc<<n | v&(1<<n-1)
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.nbits -= 8
+		b.buf = append(b.buf, byte(b.acc>>b.nbits))
+	}
+}
+
+func (b *bitWriter) writeSigned(v int32, n uint) {
+	b.write(uint64(uint32(v)), n)
+}
+
+// writeUnary writes v zeros followed by one.
+func (b *bitWriter) writeUnary(v uint64) {
+	for ; v >= 32; v -= 32 {
+		b.write(0, 32)
+	}
+	b.write(1, uint(v)+1)
+}
+
+// writeUTF8 writes v in UTF-8 like coding of FLAC frame header.
+func (b *bitWriter) writeUTF8(v uint64) {
+	if v < 0x80 {
+		b.write(v, 8)
+		return
+	}
+	n := uint(2) // number of bytes
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	b.write(0xff<<(8-n)&0xff|v>>(6*(n-1)), 8)
+	for i := n - 1; i > 0; i-- {
+		b.write(0x80|v>>(6*(i-1))&0x3f, 8)
+	}
+}
+
+// align pads last byte with zero bits.
+func (b *bitWriter) align() {
+	if b.nbits > 0 {
+		b.write(0, 8-b.nbits)
+	}
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, d := range data {
+		crc ^= d
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, d := range data {
+		crc ^= uint16(d) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,201 @@
+package mix
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+// bitReader reads big-endian bit fields for FLAC decoder of tests.
+type bitReader struct {
+	data []byte
+	pos  uint // in bits
+}
+
+func (r *bitReader) read(n uint) uint64 {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) signed(n uint) int32 {
+	return int32(int64(r.read(n)<<(64-n)) >> (64 - n))
+}
+
+func (r *bitReader) utf8() uint64 {
+	first := r.read(8)
+	n := uint(0)
+	for first&(0x80>>n) != 0 {
+		n++
+	}
+	if n == 0 {
+		return first
+	}
+	v := first & (0xff >> (n + 1))
+	for i := uint(1); i < n; i++ {
+		v = v<<6 | r.read(8)&0x3f
+	}
+	return v
+}
+
+// decodeFlac decodes subset of FLAC, that is written by flacEncoder.
+func decodeFlac(data []byte) (rate Tz, bps uint, res [][]int32, err error) {
+	if !bytes.HasPrefix(data, []byte("fLaC")) {
+		return 0, 0, nil, errors.New("No FLAC marker")
+	}
+	r := &bitReader{data: data, pos: 32}
+	if last, typ, size := r.read(1), r.read(7), r.read(24); last != 1 || typ != 0 || size != 34 {
+		return 0, 0, nil, errors.New("Invalid STREAMINFO header")
+	}
+	minBlock, maxBlock := int(r.read(16)), int(r.read(16))
+	r.read(24 + 24)
+	rate = Tz(r.read(20))
+	numChannels := int(r.read(3) + 1)
+	bps = uint(r.read(5) + 1)
+	r.read(36 + 128)
+	res = make([][]int32, numChannels)
+
+	for r.pos/8 < uint(len(data)) {
+		start := r.pos / 8
+		if r.read(14) != 0x3ffe || r.read(1) != 0 || r.read(1) != 1 || r.read(4) != 7 ||
+			r.read(4) != 0 || int(r.read(4))+1 != numChannels {
+			return 0, 0, nil, errors.New("Invalid frame header")
+		}
+		r.read(3 + 1)
+		if num := r.utf8(); num != uint64(len(res[0])) {
+			return 0, 0, nil, errors.New("Invalid sample number")
+		}
+		n := int(r.read(16) + 1)
+		if n > maxBlock {
+			return 0, 0, nil, errors.New("Frame is longer than maximum block size")
+		}
+		if crc := byte(r.read(8)); crc != crc8(data[start:r.pos/8-1]) {
+			return 0, 0, nil, errors.New("Invalid header CRC")
+		}
+		for c := range res {
+			typ := r.read(8) >> 1
+			switch {
+			case typ == 0:
+				v := r.signed(bps)
+				for i := 0; i < n; i++ {
+					res[c] = append(res[c], v)
+				}
+			case typ == 1:
+				for i := 0; i < n; i++ {
+					res[c] = append(res[c], r.signed(bps))
+				}
+			case typ&0x38 == 0x08:
+				order := int(typ & 7)
+				s := make([]int32, 0, n)
+				for i := 0; i < order; i++ {
+					s = append(s, r.signed(bps))
+				}
+				if r.read(2) != 0 || r.read(4) != 0 {
+					return 0, 0, nil, errors.New("Unsupported residual")
+				}
+				param := uint(r.read(4))
+				for i := order; i < n; i++ {
+					q := uint64(0)
+					for r.read(1) == 0 {
+						q++
+					}
+					u := q<<param | r.read(param)
+					v := int32(u>>1) ^ -int32(u&1)
+					switch order {
+					case 1:
+						v += s[i-1]
+					case 2:
+						v += 2*s[i-1] - s[i-2]
+					case 3:
+						v += 3*s[i-1] - 3*s[i-2] + s[i-3]
+					case 4:
+						v += 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+					}
+					s = append(s, v)
+				}
+				res[c] = append(res[c], s...)
+			default:
+				return 0, 0, nil, errors.New("Unsupported subframe")
+			}
+		}
+		if r.pos%8 != 0 {
+			r.read(8 - r.pos%8)
+		}
+		if crc := uint16(r.read(16)); crc != crc16(data[start:r.pos/8-2]) {
+			return 0, 0, nil, errors.New("Invalid frame CRC")
+		}
+		// Only the last frame may be shorter.
+		if n < minBlock && r.pos/8 < uint(len(data)) {
+			return 0, 0, nil, errors.New("Frame is shorter than minimum block size")
+		}
+	}
+	return rate, bps, res, nil
+}
+
+func TestFlacEncoder(t *testing.T) {
+	for _, format := range []SampleFormat{Int16, Int24} {
+		var out bytes.Buffer
+		enc, err := NewFlacEncoder(&out, 44100, 2, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Sine, noise, constant and short buffers use different subframes.
+		// Buffer of 4100 samples must not end by frame shorter than 16.
+		// Sine is clipped.
+		sine, noise := NewBuffer(10000), NewBuffer(10000)
+		seed := uint32(1)
+		for i := range sine {
+			sine[i] = float32(1.25 * math.Sin(float64(i)/20))
+			seed = seed*1664525 + 1013904223
+			noise[i] = float32(int32(seed)) / math.MaxInt32
+		}
+		silence := NewBuffer(5000)
+		chunks := [][]Buffer{{sine, noise}, {silence, sine[0:5000]},
+			{noise[0:4100], sine[0:4100]}, {sine[0:3], noise[0:3]}}
+		for _, chunk := range chunks {
+			if err := enc.Encode(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if format.integer(1.25) != format.integer(1) ||
+			format.integer(-1.25) != format.integer(-1) {
+			t.Fatal("Samples are not clamped")
+		}
+		rate, bps, res, err := decodeFlac(out.Bytes())
+		if err != nil {
+			t.Fatal("Can not decode", format, "stream:", err)
+		}
+		if rate != 44100 || int(bps) != format.Bits() || len(res) != 2 ||
+			len(res[0]) != 19103 {
+			t.Fatal("Invalid stream", rate, bps, len(res), len(res[0]))
+		}
+		pos := 0
+		for _, chunk := range chunks {
+			for c, buf := range chunk {
+				for i, v := range buf {
+					if res[c][pos+i] != format.integer(v) {
+						t.Fatalf("Invalid %s sample %d of channel %d: %d, expected %d",
+							format, pos+i, c, res[c][pos+i], format.integer(v))
+					}
+				}
+			}
+			pos += len(chunk[0])
+		}
+		if out.Len() > 19103*2*format.Bits()/8 {
+			t.Error("Stream is not compressed", out.Len())
+		}
+	}
+
+	if _, err := NewFlacEncoder(&bytes.Buffer{}, 44100, 2, Float32); err == nil {
+		t.Error("Float samples are accepted")
+	}
+}
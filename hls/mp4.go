@@ -0,0 +1,254 @@
+package hls
+
+import (
+	"github.com/kikht/mix"
+
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	mp4InitName = "init.mp4"
+	mp4MaxFrame = 4096 // samples in FLAC frame, that is MP4 sample
+	mp4MinFrame = 16   // shorter FLAC frames are valid only at end of stream
+	mp4Track    = 1
+)
+
+// mp4Muxer writes FLAC stream as fragmented MP4: initialization segment
+// with FLAC header and media segments with one fragment of FLAC frames.
+type mp4Muxer struct {
+	sampleRate  mix.Tz
+	numChannels int
+	format      mix.SampleFormat
+	encoder     mix.Encoder
+	data        bytes.Buffer // output of encoder
+	header      []byte       // FLAC marker and STREAMINFO
+	numOut      mix.Tz       // decode time of the next segment
+	sequence    uint32       // number of the next fragment
+	part        []mix.Buffer
+}
+
+func newMP4Muxer(sampleRate mix.Tz, numChannels int,
+	format mix.SampleFormat) (*mp4Muxer, error) {
+
+	m := &mp4Muxer{
+		sampleRate:  sampleRate,
+		numChannels: numChannels,
+		format:      format,
+		sequence:    1,
+		part:        make([]mix.Buffer, numChannels),
+	}
+	var err error
+	m.encoder, err = mix.NewFlacEncoder(&m.data, sampleRate, numChannels, format)
+	if err != nil {
+		return nil, err
+	}
+	// Empty chunk makes encoder write its header.
+	if err := m.encoder.Encode(make([]mix.Buffer, numChannels)); err != nil {
+		return nil, err
+	}
+	m.header = append([]byte(nil), m.data.Bytes()...)
+	m.data.Reset()
+	return m, nil
+}
+
+// init returns initialization segment.
+func (m *mp4Muxer) init() []byte {
+	var b mp4Writer
+	b.open("ftyp")
+	b.write([]byte("iso6"), uint32(0), []byte("iso6mp41"))
+	b.close()
+
+	b.open("moov")
+	b.openFull("mvhd", 0, 0)
+	b.write(uint32(0), uint32(0), uint32(m.sampleRate), uint32(0),
+		uint32(0x00010000), uint16(0x0100), make([]byte, 10), mp4Matrix,
+		make([]byte, 24), uint32(mp4Track+1))
+	b.close()
+
+	b.open("trak")
+	b.openFull("tkhd", 0, 3) // enabled and in movie
+	b.write(uint32(0), uint32(0), uint32(mp4Track), uint32(0), uint32(0),
+		make([]byte, 8), uint16(0), uint16(0), uint16(0x0100), uint16(0),
+		mp4Matrix, uint32(0), uint32(0))
+	b.close()
+	b.open("mdia")
+	b.openFull("mdhd", 0, 0)
+	b.write(uint32(0), uint32(0), uint32(m.sampleRate), uint32(0),
+		uint16(0x55c4), uint16(0)) // "und" language
+	b.close()
+	b.openFull("hdlr", 0, 0)
+	b.write(uint32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+	b.close()
+	b.open("minf")
+	b.openFull("smhd", 0, 0)
+	b.write(uint32(0))
+	b.close()
+	b.open("dinf")
+	b.openFull("dref", 0, 0)
+	b.write(uint32(1))
+	b.openFull("url ", 0, 1) // media is in the same file
+	b.close()
+	b.close()
+	b.close()
+	b.open("stbl")
+	b.openFull("stsd", 0, 0)
+	b.write(uint32(1))
+	m.sampleEntry(&b)
+	b.close()
+	for _, empty := range []string{"stts", "stsc", "stco"} {
+		b.openFull(empty, 0, 0)
+		b.write(uint32(0))
+		b.close()
+	}
+	b.openFull("stsz", 0, 0)
+	b.write(uint32(0), uint32(0))
+	b.close()
+	b.close() // stbl
+	b.close() // minf
+	b.close() // mdia
+	b.close() // trak
+
+	b.open("mvex")
+	b.openFull("trex", 0, 0)
+	b.write(uint32(mp4Track), uint32(1), uint32(0), uint32(0), uint32(0))
+	b.close()
+	b.close()
+	b.close() // moov
+	return b.buf.Bytes()
+}
+
+// sampleEntry writes FLAC sample entry with STREAMINFO of encoder.
+func (m *mp4Muxer) sampleEntry(b *mp4Writer) {
+	rate := uint32(m.sampleRate) << 16
+	if m.sampleRate > 0xffff {
+		rate = 0 // Actual rate is in STREAMINFO.
+	}
+	b.open("fLaC")
+	b.write(make([]byte, 6), uint16(1), make([]byte, 8),
+		uint16(m.numChannels), uint16(m.format.Bits()), uint16(0), uint16(0), rate)
+	b.openFull("dfLa", 0, 0)
+	b.write(m.header[4:]) // metadata blocks after "fLaC" marker
+	b.close()
+	b.close()
+}
+
+// segment returns encoder of media segment, that is written to w on Close.
+func (m *mp4Muxer) segment(w io.Writer) mix.Encoder {
+	return &mp4Segment{muxer: m, output: w}
+}
+
+type mp4Segment struct {
+	muxer     *mp4Muxer
+	output    io.Writer
+	mdat      bytes.Buffer
+	sizes     []uint32 // of FLAC frames
+	durations []uint32
+	length    mix.Tz
+}
+
+// Encode encodes every 4096 samples of buffer as FLAC frame. The last frame
+// is not shorter than 16 samples, unless whole buffer is.
+func (s *mp4Segment) Encode(buffer []mix.Buffer) error {
+	m := s.muxer
+	length := len(buffer[0])
+	for beg := 0; beg < length; {
+		end := beg + mp4MaxFrame
+		if end > length {
+			end = length
+		} else if rest := length - end; rest > 0 && rest < mp4MinFrame {
+			end = length - mp4MinFrame
+		}
+		for c, buf := range buffer {
+			m.part[c] = buf[beg:end]
+		}
+		m.data.Reset()
+		if err := m.encoder.Encode(m.part); err != nil {
+			return err
+		}
+		s.mdat.Write(m.data.Bytes())
+		s.sizes = append(s.sizes, uint32(m.data.Len()))
+		s.durations = append(s.durations, uint32(end-beg))
+		s.length += mix.Tz(end - beg)
+		beg = end
+	}
+	return nil
+}
+
+// Close writes fragment of encoded frames.
+func (s *mp4Segment) Close() error {
+	m := s.muxer
+	var b mp4Writer
+	b.open("styp")
+	b.write([]byte("msdh"), uint32(0), []byte("msdhmsix"))
+	b.close()
+
+	b.open("moof")
+	b.openFull("mfhd", 0, 0)
+	b.write(m.sequence)
+	b.close()
+	b.open("traf")
+	b.openFull("tfhd", 0, 0x020000) // default-base-is-moof
+	b.write(uint32(mp4Track))
+	b.close()
+	b.openFull("tfdt", 1, 0)
+	b.write(uint64(m.numOut))
+	b.close()
+	// Sample duration, sample size and data offset are present.
+	b.openFull("trun", 0, 0x000301)
+	b.write(uint32(len(s.sizes)))
+	offset := b.buf.Len()
+	b.write(uint32(0))
+	for i, size := range s.sizes {
+		b.write(s.durations[i], size)
+	}
+	b.close()
+	b.close() // traf
+	moof := b.close()
+	// Data starts after moof and header of mdat.
+	binary.BigEndian.PutUint32(b.buf.Bytes()[offset:],
+		uint32(b.buf.Len()-moof+8))
+
+	b.open("mdat")
+	b.write(s.mdat.Bytes())
+	b.close()
+
+	m.numOut += s.length
+	m.sequence++
+	_, err := s.output.Write(b.buf.Bytes())
+	return err
+}
+
+var mp4Matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// mp4Writer writes nested boxes of ISO base media file.
+type mp4Writer struct {
+	buf   bytes.Buffer
+	boxes []int // offsets of open boxes
+}
+
+func (b *mp4Writer) open(kind string) {
+	b.boxes = append(b.boxes, b.buf.Len())
+	b.write(uint32(0), []byte(kind))
+}
+
+func (b *mp4Writer) openFull(kind string, version uint8, flags uint32) {
+	b.open(kind)
+	b.write(uint32(version)<<24 | flags)
+}
+
+// close writes size of the last open box and returns its offset.
+func (b *mp4Writer) close() int {
+	beg := b.boxes[len(b.boxes)-1]
+	b.boxes = b.boxes[0 : len(b.boxes)-1]
+	binary.BigEndian.PutUint32(b.buf.Bytes()[beg:], uint32(b.buf.Len()-beg))
+	return beg
+}
+
+// write writes big-endian fields.
+func (b *mp4Writer) write(fields ...interface{}) {
+	for _, f := range fields {
+		binary.Write(&b.buf, binary.BigEndian, f)
+	}
+}
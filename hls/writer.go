@@ -0,0 +1,255 @@
+// Package hls writes mix as HTTP Live Streaming playlist of fixed-length
+// segments on local disk, so that long sessions could be scrubbed later in
+// browser. Writer is mix.Encoder, it records live mix of real-time stream
+//
+//	w, err := hls.NewWriter(hls.Config{Dir: "evening", Container: hls.MP4,
+//		Format: mix.Int16})
+//	if err != nil {
+//		return err
+//	}
+//	stream := pipe.NewEncoderStream(w, pipe.Config{Format: mix.Int16})
+//	defer stream.Close()
+//	ctrl := controller.NewSwitchController(stream)
+//
+// or renders session offline with mix.RenderParallel. Serve Dir by any
+// static HTTP server and open its playlist by HLS player.
+package hls
+
+import (
+	"github.com/kikht/mix"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Container is format of segments.
+type Container int
+
+const (
+	MP4  Container = iota // fragmented MP4 of FLAC frames, needs Int16 or Int24
+	WAV                   // WAV files
+	FLAC                  // FLAC files, needs Int16 or Int24
+)
+
+// Config describes output of Writer. Zero fields are replaced by defaults.
+type Config struct {
+	Dir         string // directory of playlist and segments, created if needed
+	Playlist    string // "index.m3u8" by default
+	SampleRate  mix.Tz // 44100 by default
+	NumChannels int    // 2 by default
+	Container   Container
+	Format      mix.SampleFormat
+	// SegmentLength is number of samples in segment, 6 seconds by default.
+	SegmentLength mix.Tz
+	// MaxSegments limits number of segments in playlist. Older segments
+	// are removed from disk. Zero keeps all segments, so that playlist
+	// is event playlist, that grows until Close.
+	MaxSegments int
+}
+
+// Writer is mix.Encoder, that splits encoded stream to segments. Playlist
+// is updated after every segment, Close writes the last short segment
+// and ends playlist.
+type Writer struct {
+	cfg      Config
+	mp4      *mp4Muxer
+	segment  mix.Encoder  // current segment, nil between segments
+	file     *os.File     // of current segment
+	length   mix.Tz       // number of samples in current segment
+	sequence int          // number of the next segment
+	segments []segmentRef // segments of playlist
+	first    int          // media sequence number of segments[0]
+	part     []mix.Buffer
+}
+
+type segmentRef struct {
+	name   string
+	length mix.Tz
+}
+
+// NewWriter creates Dir and initialization segment of MP4 container.
+// Playlist and segments of previous Writer in Dir are overwritten.
+func NewWriter(cfg Config) (*Writer, error) {
+	if cfg.Playlist == "" {
+		cfg.Playlist = "index.m3u8"
+	}
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 44100
+	}
+	if cfg.NumChannels == 0 {
+		cfg.NumChannels = 2
+	}
+	if cfg.SegmentLength == 0 {
+		cfg.SegmentLength = 6 * cfg.SampleRate
+	}
+	if cfg.SegmentLength < 0 || cfg.MaxSegments < 0 {
+		return nil, errors.New("Invalid segment limits")
+	}
+	if cfg.Container != WAV && cfg.Format != mix.Int16 && cfg.Format != mix.Int24 {
+		return nil, fmt.Errorf("FLAC does not support %s samples", cfg.Format)
+	}
+	if cfg.Container > FLAC {
+		return nil, fmt.Errorf("Unknown container %d", cfg.Container)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		cfg:  cfg,
+		part: make([]mix.Buffer, cfg.NumChannels),
+	}
+	if cfg.Container == MP4 {
+		var err error
+		w.mp4, err = newMP4Muxer(cfg.SampleRate, cfg.NumChannels, cfg.Format)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(w.path(mp4InitName), w.mp4.init(), 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Encode writes buffer to segments and starts new segment after every
+// SegmentLength samples.
+func (w *Writer) Encode(buffer []mix.Buffer) error {
+	if len(buffer) != w.cfg.NumChannels {
+		return fmt.Errorf("Expected %d channels, got %d",
+			w.cfg.NumChannels, len(buffer))
+	}
+	length := mix.Tz(len(buffer[0]))
+	for beg := mix.Tz(0); beg < length; {
+		if w.segment == nil {
+			if err := w.startSegment(); err != nil {
+				return err
+			}
+		}
+		end := beg + w.cfg.SegmentLength - w.length
+		if end > length {
+			end = length
+		}
+		for c, buf := range buffer {
+			w.part[c] = buf[beg:end]
+		}
+		if err := w.segment.Encode(w.part); err != nil {
+			return err
+		}
+		w.length += end - beg
+		beg = end
+		if w.length == w.cfg.SegmentLength {
+			if err := w.finishSegment(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close finishes the last segment and ends playlist.
+func (w *Writer) Close() error {
+	if w.segment != nil {
+		if err := w.finishSegment(); err != nil {
+			return err
+		}
+	}
+	return w.writePlaylist(true)
+}
+
+func (w *Writer) path(name string) string {
+	return filepath.Join(w.cfg.Dir, name)
+}
+
+func (w *Writer) startSegment() error {
+	ext := [...]string{MP4: "m4s", WAV: "wav", FLAC: "flac"}[w.cfg.Container]
+	name := fmt.Sprintf("segment%05d.%s", w.sequence, ext)
+	file, err := os.Create(w.path(name))
+	if err != nil {
+		return err
+	}
+	var segment mix.Encoder
+	switch w.cfg.Container {
+	case MP4:
+		segment = w.mp4.segment(file)
+	case WAV:
+		segment = mix.NewWavEncoder(file, w.cfg.SampleRate, w.cfg.NumChannels,
+			w.cfg.Format)
+	case FLAC:
+		segment, err = mix.NewFlacEncoder(file, w.cfg.SampleRate,
+			w.cfg.NumChannels, w.cfg.Format)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.segment, w.file, w.length = segment, file, 0
+	w.segments = append(w.segments, segmentRef{name, 0})
+	w.sequence++
+	return nil
+}
+
+// finishSegment closes current segment, adds it to playlist and removes
+// segments beyond MaxSegments.
+func (w *Writer) finishSegment() error {
+	err := w.segment.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.segment, w.file = nil, nil
+	if err != nil {
+		return fmt.Errorf("Can not write segment: %v", err)
+	}
+	w.segments[len(w.segments)-1].length = w.length
+
+	for w.cfg.MaxSegments > 0 && len(w.segments) > w.cfg.MaxSegments {
+		if err := os.Remove(w.path(w.segments[0].name)); err != nil {
+			return err
+		}
+		w.segments = w.segments[1:]
+		w.first++
+	}
+	return w.writePlaylist(false)
+}
+
+// writePlaylist replaces playlist atomically, so that players never read
+// partial playlist.
+func (w *Writer) writePlaylist(end bool) error {
+	var buf bytes.Buffer
+	version := 3
+	if w.cfg.Container == MP4 {
+		version = 7
+	}
+	target := math.Ceil(float64(w.cfg.SegmentLength) / float64(w.cfg.SampleRate))
+	fmt.Fprintf(&buf, "#EXTM3U\n#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&buf, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	fmt.Fprintf(&buf, "#EXT-X-MEDIA-SEQUENCE:%d\n", w.first)
+	if w.cfg.MaxSegments == 0 {
+		buf.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+	buf.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if w.cfg.Container == MP4 {
+		fmt.Fprintf(&buf, "#EXT-X-MAP:URI=\"%s\"\n", mp4InitName)
+	}
+	for _, s := range w.segments {
+		if s.length == 0 {
+			continue // Segment is not finished yet.
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%.6f,\n%s\n",
+			float64(s.length)/float64(w.cfg.SampleRate), s.name)
+	}
+	if end {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	tmp := w.path(w.cfg.Playlist + ".tmp")
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path(w.cfg.Playlist))
+}
@@ -0,0 +1,209 @@
+package hls
+
+import (
+	"github.com/kikht/mix"
+
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const rate = 8000
+
+// encode writes n samples of ramp to w in chunks of 300 samples.
+func encode(t *testing.T, w *Writer, n int) {
+	t.Helper()
+	for beg := 0; beg < n; beg += 300 {
+		end := beg + 300
+		if end > n {
+			end = n
+		}
+		buf := make([]mix.Buffer, 2)
+		for c := range buf {
+			buf[c] = mix.NewBuffer(mix.Tz(end - beg))
+			for i := range buf[c] {
+				buf[c][i] = float32((beg+i)%100) / 100
+			}
+		}
+		if err := w.Encode(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWavSegments(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Dir: dir, SampleRate: rate, Container: WAV,
+		Format: mix.Int16, SegmentLength: 800, MaxSegments: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode(t, w, 1700)
+	playlist := readFile(t, dir, "index.m3u8")
+	for _, line := range []string{"#EXT-X-TARGETDURATION:1\n",
+		"#EXT-X-MEDIA-SEQUENCE:0\n", "#EXTINF:0.100000,\nsegment00001.wav\n"} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("Playlist does not contain %q:\n%s", line, playlist)
+		}
+	}
+	if strings.Contains(playlist, "segment00002") ||
+		strings.Contains(playlist, "ENDLIST") {
+		t.Error("Unfinished segment is in playlist:\n", playlist)
+	}
+
+	encode(t, w, 300)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	playlist = readFile(t, dir, "index.m3u8")
+	expect := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n" +
+		"#EXT-X-MEDIA-SEQUENCE:1\n#EXT-X-INDEPENDENT-SEGMENTS\n" +
+		"#EXTINF:0.100000,\nsegment00001.wav\n" +
+		"#EXTINF:0.050000,\nsegment00002.wav\n#EXT-X-ENDLIST\n"
+	if playlist != expect {
+		t.Errorf("Invalid playlist:\n%s", playlist)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "segment00000.wav")); !os.IsNotExist(err) {
+		t.Error("Old segment is not removed", err)
+	}
+	segment := readFile(t, dir, "segment00002.wav")
+	if !strings.HasPrefix(segment, "RIFF") || len(segment) != riffSize+400*2*2 {
+		t.Error("Invalid segment of length", len(segment))
+	}
+}
+
+// Size of WAV header of mix encoder.
+const riffSize = 68
+
+func TestFlacSegments(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Dir: dir, SampleRate: rate, Container: FLAC,
+		Format: mix.Int24, SegmentLength: 800})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode(t, w, 1600)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	playlist := readFile(t, dir, "index.m3u8")
+	if !strings.Contains(playlist, "#EXT-X-PLAYLIST-TYPE:EVENT\n") ||
+		strings.Count(playlist, "#EXTINF:0.100000,") != 2 {
+		t.Errorf("Invalid playlist:\n%s", playlist)
+	}
+	for _, name := range []string{"segment00000.flac", "segment00001.flac"} {
+		if !strings.HasPrefix(readFile(t, dir, name), "fLaC") {
+			t.Error("Invalid FLAC segment", name)
+		}
+	}
+}
+
+// box is ISO base media box.
+type box struct {
+	kind string
+	data []byte
+}
+
+func parseBoxes(t *testing.T, data []byte) []box {
+	t.Helper()
+	var res []box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatal("Truncated box")
+		}
+		size := binary.BigEndian.Uint32(data)
+		if size < 8 || int(size) > len(data) {
+			t.Fatal("Invalid box size", size)
+		}
+		res = append(res, box{string(data[4:8]), data[8:size]})
+		data = data[size:]
+	}
+	return res
+}
+
+// find returns data of box at path of nested boxes.
+func find(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+	for i, kind := range path {
+		found := false
+		for _, b := range parseBoxes(t, data) {
+			if b.kind == kind {
+				data, found = b.data, true
+				break
+			}
+		}
+		if !found {
+			t.Fatal("Box is not found", path[0:i+1])
+		}
+	}
+	return data
+}
+
+func TestMP4Segments(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Dir: dir, SampleRate: rate, Format: mix.Int16,
+		SegmentLength: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode(t, w, 10000)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	playlist := readFile(t, dir, "index.m3u8")
+	if !strings.Contains(playlist, "#EXT-X-VERSION:7\n#") ||
+		!strings.Contains(playlist, "#EXT-X-MAP:URI=\"init.mp4\"\n") ||
+		strings.Count(playlist, "#EXTINF:0.625000,") != 2 {
+		t.Errorf("Invalid playlist:\n%s", playlist)
+	}
+
+	init := []byte(readFile(t, dir, "init.mp4"))
+	stsd := find(t, init, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+	entry := stsd[8:] // after version, flags and entry count
+	dfla := find(t, entry[8+28:], "dfLa")
+	if string(entry[4:8]) != "fLaC" || binary.BigEndian.Uint16(entry[8+16:]) != 2 ||
+		dfla[4] != 0x80 || dfla[7] != 34 {
+		t.Error("Invalid FLAC sample entry")
+	}
+
+	var decodeTime uint64
+	for i, name := range []string{"segment00000.m4s", "segment00001.m4s"} {
+		segment := []byte(readFile(t, dir, name))
+		if string(segment[4:8]) != "styp" {
+			t.Fatal("Segment does not start with styp")
+		}
+		if seq := binary.BigEndian.Uint32(find(t, segment, "moof", "mfhd")[4:]); seq != uint32(i+1) {
+			t.Error("Invalid fragment number", seq)
+		}
+		tfdt := find(t, segment, "moof", "traf", "tfdt")
+		if binary.BigEndian.Uint64(tfdt[4:]) != decodeTime {
+			t.Error("Invalid decode time", binary.BigEndian.Uint64(tfdt[4:]))
+		}
+		trun := find(t, segment, "moof", "traf", "trun")
+		count := binary.BigEndian.Uint32(trun[4:])
+		offset := binary.BigEndian.Uint32(trun[8:])
+		var duration, size uint32
+		for j := uint32(0); j < count; j++ {
+			duration += binary.BigEndian.Uint32(trun[12+8*j:])
+			size += binary.BigEndian.Uint32(trun[16+8*j:])
+		}
+		decodeTime += uint64(duration)
+		mdat := find(t, segment, "mdat")
+		moofBeg := len(find(t, segment, "styp")) + 8
+		if duration != 5000 || int(size) != len(mdat) ||
+			segment[moofBeg+int(offset)] != 0xff {
+			t.Error("Invalid fragment", duration, size, len(mdat), offset)
+		}
+	}
+}
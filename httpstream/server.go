@@ -0,0 +1,315 @@
+// Package httpstream serves live mix over HTTP, so that it could be heard
+// in browser or by remote players:
+//
+//	server, err := httpstream.New(httpstream.Config{Format: mix.Int16})
+//	if err != nil {
+//		return err
+//	}
+//	defer server.Close()
+//	http.Handle("/live", server)
+//	ctrl := controller.NewSwitchController(server)
+//
+// Server is real-time player like jack.Stream: it renders played source
+// in real-time pace and sends every chunk to all connected listeners.
+package httpstream
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/output"
+	"github.com/kikht/mix/pipe"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Container is format of HTTP response.
+type Container int
+
+const (
+	WAV  Container = iota // WAV of unknown length
+	FLAC                  // FLAC of unknown length, needs Int16 or Int24
+	Raw                   // interleaved little-endian samples
+)
+
+// Config describes output of Server. Zero fields are replaced by defaults.
+type Config struct {
+	SampleRate  mix.Tz           // 44100 by default
+	ChunkSize   mix.Tz           // 1024 by default
+	NumChannels int              // 2 by default
+	Container   Container        // WAV by default
+	Format      mix.SampleFormat // mix.Float32 by default
+	// Latency is number of samples rendered ahead of clock. 4 chunks by
+	// default.
+	Latency mix.Tz
+	Output  output.Config
+	// ClientBuffer is number of samples queued for every listener. Clients,
+	// that fall behind by more than that, are dropped. 2 seconds by default.
+	ClientBuffer mix.Tz
+}
+
+// Server is mix.Player and mix.SwitchPlayer, that serves played source
+// to HTTP clients. Its Stream methods control playback, Close also
+// disconnects all clients.
+type Server struct {
+	*pipe.Stream
+	fanout *fanout
+}
+
+// New starts Server, that plays silence until the first Play or Switch.
+func New(cfg Config) (*Server, error) {
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 44100
+	}
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = 1024
+	}
+	if cfg.NumChannels == 0 {
+		cfg.NumChannels = 2
+	}
+	if cfg.ClientBuffer == 0 {
+		cfg.ClientBuffer = 2 * cfg.SampleRate
+	}
+
+	f := &fanout{
+		cfg:     cfg,
+		clients: make(map[*client]struct{}),
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		Stream: pipe.NewEncoderStream(f, pipe.Config{
+			SampleRate:  cfg.SampleRate,
+			ChunkSize:   cfg.ChunkSize,
+			NumChannels: cfg.NumChannels,
+			Format:      cfg.Format,
+			Latency:     cfg.Latency,
+			Output:      cfg.Output,
+		}),
+		fanout: f,
+	}, nil
+}
+
+// ServeHTTP streams live mix to client from the next chunk, until client
+// disconnects, falls behind or Server is closed.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	c := s.fanout.add()
+	if c == nil {
+		http.Error(w, "Server is closed", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.fanout.remove(c)
+
+	w.Header().Set("Content-Type", s.fanout.cfg.Container.ContentType())
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	if _, err := w.Write(s.fanout.header); err != nil {
+		return
+	}
+	flusher.Flush()
+	for {
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Listeners returns number of connected clients.
+func (s *Server) Listeners() int {
+	s.fanout.mu.Lock()
+	defer s.fanout.mu.Unlock()
+	return len(s.fanout.clients)
+}
+
+// Dropped returns number of clients, that were dropped because they fell
+// behind.
+func (s *Server) Dropped() uint64 {
+	return atomic.LoadUint64(&s.fanout.dropped)
+}
+
+// ErrDropped is returned by Listener, that fell behind.
+var ErrDropped = errors.New("Listener fell behind live stream")
+
+// Listener reads live stream like HTTP client: header of container
+// followed by chunks from the moment of Listen.
+type Listener struct {
+	fanout  *fanout
+	client  *client
+	pending []byte
+}
+
+// Listen adds Listener, that must be read as fast as stream is played.
+// Otherwise it is dropped like late HTTP client.
+func (s *Server) Listen() (*Listener, error) {
+	c := s.fanout.add()
+	if c == nil {
+		return nil, errors.New("Server is closed")
+	}
+	return &Listener{s.fanout, c, s.fanout.header}, nil
+}
+
+// Read reads encoded stream. It returns io.EOF after Server or Listener
+// is closed, and ErrDropped after Listener fell behind.
+func (l *Listener) Read(p []byte) (int, error) {
+	if len(l.pending) == 0 {
+		chunk, ok := <-l.client.chunks
+		if !ok {
+			if l.fanout.isDropped(l.client) {
+				return 0, ErrDropped
+			}
+			return 0, io.EOF
+		}
+		l.pending = chunk
+	}
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+	return n, nil
+}
+
+// Close removes Listener from Server.
+func (l *Listener) Close() error {
+	l.fanout.remove(l.client)
+	return nil
+}
+
+type client struct {
+	chunks  chan []byte
+	dropped bool
+}
+
+// fanout is mix.Encoder, that encodes chunks once and queues them to
+// all clients.
+type fanout struct {
+	cfg     Config
+	encoder mix.Encoder
+	data    bytes.Buffer // output of encoder
+	header  []byte       // sent to every client before chunks
+
+	mu      sync.Mutex
+	clients map[*client]struct{}
+	closed  bool
+	dropped uint64 // atomic
+}
+
+// init creates encoder of chunks and its header.
+func (f *fanout) init() error {
+	var err error
+	switch f.cfg.Container {
+	case WAV:
+		f.encoder = mix.NewWavEncoder(&f.data, f.cfg.SampleRate,
+			f.cfg.NumChannels, f.cfg.Format)
+	case FLAC:
+		f.encoder, err = mix.NewFlacEncoder(&f.data, f.cfg.SampleRate,
+			f.cfg.NumChannels, f.cfg.Format)
+	case Raw:
+		f.encoder = mix.NewRawEncoder(&f.data, f.cfg.Format)
+	default:
+		err = fmt.Errorf("Unknown container %d", f.cfg.Container)
+	}
+	if err != nil {
+		return err
+	}
+	// Empty chunk makes encoders write their headers.
+	if err := f.encoder.Encode(make([]mix.Buffer, f.cfg.NumChannels)); err != nil {
+		return errors.New("Can not write header: " + err.Error())
+	}
+	f.header = append([]byte(nil), f.data.Bytes()...)
+	f.data.Reset()
+	return nil
+}
+
+// ContentType returns MIME type of container.
+func (c Container) ContentType() string {
+	switch c {
+	case WAV:
+		return "audio/wav"
+	case FLAC:
+		return "audio/flac"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func (f *fanout) add() *client {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	size := (f.cfg.ClientBuffer + f.cfg.ChunkSize - 1) / f.cfg.ChunkSize
+	c := &client{chunks: make(chan []byte, size)}
+	f.clients[c] = struct{}{}
+	return c
+}
+
+func (f *fanout) remove(c *client) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.clients[c]; ok {
+		delete(f.clients, c)
+		close(c.chunks)
+	}
+}
+
+func (f *fanout) isDropped(c *client) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return c.dropped
+}
+
+// Encode encodes chunk and queues it to clients. Clients with full queue
+// are dropped. Chunks are not encoded without clients.
+func (f *fanout) Encode(buffer []mix.Buffer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.clients) == 0 {
+		return nil
+	}
+	f.data.Reset()
+	if err := f.encoder.Encode(buffer); err != nil {
+		return err
+	}
+	chunk := append([]byte(nil), f.data.Bytes()...)
+	for c := range f.clients {
+		select {
+		case c.chunks <- chunk:
+		default:
+			delete(f.clients, c)
+			close(c.chunks)
+			c.dropped = true
+			atomic.AddUint64(&f.dropped, 1)
+		}
+	}
+	return nil
+}
+
+// Close disconnects all clients.
+func (f *fanout) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for c := range f.clients {
+		delete(f.clients, c)
+		close(c.chunks)
+	}
+	return f.encoder.Close()
+}
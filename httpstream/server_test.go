@@ -0,0 +1,187 @@
+package httpstream
+
+import (
+	"github.com/kikht/mix"
+
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const rate = 8000
+
+func constSource(v float32, n mix.Tz) mix.Source {
+	buf := mix.NewBuffer(n)
+	for i := range buf {
+		buf[i] = v
+	}
+	return mix.MemSource{Rate: rate, Data: []mix.Buffer{buf}}
+}
+
+func waitListeners(t *testing.T, s *Server, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); s.Listeners() != n; {
+		if time.Now().After(deadline) {
+			t.Fatal("Invalid number of listeners", s.Listeners())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s, err := New(Config{SampleRate: rate, ChunkSize: 80, Latency: 160,
+		Container: Raw, Format: mix.Int16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := http.Get(ts.URL)
+			if err != nil {
+				results <- result{nil, err}
+				return
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			results <- result{data, err}
+		}()
+	}
+	waitListeners(t, s, 2)
+	// Source starts at the next chunk.
+	s.Switch(mix.SourceMutatorFunc(func(cur mix.Source, pos mix.Tz) mix.Source {
+		res, _ := mix.Concat(mix.Silence(pos, rate, 1), constSource(0.5, 800))
+		return res
+	}))
+	<-s.End()
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatal("Error while closing server:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			t.Fatal("Error of client:", res.err)
+		}
+		nonzero := 0
+		for j := 0; j+2 <= len(res.data); j += 2 {
+			v := int16(binary.LittleEndian.Uint16(res.data[j:]))
+			if v != 0 && v != 10922 { // 0.5 / (1 + 0.5) * 32767
+				t.Fatalf("Invalid sample %d: %d", j/2, v)
+			}
+			if v != 0 {
+				nonzero++
+			}
+		}
+		if nonzero != 2*800 {
+			t.Error("Invalid number of played samples", nonzero)
+		}
+	}
+	if s.Listeners() != 0 || s.Dropped() != 0 {
+		t.Error("Invalid server state", s.Listeners(), s.Dropped())
+	}
+	if resp, err := http.Get(ts.URL); err != nil ||
+		resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Closed server accepts clients", err)
+	}
+}
+
+func TestContainers(t *testing.T) {
+	tests := []struct {
+		container   Container
+		format      mix.SampleFormat
+		contentType string
+		prefix      string
+	}{
+		{WAV, mix.Float32, "audio/wav", "RIFF"},
+		{FLAC, mix.Int16, "audio/flac", "fLaC"},
+	}
+	for _, test := range tests {
+		s, err := New(Config{SampleRate: rate, ChunkSize: 80,
+			Container: test.container, Format: test.format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		done := make(chan struct{})
+		go func() {
+			s.ServeHTTP(rec, req)
+			close(done)
+		}()
+		waitListeners(t, s, 1)
+		time.Sleep(50 * time.Millisecond)
+		s.Close()
+		<-done
+		if ct := rec.Header().Get("Content-Type"); ct != test.contentType {
+			t.Error("Invalid content type", ct)
+		}
+		if body := rec.Body.Bytes(); !bytes.HasPrefix(body, []byte(test.prefix)) ||
+			len(body) <= len(s.fanout.header) {
+			t.Error("Invalid body of", test.contentType, len(body))
+		}
+	}
+
+	if _, err := New(Config{Container: FLAC}); err == nil {
+		t.Error("FLAC of float samples is accepted")
+	}
+}
+
+func TestDropLateClient(t *testing.T) {
+	s, err := New(Config{SampleRate: rate, ChunkSize: 80, ClientBuffer: 160})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := s.fanout.add()
+	for deadline := time.Now().Add(5 * time.Second); s.Dropped() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Late client is not dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(c.chunks) != 2 || s.Listeners() != 0 {
+		t.Error("Invalid state of dropped client", len(c.chunks), s.Listeners())
+	}
+}
+
+func TestListener(t *testing.T) {
+	s, err := New(Config{SampleRate: rate, ChunkSize: 80, ClientBuffer: 160})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if n, err := io.ReadFull(l, buf); n != 4 || err != nil || string(buf) != "RIFF" {
+		t.Fatal("Invalid header", string(buf), err)
+	}
+	// Listener is not read, so it falls behind.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := io.Copy(io.Discard, l); err != ErrDropped {
+		t.Error("Late listener is not dropped", err)
+	}
+
+	l, _ = s.Listen()
+	s.Close()
+	if _, err := io.Copy(io.Discard, l); err != nil {
+		t.Error("Listener is not closed", err)
+	}
+	if _, err := s.Listen(); err == nil {
+		t.Error("Closed server accepts listeners")
+	}
+}
@@ -0,0 +1,318 @@
+// Package icecast implements source client of Icecast compatible servers.
+// Source is real-time player, that pushes live mix to server mount:
+//
+//	src, err := icecast.New(icecast.Config{
+//		URL:      "http://localhost:8000/table",
+//		Password: "hackme",
+//		Stream:   httpstream.Config{Container: httpstream.FLAC, Format: mix.Int16},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer src.Close()
+//	ctrl := controller.NewSwitchController(src)
+//	ctrl.OnLabel(src.SetTitle)
+package icecast
+
+import (
+	"github.com/kikht/mix/httpstream"
+
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes connection to Icecast server.
+type Config struct {
+	URL      string // http://host:port/mount
+	User     string // "source" by default
+	Password string
+	// Method is "PUT" by default. Use "SOURCE" for servers older than
+	// Icecast 2.4 and for Shoutcast.
+	Method string
+	// Stream describes encoding. WAV and FLAC containers are sent with
+	// their content types, raw samples as application/octet-stream.
+	Stream httpstream.Config
+
+	Name, Description, Genre string // stream information for listeners
+	Public                   bool   // list stream in directories
+
+	Timeout    time.Duration // of network operations, 10s by default
+	MinBackoff time.Duration // first delay of reconnect, 1s by default
+	MaxBackoff time.Duration // maximum delay of reconnect, 1m by default
+	// OnError is called with connection and metadata errors, if not nil.
+	// Source reconnects after connection errors.
+	OnError func(error)
+}
+
+// Source is mix.Player and mix.SwitchPlayer, that plays to Icecast server.
+// It renders source even while it is disconnected, so controllers work
+// as usual.
+type Source struct {
+	*httpstream.Server
+	cfg       Config
+	url       *url.URL
+	connected int32 // atomic
+
+	mu     sync.Mutex
+	title  string
+	titles chan struct{} // wakes up metadata goroutine
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New starts Source, that connects to server in background.
+func New(cfg Config) (*Source, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid server URL: %v", err)
+	}
+	if u.Scheme != "http" || u.Host == "" || len(u.Path) < 2 {
+		return nil, fmt.Errorf("Invalid server URL %q", cfg.URL)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if cfg.User == "" {
+		cfg.User = "source"
+	}
+	if cfg.Method == "" {
+		cfg.Method = "PUT"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = time.Minute
+	}
+	server, err := httpstream.New(cfg.Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Source{
+		Server: server,
+		cfg:    cfg,
+		url:    u,
+		titles: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+	s.wg.Add(2)
+	go s.run()
+	go s.runMetadata()
+	return s, nil
+}
+
+// Connected reports whether Source is streaming to server now.
+func (s *Source) Connected() bool {
+	return atomic.LoadInt32(&s.connected) != 0
+}
+
+// SetTitle updates stream title on server. It does not block, title is
+// sent in background and sent again after reconnect.
+func (s *Source) SetTitle(title string) {
+	s.mu.Lock()
+	s.title = title
+	s.mu.Unlock()
+	s.notifyTitle()
+}
+
+func (s *Source) notifyTitle() {
+	select {
+	case s.titles <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops playback and disconnects from server.
+func (s *Source) Close() error {
+	close(s.quit)
+	s.wg.Wait()
+	return s.Server.Close()
+}
+
+func (s *Source) reportError(err error) {
+	if s.cfg.OnError != nil {
+		s.cfg.OnError(err)
+	}
+}
+
+// run streams to server and reconnects with exponential backoff.
+func (s *Source) run() {
+	defer s.wg.Done()
+	backoff := s.cfg.MinBackoff
+	for {
+		streamed, err := s.stream()
+		if err == nil {
+			return // Server is closed.
+		}
+		s.reportError(err)
+		if streamed {
+			backoff = s.cfg.MinBackoff
+		}
+		select {
+		case <-s.quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > s.cfg.MaxBackoff {
+			backoff = s.cfg.MaxBackoff
+		}
+	}
+}
+
+// stream connects to server and sends live stream until error. It reports
+// whether connection was accepted by server.
+func (s *Source) stream() (bool, error) {
+	conn, err := net.DialTimeout("tcp", s.url.Host, s.cfg.Timeout)
+	if err != nil {
+		return false, fmt.Errorf("Can not connect to Icecast server: %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.quit:
+			conn.Close()
+		case <-done:
+			conn.Close()
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(s.cfg.Timeout))
+	if _, err := conn.Write(s.request()); err != nil {
+		return false, fmt.Errorf("Can not send request to Icecast server: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return false, fmt.Errorf("Invalid response of Icecast server: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Icecast server refused source: %s", resp.Status)
+	}
+
+	// Listener is added after handshake, so that it is not late.
+	listener, err := s.Listen()
+	if err != nil {
+		return false, nil
+	}
+	defer listener.Close()
+	atomic.StoreInt32(&s.connected, 1)
+	defer atomic.StoreInt32(&s.connected, 0)
+	s.notifyTitle()
+	_, err = io.Copy(deadlineWriter{conn, s.cfg.Timeout}, listener)
+	select {
+	case <-s.quit:
+		return true, nil
+	default:
+	}
+	if err == nil {
+		err = errors.New("Live stream is closed")
+	}
+	return true, fmt.Errorf("Connection to Icecast server is lost: %v", err)
+}
+
+// request returns HTTP header of source request.
+func (s *Source) request() []byte {
+	proto := "HTTP/1.1"
+	if s.cfg.Method == "SOURCE" {
+		proto = "HTTP/1.0"
+	}
+	public := "0"
+	if s.cfg.Public {
+		public = "1"
+	}
+	header := http.Header{}
+	header.Set("Host", s.url.Host)
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString(
+		[]byte(s.cfg.User+":"+s.cfg.Password)))
+	header.Set("User-Agent", "gomix")
+	header.Set("Content-Type", s.cfg.Stream.Container.ContentType())
+	header.Set("Ice-Public", public)
+	for key, value := range map[string]string{
+		"Ice-Name":        s.cfg.Name,
+		"Ice-Description": s.cfg.Description,
+		"Ice-Genre":       s.cfg.Genre,
+	} {
+		if value != "" {
+			header.Set(key, value)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\r\n", s.cfg.Method, s.url.EscapedPath(), proto)
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// runMetadata sends titles to server, while Source is connected.
+func (s *Source) runMetadata() {
+	defer s.wg.Done()
+	client := &http.Client{Timeout: s.cfg.Timeout}
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-s.titles:
+		}
+		s.mu.Lock()
+		title := s.title
+		s.mu.Unlock()
+		if title == "" || !s.Connected() {
+			continue
+		}
+		if err := s.updateMetadata(client, title); err != nil {
+			s.reportError(err)
+		}
+	}
+}
+
+// updateMetadata sets title with admin request of Icecast.
+func (s *Source) updateMetadata(client *http.Client, title string) error {
+	query := url.Values{}
+	query.Set("mount", s.url.Path)
+	query.Set("mode", "updinfo")
+	query.Set("song", title)
+	u := url.URL{Scheme: "http", Host: s.url.Host, Path: "/admin/metadata",
+		RawQuery: query.Encode()}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.cfg.User, s.cfg.Password)
+	req.Header.Set("User-Agent", "gomix")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Can not update metadata: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Can not update metadata: %s", resp.Status)
+	}
+	return nil
+}
+
+// deadlineWriter writes to connection with timeout.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
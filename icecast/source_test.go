@@ -0,0 +1,199 @@
+package icecast
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/httpstream"
+
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// request is source or metadata request received by fakeServer.
+type request struct {
+	method, path, user, password, contentType string
+	song, mount                               string
+	body                                      []byte // first bytes of stream
+}
+
+// fakeServer accepts sources like Icecast. It closes every source
+// connection after first bytes of stream, so that source reconnects.
+type fakeServer struct {
+	ln       net.Listener
+	status   string
+	requests chan request
+}
+
+func newFakeServer(t *testing.T, status string) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln, status, make(chan request, 16)}
+	go s.run()
+	return s
+}
+
+func (s *fakeServer) url() string {
+	return "http://" + s.ln.Addr().String() + "/live"
+}
+
+func (s *fakeServer) run() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	req, err := http.ReadRequest(in)
+	if err != nil {
+		return
+	}
+	var r request
+	r.method, r.path = req.Method, req.URL.Path
+	r.user, r.password, _ = req.BasicAuth()
+	r.contentType = req.Header.Get("Content-Type")
+	r.song, r.mount = req.URL.Query().Get("song"), req.URL.Query().Get("mount")
+	if req.Method == "GET" {
+		io.WriteString(conn, "HTTP/1.0 "+s.status+"\r\nContent-Length: 0\r\n\r\n")
+		s.requests <- r
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+s.status+"\r\n\r\n")
+	if strings.HasPrefix(s.status, "200") {
+		r.body = make([]byte, 4)
+		if _, err := io.ReadFull(in, r.body); err != nil {
+			return
+		}
+	}
+	s.requests <- r
+}
+
+func (s *fakeServer) next(t *testing.T) request {
+	t.Helper()
+	select {
+	case r := <-s.requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("No request from source")
+		return request{}
+	}
+}
+
+func TestSource(t *testing.T) {
+	server := newFakeServer(t, "200 OK")
+	defer server.ln.Close()
+
+	errors := make(chan error, 16)
+	src, err := New(Config{
+		URL:        server.url(),
+		Password:   "hackme",
+		Method:     "SOURCE",
+		Stream:     httpstream.Config{SampleRate: 8000, ChunkSize: 80, Format: mix.Int16},
+		MinBackoff: time.Millisecond,
+		OnError: func(err error) {
+			select {
+			case errors <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		r := server.next(t)
+		if r.method != "SOURCE" || r.path != "/live" || r.user != "source" ||
+			r.password != "hackme" || r.contentType != "audio/wav" {
+			t.Fatalf("Invalid source request %+v", r)
+		}
+		// Header of stream is sent again after reconnect.
+		if string(r.body) != "RIFF" {
+			t.Fatalf("Invalid stream header %q", r.body)
+		}
+	}
+	select {
+	case <-errors:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lost connection is not reported")
+	}
+
+	src.SetTitle("Tavern")
+	for {
+		r := server.next(t)
+		if r.method != "GET" {
+			continue // reconnect
+		}
+		if r.path != "/admin/metadata" || r.mount != "/live" ||
+			r.song != "Tavern" || r.password != "hackme" {
+			t.Fatalf("Invalid metadata request %+v", r)
+		}
+		break
+	}
+
+	if err := src.Close(); err != nil {
+		t.Fatal("Error while closing source:", err)
+	}
+	if src.Connected() {
+		t.Error("Source is connected after Close")
+	}
+}
+
+func TestRefusedSource(t *testing.T) {
+	server := newFakeServer(t, "401 Unauthorized")
+	defer server.ln.Close()
+
+	errors := make(chan error, 16)
+	src, err := New(Config{
+		URL:        server.url(),
+		Password:   "wrong",
+		Stream:     httpstream.Config{SampleRate: 8000, ChunkSize: 80},
+		MinBackoff: time.Hour,
+		OnError: func(err error) {
+			select {
+			case errors <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := server.next(t); r.method != "PUT" {
+		t.Error("Invalid default method", r.method)
+	}
+	select {
+	case err := <-errors:
+		if !strings.Contains(err.Error(), "401") {
+			t.Error("Invalid error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Refused source is not reported")
+	}
+	if src.Connected() {
+		t.Error("Refused source is connected")
+	}
+	// Close does not wait for backoff.
+	if err := src.Close(); err != nil {
+		t.Fatal("Error while closing source:", err)
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, u := range []string{"ftp://host/live", "http://host", "http://host/", ":"} {
+		if _, err := New(Config{URL: u}); err == nil {
+			t.Error("Invalid URL is accepted", u)
+		}
+	}
+}
@@ -15,6 +15,30 @@ type SwitchPlayer interface {
 	Switch(mutator SourceMutator)
 }
 
+// PositionPlayer is implemented by players, that know position of audio
+// device. Position is the sample, that is heard right now. Changes made by
+// Play or Switch are heard not earlier than Latency samples after it.
+type PositionPlayer interface {
+	PlayerState
+	Position() Tz
+	Latency() Tz
+}
+
+// Transport is implemented by streams of audio devices. Its methods are
+// safe to call from controller goroutine, while device callback is running.
+type Transport interface {
+	// Pause plays silence and holds position until Resume.
+	Pause()
+	Resume()
+	// Seek moves position of played source to pos.
+	Seek(pos Tz)
+	// Stop fades out played source during fade samples. Then stream plays
+	// silence and signals end.
+	Stop(fade Tz)
+	// Close stops stream and frees its ports and handles.
+	Close() error
+}
+
 type SourceMutator interface {
 	Mutate(cur Source, pos Tz) Source
 }
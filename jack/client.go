@@ -0,0 +1,350 @@
+// Package jack implements real-time player for JACK audio server.
+//
+//	client, err := jack.Open(jack.Config{Connect: jack.ConnectPhysical})
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//	stream, err := client.NewStream(2)
+package jack
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/output"
+
+	"github.com/xthexder/go-jack"
+
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AutoConnect defines where output ports of new streams are connected.
+type AutoConnect int
+
+const (
+	ConnectNone     AutoConnect = iota // ports are left unconnected
+	ConnectPhysical                    // round-robin to physical ports
+	ConnectPattern                     // to ports matching patterns
+)
+
+// Config describes connection to JACK server.
+type Config struct {
+	ClientName string // "gomix" by default
+	ServerName string // default server, if empty
+	Connect    AutoConnect
+	// Patterns are regular expressions of input port names for
+	// ConnectPattern. Channel i of stream is connected to all ports
+	// matching Patterns[i%len(Patterns)].
+	Patterns []string
+	// InputPatterns are regular expressions of output port names, that
+	// are connected to channels of inputs in the same way.
+	InputPatterns []string
+	// Output configures conversion of stream samples, e.g. clip mode.
+	// Bits may be set to dither for integer resolution of device.
+	Output output.Config
+
+	// Hooks are called from JACK threads, so they must not block.
+	OnShutdown   func()                  // server closed the client
+	OnBufferSize func(chunkSize mix.Tz)  // chunk size changed
+	OnSampleRate func(sampleRate mix.Tz) // sample rate changed
+}
+
+// Client is connection to JACK server, that plays its streams.
+type Client struct {
+	client     *jack.Client
+	cfg        Config
+	patterns   [2][]*regexp.Regexp // for outputs and inputs
+	sampleRate int64               // atomic
+	bufferSize int64               // atomic
+	// Process callback increments cycles at start and end, so it is odd
+	// during process cycle.
+	cycles uint64
+
+	followers int32    // number of streams following transport, atomic
+	rolling   bool     // transport state of current cycle
+	frame     mix.Tz   // transport frame of current cycle
+	position  position // filled by jack_transport_query
+
+	streams   atomic.Value // []*Stream
+	inputs    atomic.Value // []*Input
+	midi      atomic.Value // []*MidiInput
+	streamsMu sync.Mutex   // serializes changes of streams and inputs
+	portCount int
+}
+
+// serverMu guards JACK_DEFAULT_SERVER environment variable, that selects
+// server of jack_client_open.
+var serverMu sync.Mutex
+
+// Open connects to JACK server and activates client. It never starts server.
+func Open(cfg Config) (*Client, error) {
+	if cfg.ClientName == "" {
+		cfg.ClientName = "gomix"
+	}
+	c := &Client{cfg: cfg}
+	for i, patterns := range [...][]string{cfg.Patterns, cfg.InputPatterns} {
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid port pattern %q: %v", p, err)
+			}
+			c.patterns[i] = append(c.patterns[i], re)
+		}
+	}
+	if cfg.Connect == ConnectPattern && len(c.patterns[0])+len(c.patterns[1]) == 0 {
+		return nil, errors.New("No port patterns to connect")
+	}
+	c.streams.Store([]*Stream{})
+	c.inputs.Store([]*Input{})
+	c.midi.Store([]*MidiInput{})
+
+	var status int
+	c.client, status = openClient(cfg.ClientName, cfg.ServerName)
+	if status != 0 || c.client == nil {
+		return nil, fmt.Errorf("Can not connect to JACK server: %s",
+			jack.StrError(status))
+	}
+
+	atomic.StoreInt64(&c.sampleRate, int64(c.client.GetSampleRate()))
+	atomic.StoreInt64(&c.bufferSize, int64(c.client.GetBufferSize()))
+	if status := c.client.SetProcessCallback(c.process); status != 0 {
+		c.client.Close()
+		return nil, fmt.Errorf("Can not set process callback: %s",
+			jack.StrError(status))
+	}
+	c.client.SetBufferSizeCallback(func(size uint32) int {
+		atomic.StoreInt64(&c.bufferSize, int64(size))
+		if cfg.OnBufferSize != nil {
+			cfg.OnBufferSize(mix.Tz(size))
+		}
+		return 0
+	})
+	c.client.SetSampleRateCallback(func(rate uint32) int {
+		atomic.StoreInt64(&c.sampleRate, int64(rate))
+		if cfg.OnSampleRate != nil {
+			cfg.OnSampleRate(mix.Tz(rate))
+		}
+		return 0
+	})
+	if cfg.OnShutdown != nil {
+		c.client.OnShutdown(cfg.OnShutdown)
+	}
+	if status := c.client.Activate(); status != 0 {
+		c.client.Close()
+		return nil, fmt.Errorf("Can not activate JACK client: %s",
+			jack.StrError(status))
+	}
+	return c, nil
+}
+
+// openClient opens client of server. Empty server means default one.
+func openClient(name, server string) (*jack.Client, int) {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+	if server != "" {
+		orig, ok := os.LookupEnv("JACK_DEFAULT_SERVER")
+		os.Setenv("JACK_DEFAULT_SERVER", server)
+		defer func() {
+			if ok {
+				os.Setenv("JACK_DEFAULT_SERVER", orig)
+			} else {
+				os.Unsetenv("JACK_DEFAULT_SERVER")
+			}
+		}()
+	}
+	return jack.ClientOpen(name, jack.NullOption|jack.NoStartServer)
+}
+
+// Close deactivates client and disconnects from JACK server.
+func (c *Client) Close() error {
+	if status := c.client.Close(); status != 0 {
+		return fmt.Errorf("Can not close JACK client: %s", jack.StrError(status))
+	}
+	return nil
+}
+
+// Name returns actual name of client, that could differ from Config.
+func (c *Client) Name() string {
+	return c.client.GetName()
+}
+
+func (c *Client) SampleRate() mix.Tz {
+	return mix.Tz(atomic.LoadInt64(&c.sampleRate))
+}
+
+func (c *Client) ChunkSize() mix.Tz {
+	return mix.Tz(atomic.LoadInt64(&c.bufferSize))
+}
+
+func (c *Client) process(nframes uint32) int {
+	atomic.AddUint64(&c.cycles, 1)
+	if atomic.LoadInt32(&c.followers) > 0 {
+		c.queryTransport()
+	}
+	for _, m := range c.midi.Load().([]*MidiInput) {
+		m.receive(nframes)
+	}
+	for _, in := range c.inputs.Load().([]*Input) {
+		for i, port := range in.ports {
+			in.captured[i] = port.GetBuffer(nframes)
+		}
+		in.capture(mix.Tz(nframes))
+	}
+	for _, stream := range c.streams.Load().([]*Stream) {
+		for i, port := range stream.ports {
+			stream.outputs[i] = port.GetBuffer(nframes)
+		}
+		stream.render(mix.Tz(nframes))
+	}
+	atomic.AddUint64(&c.cycles, 1)
+	return 0
+}
+
+// NewStream registers numChannels output ports and connects them according
+// to Config.
+func (c *Client) NewStream(numChannels int) (*Stream, error) {
+	return c.newStream(numChannels, nil)
+}
+
+// NewNamedStream registers output port for each of names, e.g. channel
+// names of zones of controller.Controller, and connects them according to
+// Config. Names must be unique within client.
+func (c *Client) NewNamedStream(names ...string) (*Stream, error) {
+	if len(names) == 0 {
+		return nil, errors.New("No port names")
+	}
+	return c.newStream(len(names), names)
+}
+
+func (c *Client) newStream(numChannels int, names []string) (*Stream, error) {
+	stream := &Stream{
+		client:  c,
+		ports:   make([]*jack.Port, numChannels),
+		outputs: make([][]jack.AudioSample, numChannels),
+		stage:   output.New(c.cfg.Output, numChannels),
+		end:     make(chan struct{}, 1),
+	}
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	for i := range stream.ports {
+		c.portCount++
+		name := fmt.Sprintf("out_%d", c.portCount)
+		if names != nil {
+			name = names[i]
+		}
+		stream.ports[i] = c.client.PortRegister(name,
+			jack.DEFAULT_AUDIO_TYPE, jack.PortIsOutput, 0)
+		if stream.ports[i] == nil {
+			unregister(c, stream.ports)
+			return nil, errors.New("Can not register jack port")
+		}
+	}
+	if err := c.connect(stream.ports, false); err != nil {
+		unregister(c, stream.ports)
+		return nil, err
+	}
+
+	oldStreams := c.streams.Load().([]*Stream)
+	newStreams := make([]*Stream, len(oldStreams)+1)
+	copy(newStreams, oldStreams)
+	newStreams[len(newStreams)-1] = stream
+	c.streams.Store(newStreams)
+	return stream, nil
+}
+
+// connect connects ports of stream or input according to Config.Connect.
+func (c *Client) connect(ports []*jack.Port, input bool) error {
+	var (
+		targets   [][]string
+		patterns  = c.patterns[0]
+		direction = uint64(jack.PortIsInput)
+	)
+	if input {
+		patterns, direction = c.patterns[1], jack.PortIsOutput
+	}
+	switch c.cfg.Connect {
+	case ConnectNone:
+		return nil
+	case ConnectPhysical:
+		physical := c.client.GetPorts("", jack.DEFAULT_AUDIO_TYPE,
+			jack.PortIsPhysical|direction)
+		if len(physical) == 0 {
+			return errors.New("Can not find physical ports")
+		}
+		for i := range ports {
+			targets = append(targets, []string{physical[i%len(physical)]})
+		}
+	case ConnectPattern:
+		if len(patterns) == 0 {
+			return nil
+		}
+		names := c.client.GetPorts("", jack.DEFAULT_AUDIO_TYPE, direction)
+		for i := range ports {
+			re := patterns[i%len(patterns)]
+			var matched []string
+			for _, name := range names {
+				if re.MatchString(name) {
+					matched = append(matched, name)
+				}
+			}
+			if len(matched) == 0 {
+				return fmt.Errorf("No input ports match %s", re)
+			}
+			targets = append(targets, matched)
+		}
+	default:
+		return fmt.Errorf("Unknown auto-connect policy %d", c.cfg.Connect)
+	}
+
+	for i, port := range ports {
+		for _, name := range targets[i] {
+			src, dst := port.GetName(), name
+			if input {
+				src, dst = dst, src
+			}
+			if status := c.client.Connect(src, dst); status != 0 {
+				return fmt.Errorf("Can not connect %s to %s: %s",
+					src, dst, jack.StrError(status))
+			}
+		}
+	}
+	return nil
+}
+
+// remove removes stream from processed ones and waits until current
+// process cycle is finished, so that its ports are not used anymore.
+func (c *Client) remove(s *Stream) {
+	c.streamsMu.Lock()
+	oldStreams := c.streams.Load().([]*Stream)
+	newStreams := make([]*Stream, 0, len(oldStreams))
+	for _, stream := range oldStreams {
+		if stream != s {
+			newStreams = append(newStreams, stream)
+		}
+	}
+	c.streams.Store(newStreams)
+	c.streamsMu.Unlock()
+
+	c.waitCycle()
+}
+
+// waitCycle waits until current process cycle is finished, so that
+// changes of streams, inputs and recorders are seen by process callback.
+func (c *Client) waitCycle() {
+	orig := atomic.LoadUint64(&c.cycles)
+	if orig&1 == 0 {
+		return
+	}
+	// Give up after timeout, if client is shut down during cycle.
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if atomic.LoadUint64(&c.cycles) != orig {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,119 @@
+package jack
+
+import (
+	"github.com/kikht/mix"
+
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestOpenErrors(t *testing.T) {
+	if _, err := Open(Config{ServerName: "mix-no-such-server"}); err == nil {
+		t.Error("Connected to missing server")
+	}
+	if _, err := Open(Config{Connect: ConnectPattern, Patterns: []string{"("}}); err == nil {
+		t.Error("Invalid pattern is accepted")
+	}
+	if _, err := Open(Config{Connect: ConnectPattern}); err == nil {
+		t.Error("Pattern policy without patterns is accepted")
+	}
+}
+
+// dummyServer starts jackd with dummy driver, so that tests do not need
+// audio hardware. Test is skipped, if jackd is not installed.
+func dummyServer(t *testing.T) string {
+	path, err := exec.LookPath("jackd")
+	if err != nil {
+		t.Skip("jackd is not installed")
+	}
+	name := fmt.Sprintf("mixtest%d", os.Getpid())
+	cmd := exec.Command(path, "-n", name, "-d", "dummy", "-r", "48000", "-p", "256")
+	if err := cmd.Start(); err != nil {
+		t.Skip("Can not start jackd:", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	for i := 0; i < 50; i++ {
+		if c, err := Open(Config{ServerName: name}); err == nil {
+			c.Close()
+			return name
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("Dummy JACK server is not started")
+	return ""
+}
+
+func TestDummyServer(t *testing.T) {
+	server := dummyServer(t)
+	c, err := Open(Config{
+		ClientName: "mixtest",
+		ServerName: server,
+		Connect:    ConnectPattern,
+		Patterns:   []string{"^system:playback_1$", "^system:playback_2$"},
+	})
+	if err != nil {
+		t.Fatal("Can not open client:", err)
+	}
+	defer c.Close()
+	if c.SampleRate() != 48000 || c.ChunkSize() != 256 {
+		t.Error("Invalid client parameters", c.SampleRate(), c.ChunkSize())
+	}
+
+	stream, err := c.NewStream(2)
+	if err != nil {
+		t.Fatal("Can not create stream:", err)
+	}
+	data := mix.NewBuffer(4800)
+	stream.Play(mix.MemSource{Rate: 48000, Data: []mix.Buffer{data, data}})
+	select {
+	case <-stream.End():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream is not played")
+	}
+	if stream.Position() == 0 || stream.Err() != nil {
+		t.Error("Invalid stream state", stream.Position(), stream.Err())
+	}
+	if err := stream.Close(); err != nil {
+		t.Error("Can not close stream:", err)
+	}
+
+	zones, err := c.NewNamedStream("hall_L", "hall_R", "bar_L", "bar_R")
+	if err != nil {
+		t.Fatal("Can not create named stream:", err)
+	}
+	if name := zones.ports[2].GetName(); name != c.Name()+":bar_L" {
+		t.Error("Invalid port name", name)
+	}
+	if _, err := c.NewNamedStream("hall_L"); err == nil {
+		t.Error("Port name is not unique")
+	}
+	zones.Close()
+
+	in, err := c.NewInput(2)
+	if err != nil {
+		t.Fatal("Can not create input:", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if in.Now() == 0 {
+		t.Error("Input is not captured")
+	}
+	if err := in.Close(); err != nil {
+		t.Error("Can not close input:", err)
+	}
+
+	other, err := Open(Config{ServerName: server, Connect: ConnectPattern,
+		Patterns: []string{"^no-such-port$"}})
+	if err != nil {
+		t.Fatal("Can not open client:", err)
+	}
+	defer other.Close()
+	if _, err := other.NewStream(1); err == nil {
+		t.Error("Stream connected to missing port")
+	}
+}
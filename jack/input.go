@@ -0,0 +1,202 @@
+package jack
+
+import (
+	"github.com/kikht/mix"
+
+	"github.com/xthexder/go-jack"
+
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+const inputHistory = 1 << 16 // frames kept by Input, must be power of 2
+
+// Input is live unbounded Source of JACK input ports. Offsets of Input are
+// in input time, that is number of frames captured since its creation.
+// Input keeps short history, older and future frames are silent. Use
+// Aligned to play Input in time of Stream, e.g. as Region of Session.
+//
+// Samples must be called from process callback, i.e. while Stream renders
+// its source.
+type Input struct {
+	client   *Client
+	ports    []*jack.Port
+	captured [][]jack.AudioSample // port buffers of current cycle
+	ring     []mix.Buffer
+	written  int64 // number of captured frames, atomic
+	buffer   []mix.Buffer
+	recorder atomic.Value // *Recorder
+}
+
+// NewInput registers numChannels input ports and connects them according
+// to Config.
+func (c *Client) NewInput(numChannels int) (*Input, error) {
+	in := &Input{
+		client:   c,
+		ports:    make([]*jack.Port, numChannels),
+		captured: make([][]jack.AudioSample, numChannels),
+		ring:     make([]mix.Buffer, numChannels),
+		buffer:   make([]mix.Buffer, numChannels),
+	}
+	for i := range in.ring {
+		in.ring[i] = mix.NewBuffer(inputHistory)
+	}
+
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	for i := range in.ports {
+		c.portCount++
+		in.ports[i] = c.client.PortRegister(fmt.Sprintf("in_%d", c.portCount),
+			jack.DEFAULT_AUDIO_TYPE, jack.PortIsInput, 0)
+		if in.ports[i] == nil {
+			unregister(c, in.ports)
+			return nil, errors.New("Can not register jack port")
+		}
+	}
+	if err := c.connect(in.ports, true); err != nil {
+		unregister(c, in.ports)
+		return nil, err
+	}
+
+	oldInputs := c.inputs.Load().([]*Input)
+	newInputs := make([]*Input, len(oldInputs)+1)
+	copy(newInputs, oldInputs)
+	newInputs[len(newInputs)-1] = in
+	c.inputs.Store(newInputs)
+	return in, nil
+}
+
+// capture copies n frames of captured buffers to history.
+func (in *Input) capture(n mix.Tz) {
+	pos := mix.Tz(atomic.LoadInt64(&in.written))
+	for c, buf := range in.captured {
+		ring := in.ring[c]
+		for i, v := range buf[0:n] {
+			ring[(pos+mix.Tz(i))&(inputHistory-1)] = float32(v)
+		}
+	}
+	atomic.StoreInt64(&in.written, int64(pos+n))
+	if rec, _ := in.recorder.Load().(*Recorder); rec != nil {
+		rec.write(in.captured, int(n))
+	}
+}
+
+// Samples returns captured frames. Frames, that are not in history, are
+// silent.
+func (in *Input) Samples(channel int, offset, length mix.Tz) mix.Buffer {
+	written := mix.Tz(atomic.LoadInt64(&in.written))
+	beg, end := offset&(inputHistory-1), (offset+length)&(inputHistory-1)
+	if offset >= written-inputHistory && offset+length <= written && beg < end {
+		return in.ring[channel][beg:end]
+	}
+
+	if mix.Tz(cap(in.buffer[channel])) < length {
+		in.buffer[channel] = mix.NewBuffer(length)
+	}
+	res := in.buffer[channel][0:length]
+	for i := range res {
+		if pos := offset + mix.Tz(i); pos >= written-inputHistory && pos < written {
+			res[i] = in.ring[channel][pos&(inputHistory-1)]
+		} else {
+			res[i] = 0
+		}
+	}
+	return res
+}
+
+func (in *Input) SampleRate() mix.Tz {
+	return in.client.SampleRate()
+}
+
+func (in *Input) NumChannels() int {
+	return len(in.ring)
+}
+
+// Length returns mix.Infinite, live input never ends.
+func (in *Input) Length() mix.Tz {
+	return mix.Infinite
+}
+
+// Clone returns Input itself, reading does not change it.
+func (in *Input) Clone() mix.Source {
+	return in
+}
+
+func (in *Input) Preallocate(chunkSize mix.Tz) {
+	for c := range in.buffer {
+		if mix.Tz(cap(in.buffer[c])) < chunkSize {
+			in.buffer[c] = mix.NewBuffer(chunkSize)
+		}
+	}
+}
+
+// Now returns input time of the next captured frame.
+func (in *Input) Now() mix.Tz {
+	return mix.Tz(atomic.LoadInt64(&in.written))
+}
+
+// Aligned returns Source, that plays Input in time of Stream: samples
+// captured in process cycle are played in the same cycle. Alignment is
+// lost, if Stream is paused or seeked.
+func (in *Input) Aligned(s *Stream) mix.Source {
+	c := in.client
+	for {
+		// Read both positions between process cycles.
+		cycle := atomic.LoadUint64(&c.cycles)
+		if cycle&1 == 0 {
+			delta := mix.Tz(atomic.LoadInt64(&in.written)) -
+				mix.Tz(atomic.LoadUint64(&s.state)>>stateBits)
+			if atomic.LoadUint64(&c.cycles) == cycle {
+				return &alignedInput{in, delta}
+			}
+		}
+		runtime.Gosched()
+	}
+}
+
+type alignedInput struct {
+	*Input
+	delta mix.Tz
+}
+
+func (a *alignedInput) Samples(channel int, offset, length mix.Tz) mix.Buffer {
+	return a.Input.Samples(channel, offset+a.delta, length)
+}
+
+func (a *alignedInput) Clone() mix.Source {
+	return a
+}
+
+// Record starts recording of captured frames to encoder.
+// It replaces previous Recorder, that should be closed.
+func (in *Input) Record(encoder mix.Encoder) *Recorder {
+	var rec *Recorder
+	rec = newRecorder(len(in.captured), encoder, -1, func() {
+		in.recorder.CompareAndSwap(rec, (*Recorder)(nil))
+		in.client.waitCycle()
+	})
+	in.recorder.Store(rec)
+	return rec
+}
+
+// Close removes Input from JACK client and unregisters its ports.
+func (in *Input) Close() error {
+	c := in.client
+	c.streamsMu.Lock()
+	oldInputs := c.inputs.Load().([]*Input)
+	newInputs := make([]*Input, 0, len(oldInputs))
+	for _, other := range oldInputs {
+		if other != in {
+			newInputs = append(newInputs, other)
+		}
+	}
+	c.inputs.Store(newInputs)
+	c.streamsMu.Unlock()
+
+	c.waitCycle()
+	err := unregister(c, in.ports)
+	in.ports = nil
+	return err
+}
@@ -0,0 +1,117 @@
+package jack
+
+import (
+	"github.com/kikht/mix"
+
+	"github.com/xthexder/go-jack"
+
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func testInput(c *Client) *Input {
+	in := &Input{
+		client:   c,
+		captured: make([][]jack.AudioSample, 2),
+		ring:     []mix.Buffer{mix.NewBuffer(inputHistory), mix.NewBuffer(inputHistory)},
+		buffer:   make([]mix.Buffer, 2),
+	}
+	for i := range in.captured {
+		in.captured[i] = make([]jack.AudioSample, testChunk)
+	}
+	return in
+}
+
+// cycle simulates process callback, that captures i-th chunk of ramp.
+func cycle(c *Client, in *Input, s *Stream, i int) {
+	c.cycles++
+	for ch, buf := range in.captured {
+		for j := range buf {
+			buf[j] = jack.AudioSample(float32(ch) + float32(i*testChunk+j)/1e6)
+		}
+	}
+	in.capture(testChunk)
+	if s != nil {
+		s.render(testChunk)
+	}
+	c.cycles++
+}
+
+func TestInput(t *testing.T) {
+	c := &Client{}
+	in := testInput(c)
+	for i := 0; i < 3; i++ {
+		cycle(c, in, nil, i)
+	}
+	if in.Now() != 3*testChunk || !mix.IsUnbounded(in) {
+		t.Fatal("Invalid input state", in.Now(), in.Length())
+	}
+	res := in.Samples(1, testChunk-1, 3)
+	expect := []float32{1 + float32(testChunk-1)/1e6, 1 + float32(testChunk)/1e6,
+		1 + float32(testChunk+1)/1e6}
+	for i := range expect {
+		if res[i] != expect[i] {
+			t.Fatal("Invalid captured samples", res, expect)
+		}
+	}
+	if res := in.Samples(0, 3*testChunk-1, 2); res[0] == 0 || res[1] != 0 {
+		t.Error("Future frames are not silent", res)
+	}
+	if res := in.Samples(0, -1, 2); res[0] != 0 || res[1] != 0 {
+		t.Error("Frames before history are not silent", res)
+	}
+}
+
+func TestAlignedInput(t *testing.T) {
+	c := &Client{}
+	in := testInput(c)
+	s := testStream(nil)
+	s.client = c
+	cycle(c, in, s, 0)
+	s.Play(in.Aligned(s))
+	for i := 1; i < 4; i++ {
+		cycle(c, in, s, i)
+		for j, v := range s.outputs[1] {
+			x := 1 + float32(i*testChunk+j)/1e6
+			if expect := jack.AudioSample(x / (1 + x)); v != expect {
+				t.Fatalf("Sample %d of cycle %d is not aligned: %f, expected %f",
+					j, i, v, expect)
+			}
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	c := &Client{}
+	in := testInput(c)
+	s := testStream(nil)
+	s.client = c
+	s.Play(in.Aligned(s))
+
+	var out bytes.Buffer
+	rec := s.Record(mix.NewRawEncoder(&out, mix.Float32))
+	for i := 0; i < 10; i++ {
+		cycle(c, in, s, i)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal("Error while recording:", err)
+	}
+	cycle(c, in, s, 10)
+	if rec.Dropped() != 0 {
+		t.Error("Frames are dropped", rec.Dropped())
+	}
+
+	data := out.Bytes()
+	if len(data) != 10*testChunk*2*4 {
+		t.Fatal("Invalid size of recording", len(data))
+	}
+	for i := 0; i < 10*testChunk; i++ {
+		x := 1 + float32(i)/1e6
+		v := math.Float32frombits(binary.LittleEndian.Uint32(data[8*i+4:]))
+		if expect := x / (1 + x); v != expect {
+			t.Fatalf("Invalid recorded sample %d: %f, expected %f", i, v, expect)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package jack
+
+/*
+#cgo LDFLAGS: -ljack
+#include <jack/midiport.h>
+*/
+import "C"
+
+import (
+	"github.com/kikht/mix/controller"
+
+	"github.com/xthexder/go-jack"
+
+	"errors"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	midiQueueSize = 1 << 10 // events, must be power of 2
+	midiPeriod    = 2 * time.Millisecond
+
+	midiNoteOn        = 0x90
+	midiControlChange = 0xb0
+)
+
+// MidiController is controlled by MidiInput, e.g.
+// controller.SwitchController.
+type MidiController interface {
+	Action(label string) error
+	SetVolume(category controller.Category, gain float32)
+}
+
+// MidiMap maps MIDI messages to calls of MidiController.
+type MidiMap struct {
+	Channel int // 1-16, zero means any channel
+	// Notes maps note numbers to action labels, that are fired by note on.
+	Notes map[uint8]string
+	// Volumes maps control change numbers to categories. Control value
+	// 0-127 sets gain of category linearly from 0 to 1.
+	Volumes map[uint8]controller.Category
+	// Patterns are regular expressions of MIDI output port names, that
+	// are connected to input. Config.Connect does not apply to MIDI.
+	Patterns []string
+	OnError  func(error) // called with errors of Action, if not nil
+}
+
+type midiEvent struct {
+	status, data1, data2 uint8
+}
+
+// MidiInput is JACK MIDI input port, that controls MidiController.
+// Process callback pushes mapped messages to lock-free queue, and they are
+// handled by background goroutine. So MidiController is called from that
+// goroutine and must be synchronized with other its users.
+type MidiInput struct {
+	client     *Client
+	port       *jack.Port
+	ctrl       MidiController
+	mapping    MidiMap
+	queue      [midiQueueSize]midiEvent
+	head, tail uint64 // pushed and handled events, atomic
+	dropped    uint64 // atomic
+	quit       chan struct{}
+	done       chan struct{}
+
+	event C.jack_midi_event_t // read by receive in process callback
+}
+
+func newMidiInput(ctrl MidiController, mapping MidiMap) *MidiInput {
+	return &MidiInput{
+		ctrl:    ctrl,
+		mapping: mapping,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// NewMidiInput registers MIDI input port, that controls ctrl according to
+// mapping.
+func (c *Client) NewMidiInput(ctrl MidiController, mapping MidiMap) (*MidiInput, error) {
+	if mapping.Channel < 0 || mapping.Channel > 16 {
+		return nil, fmt.Errorf("Invalid MIDI channel %d", mapping.Channel)
+	}
+	var patterns []*regexp.Regexp
+	for _, p := range mapping.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port pattern %q: %v", p, err)
+		}
+		patterns = append(patterns, re)
+	}
+	m := newMidiInput(ctrl, mapping)
+	m.client = c
+
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	c.portCount++
+	m.port = c.client.PortRegister(fmt.Sprintf("midi_in_%d", c.portCount),
+		jack.DEFAULT_MIDI_TYPE, jack.PortIsInput, 0)
+	if m.port == nil {
+		return nil, errors.New("Can not register jack port")
+	}
+	for _, name := range c.client.GetPorts("", jack.DEFAULT_MIDI_TYPE, jack.PortIsOutput) {
+		for _, re := range patterns {
+			if !re.MatchString(name) {
+				continue
+			}
+			if status := c.client.Connect(name, m.port.GetName()); status != 0 {
+				unregister(c, []*jack.Port{m.port})
+				return nil, fmt.Errorf("Can not connect %s to %s: %s",
+					name, m.port.GetName(), jack.StrError(status))
+			}
+			break
+		}
+	}
+
+	go m.run()
+	oldMidi := c.midi.Load().([]*MidiInput)
+	newMidi := make([]*MidiInput, len(oldMidi)+1)
+	copy(newMidi, oldMidi)
+	newMidi[len(newMidi)-1] = m
+	c.midi.Store(newMidi)
+	return m, nil
+}
+
+// receive pushes MIDI events of current process cycle to queue. Events are
+// read by JACK API into preallocated event, because Port.GetMidiEvents
+// allocates. Port.GetBuffer only wraps MIDI buffer of port.
+func (m *MidiInput) receive(nframes uint32) {
+	buf := m.port.GetBuffer(nframes)
+	if len(buf) == 0 {
+		return
+	}
+	port := unsafe.Pointer(&buf[0])
+	n := C.jack_midi_get_event_count(port)
+	for i := C.uint32_t(0); i < n; i++ {
+		if C.jack_midi_event_get(&m.event, port, i) != 0 {
+			continue
+		}
+		m.push(unsafe.Slice((*byte)(unsafe.Pointer(m.event.buffer)), int(m.event.size)))
+	}
+}
+
+// push adds message to queue, if it is mapped. It never blocks, message
+// is dropped, if queue is full.
+func (m *MidiInput) push(msg []byte) {
+	if len(msg) != 3 {
+		return
+	}
+	status := msg[0]
+	if m.mapping.Channel != 0 && int(status&0x0f)+1 != m.mapping.Channel {
+		return
+	}
+	switch status & 0xf0 {
+	case midiNoteOn:
+		if _, ok := m.mapping.Notes[msg[1]]; !ok || msg[2] == 0 {
+			return
+		}
+	case midiControlChange:
+		if _, ok := m.mapping.Volumes[msg[1]]; !ok {
+			return
+		}
+	default:
+		return
+	}
+
+	head := atomic.LoadUint64(&m.head)
+	if head-atomic.LoadUint64(&m.tail) >= midiQueueSize {
+		atomic.AddUint64(&m.dropped, 1)
+		return
+	}
+	m.queue[head&(midiQueueSize-1)] = midiEvent{status, msg[1], msg[2]}
+	atomic.StoreUint64(&m.head, head+1)
+}
+
+func (m *MidiInput) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(midiPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.handle()
+		case <-m.quit:
+			m.handle()
+			return
+		}
+	}
+}
+
+// handle calls MidiController for all queued events.
+func (m *MidiInput) handle() {
+	tail, head := atomic.LoadUint64(&m.tail), atomic.LoadUint64(&m.head)
+	for ; tail != head; tail++ {
+		e := m.queue[tail&(midiQueueSize-1)]
+		atomic.StoreUint64(&m.tail, tail+1)
+		if e.status&0xf0 == midiControlChange {
+			m.ctrl.SetVolume(m.mapping.Volumes[e.data1], float32(e.data2)/127)
+		} else if err := m.ctrl.Action(m.mapping.Notes[e.data1]); err != nil &&
+			m.mapping.OnError != nil {
+			m.mapping.OnError(err)
+		}
+	}
+}
+
+// Dropped returns number of events, that were dropped because queue was
+// full.
+func (m *MidiInput) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// Close removes MidiInput from JACK client, unregisters its port and
+// handles remaining events.
+func (m *MidiInput) Close() error {
+	c := m.client
+	c.streamsMu.Lock()
+	oldMidi := c.midi.Load().([]*MidiInput)
+	newMidi := make([]*MidiInput, 0, len(oldMidi))
+	for _, other := range oldMidi {
+		if other != m {
+			newMidi = append(newMidi, other)
+		}
+	}
+	c.midi.Store(newMidi)
+	c.streamsMu.Unlock()
+
+	c.waitCycle()
+	err := unregister(c, []*jack.Port{m.port})
+	m.port = nil
+	close(m.quit)
+	<-m.done
+	return err
+}
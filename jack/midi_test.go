@@ -0,0 +1,66 @@
+package jack
+
+import (
+	"github.com/kikht/mix/controller"
+
+	"errors"
+	"testing"
+)
+
+type testController struct {
+	actions []string
+	volumes map[controller.Category]float32
+}
+
+func (c *testController) Action(label string) error {
+	c.actions = append(c.actions, label)
+	if label == "bad" {
+		return errors.New("Bad action")
+	}
+	return nil
+}
+
+func (c *testController) SetVolume(category controller.Category, gain float32) {
+	c.volumes[category] = gain
+}
+
+func TestMidiInput(t *testing.T) {
+	ctrl := &testController{volumes: make(map[controller.Category]float32)}
+	var errs []error
+	m := newMidiInput(ctrl, MidiMap{
+		Channel: 2,
+		Notes:   map[uint8]string{36: "day", 37: "night", 38: "bad"},
+		Volumes: map[uint8]controller.Category{7: controller.CategoryMusic},
+		OnError: func(err error) { errs = append(errs, err) },
+	})
+	m.push([]byte{0x91, 36, 100})
+	m.push([]byte{0x91, 37, 0})   // note off
+	m.push([]byte{0x81, 37, 100}) // note off
+	m.push([]byte{0x90, 37, 100}) // other channel
+	m.push([]byte{0x91, 39, 100}) // unmapped
+	m.push([]byte{0xb1, 7, 127})
+	m.push([]byte{0xb1, 8, 0}) // unmapped
+	m.push([]byte{0xb1, 7, 0})
+	m.push([]byte{0x91, 38, 1})
+	m.push([]byte{0xf8})
+	for i := 0; i < midiQueueSize; i++ {
+		m.push([]byte{0x91, 37, 1})
+	}
+	if m.Dropped() != 4 {
+		t.Error("Invalid number of dropped events", m.Dropped())
+	}
+
+	go m.run()
+	close(m.quit)
+	<-m.done
+	if len(ctrl.actions) != midiQueueSize-2 || ctrl.actions[0] != "day" ||
+		ctrl.actions[1] != "bad" || ctrl.actions[2] != "night" {
+		t.Error("Invalid actions", ctrl.actions[0:3], len(ctrl.actions))
+	}
+	if len(errs) != 1 {
+		t.Error("Errors are not reported", errs)
+	}
+	if v, ok := ctrl.volumes[controller.CategoryMusic]; !ok || v != 0 {
+		t.Error("Invalid volume", ctrl.volumes)
+	}
+}
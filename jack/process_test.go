@@ -0,0 +1,157 @@
+package jack
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/output"
+	"github.com/kikht/mix/rtlog"
+	"github.com/kikht/mix/session"
+
+	"github.com/xthexder/go-jack"
+
+	"runtime"
+	"testing"
+	"time"
+)
+
+const (
+	testRate  = 44100
+	testChunk = 256
+)
+
+func testStream(src mix.Source) *Stream {
+	s := &Stream{
+		client:  &Client{},
+		outputs: make([][]jack.AudioSample, 2),
+		stage:   output.New(output.Config{}, 2),
+		end:     make(chan struct{}, 1),
+	}
+	for c := range s.outputs {
+		s.outputs[c] = make([]jack.AudioSample, testChunk)
+	}
+	s.sources[0] = src
+	return s
+}
+
+func testSession() mix.Source {
+	return testSessionEvery(33333)
+}
+
+// testSessionEvery returns Session, where nested Session and gain regions
+// begin every period samples.
+func testSessionEvery(period mix.Tz) mix.Source {
+	data := mix.MemSource{Rate: testRate, Data: make([]mix.Buffer, 2)}
+	for c := range data.Data {
+		data.Data[c] = mix.NewBuffer(10000)
+		for i := range data.Data[c] {
+			data.Data[c][i] = float32(i%100) / 100
+		}
+	}
+	nested := mix.NewSession(testRate)
+	nested.AddRegion(mix.Region{Source: data, Volume: 0.5, FadeIn: 1000})
+
+	s := session.NewSession(testRate, true)
+	s.AddRegion(session.Region{Source: mix.Loop(data), Volume: 0.3})
+	for b := mix.Tz(0); b < 10000000; b += period {
+		s.AddRegion(session.Region{Source: nested, Begin: b, Volume: 1, Pan: 0.3})
+		s.AddRegion(session.Region{Source: mix.Gain(data, 0.5), Begin: b + 100,
+			Volume: 1, FadeIn: 500, FadeOut: 500})
+	}
+	mix.Preallocate(s, testChunk)
+	return s
+}
+
+func TestRender(t *testing.T) {
+	s := testStream(testSession())
+	for i := 0; i < 10; i++ {
+		s.render(testChunk)
+	}
+	nonZero := false
+	for _, v := range s.outputs[0] {
+		if v != 0 {
+			nonZero = true
+		}
+		if v <= -1 || v >= 1 {
+			t.Fatal("Output is not limited", v)
+		}
+	}
+	if !nonZero {
+		t.Error("Output is silent")
+	}
+
+	end := testStream(mix.MemSource{Rate: testRate, Data: []mix.Buffer{
+		mix.NewBuffer(testChunk + 10), mix.NewBuffer(testChunk + 10)}})
+	end.render(testChunk)
+	end.render(testChunk)
+	select {
+	case <-end.End():
+	default:
+		t.Error("End of source is not signalled")
+	}
+	end.render(testChunk)
+}
+
+func TestRenderAllocs(t *testing.T) {
+	// Runtime fills type assertion caches on about every 1024th call and
+	// less often, as they grow (see runtime.typeAssert). So warm them up by
+	// other stream, that mixes regions of every type in every short chunk.
+	// Measured stream must not allocate since its first chunk.
+	warm := testStream(testSessionEvery(1000))
+	for i := 0; i < 1<<16; i++ {
+		warm.render(16)
+	}
+	s := testStream(testSession())
+	// Background goroutine of rtlog allocates, while it prints messages
+	// of other tests, so let it print them.
+	time.Sleep(2 * rtlog.DrainPeriod)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 1000; i++ {
+		s.render(testChunk)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.Mallocs - before.Mallocs; n != 0 {
+		t.Error("Real-time render path allocates memory:", n)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	data := mix.NewBuffer(10000)
+	for i := range data {
+		data[i] = float32(i) / 10000
+	}
+	s := testStream(mix.MemSource{Rate: testRate, Data: []mix.Buffer{data, data}})
+	pos := func() mix.Tz {
+		return mix.Tz(s.state >> stateBits)
+	}
+
+	s.render(testChunk)
+	s.Pause()
+	s.render(testChunk)
+	if pos() != testChunk || s.outputs[0][1] != 0 {
+		t.Error("Pause does not hold position", pos(), s.outputs[0][1])
+	}
+	s.Resume()
+	s.Seek(5000)
+	s.render(testChunk)
+	if pos() != 5000+testChunk || s.outputs[0][1] != jack.AudioSample(0.5001/1.5001) {
+		t.Error("Invalid position after seek", pos(), s.outputs[0][1])
+	}
+
+	s.Stop(2 * testChunk)
+	s.render(testChunk)
+	s.render(testChunk)
+	if v := s.outputs[1][testChunk-1]; v <= 0 || v > 0.01 {
+		t.Error("Source is not faded out", v)
+	}
+	select {
+	case <-s.End():
+	default:
+		t.Error("End of stopped stream is not signalled")
+	}
+	s.render(testChunk)
+	for _, v := range s.outputs[0] {
+		if v != 0 {
+			t.Fatal("Stopped stream is not silent")
+		}
+	}
+}
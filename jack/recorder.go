@@ -0,0 +1,159 @@
+package jack
+
+import (
+	"github.com/kikht/mix"
+
+	"github.com/xthexder/go-jack"
+
+	"sync/atomic"
+	"time"
+)
+
+const (
+	recorderBufferSize = 1 << 17 // frames, must be power of 2
+	recorderPeriod     = 20 * time.Millisecond
+)
+
+// Recorder writes audio captured in process callback to encoder.
+// Process callback only copies samples to lock-free ring buffer, while
+// encoding happens in background goroutine. If encoder is too slow,
+// samples are dropped.
+type Recorder struct {
+	ring       [][]jack.AudioSample
+	head, tail uint64 // written and encoded frames, atomic
+	dropped    uint64 // atomic
+	remaining  int64  // frames to record, negative if unlimited, atomic
+	failed     uint32 // whether encoder failed, atomic
+
+	detach  func() // stops writes from process callback
+	encoder mix.Encoder
+	buffer  []mix.Buffer
+	err     error
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// newRecorder starts Recorder of limit frames. Negative limit means
+// unlimited recording. Limited Recorder never drops frames, instead process
+// callback waits for encoder, that is fine only in freewheel mode.
+func newRecorder(numChannels int, encoder mix.Encoder, limit mix.Tz,
+	detach func()) *Recorder {
+
+	r := &Recorder{
+		remaining: int64(limit),
+		detach:    detach,
+		ring:      make([][]jack.AudioSample, numChannels),
+		encoder:   encoder,
+		buffer:    make([]mix.Buffer, numChannels),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for c := range r.ring {
+		r.ring[c] = make([]jack.AudioSample, recorderBufferSize)
+	}
+	go r.run()
+	return r
+}
+
+// write copies n frames of buffers to ring. Unlimited Recorder does not
+// block or allocate. Frames are discarded after encoder failed.
+func (r *Recorder) write(buffers [][]jack.AudioSample, n int) {
+	remaining := atomic.LoadInt64(&r.remaining)
+	if remaining == 0 || r.isFailed() {
+		return
+	}
+	if remaining > 0 && int64(n) > remaining {
+		n = int(remaining)
+	}
+	head := atomic.LoadUint64(&r.head)
+	for head+uint64(n)-atomic.LoadUint64(&r.tail) > recorderBufferSize {
+		if remaining < 0 {
+			atomic.AddUint64(&r.dropped, uint64(n))
+			return
+		}
+		if r.isFailed() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for c, buf := range buffers {
+		for i, v := range buf[0:n] {
+			r.ring[c][(head+uint64(i))&(recorderBufferSize-1)] = v
+		}
+	}
+	atomic.StoreUint64(&r.head, head+uint64(n))
+	if remaining > 0 {
+		atomic.AddInt64(&r.remaining, -int64(n))
+	}
+}
+
+// full reports whether limited Recorder has got all frames.
+func (r *Recorder) full() bool {
+	return atomic.LoadInt64(&r.remaining) == 0
+}
+
+// isFailed reports whether encoder returned error, so Recorder does not
+// take frames anymore.
+func (r *Recorder) isFailed() bool {
+	return atomic.LoadUint32(&r.failed) != 0
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(recorderPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.encode()
+		case <-r.quit:
+			r.encode()
+			return
+		}
+	}
+}
+
+// encode passes all written frames to encoder. After error of encoder
+// frames are discarded, so that writer never waits for free space.
+func (r *Recorder) encode() {
+	tail, head := atomic.LoadUint64(&r.tail), atomic.LoadUint64(&r.head)
+	if head == tail {
+		return
+	}
+	if r.err != nil {
+		atomic.StoreUint64(&r.tail, head)
+		return
+	}
+	n := mix.Tz(head - tail)
+	for c := range r.buffer {
+		if mix.Tz(cap(r.buffer[c])) < n {
+			r.buffer[c] = mix.NewBuffer(n)
+		}
+		r.buffer[c] = r.buffer[c][0:n]
+		for i := range r.buffer[c] {
+			r.buffer[c][i] = float32(r.ring[c][(tail+uint64(i))&(recorderBufferSize-1)])
+		}
+	}
+	atomic.StoreUint64(&r.tail, head)
+	if r.err = r.encoder.Encode(r.buffer); r.err != nil {
+		atomic.StoreUint32(&r.failed, 1)
+	}
+}
+
+// Dropped returns number of frames, that were dropped because encoder
+// could not keep up.
+func (r *Recorder) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// Close stops recording, encodes remaining frames and closes encoder.
+// It returns the first error of encoder.
+func (r *Recorder) Close() error {
+	r.detach()
+	close(r.quit)
+	<-r.done
+	if err := r.encoder.Close(); r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
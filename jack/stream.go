@@ -1,152 +1,114 @@
 package jack
 
+/*
+#cgo LDFLAGS: -ljack
+#include <jack/jack.h>
+*/
+import "C"
+
 import (
 	"github.com/kikht/mix"
+	"github.com/kikht/mix/output"
+	"github.com/kikht/mix/rtlog"
 
-	"github.com/rkusa/gm/math32"
 	"github.com/xthexder/go-jack"
 
-	"errors"
 	"fmt"
-	"log"
-	"os"
-	"os/signal"
 	"sync/atomic"
-	"syscall"
-)
-
-var (
-	portCount   = 0
-	client      *jack.Client
-	streams     atomic.Value
-	reaper      = make(chan *Stream, 10)
-	outputPorts []string
+	"unsafe"
 )
 
 type Stream struct {
-	state   uint64
-	sources [2]mix.Source
-	ports   []*jack.Port
-	end     chan struct{}
-}
-
-func init() {
-	log.Println("jack.init()")
-	var status int
-	client, status = jack.ClientOpen("gomix", jack.NullOption|jack.NoStartServer)
-	if status != 0 {
-		log.Println("connecting client: ", jack.StrError(status))
-		client = nil
-		return
-	}
-
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT,
-		syscall.SIGQUIT, syscall.SIGHUP)
-	go func() {
-		<-sigs
-		log.Println("Closing jack connection")
-		client.Close()
-		os.Exit(-1)
-	}()
-
-	status = client.SetProcessCallback(process)
-	if status != 0 {
-		log.Println("set callback: ", jack.StrError(status))
-		client.Close()
-		client = nil
-		return
-	}
-	outputPorts = client.GetPorts("", "", jack.PortIsPhysical|jack.PortIsInput)
-	if outputPorts == nil {
-		log.Println("Can not find output ports")
-		client.Close()
-		client = nil
-		return
-	}
-	log.Println("jack output ports", outputPorts)
-	streams.Store([]*Stream{})
-
-	log.Println("jack.Play()")
-	status = client.Activate()
-	if status != 0 {
-		client.Close()
-		client = nil
-		log.Println("activate jack client:", jack.StrError(status))
-	}
+	client   *Client
+	state    uint64
+	follow   int32 // whether Stream follows transport, atomic
+	origin   int64 // transport frame of zero position, atomic
+	sources  [2]mix.Source
+	ports    []*jack.Port
+	outputs  [][]jack.AudioSample // port buffers of current cycle
+	stage    *output.Stage
+	end      chan struct{}
+	err      atomic.Value // first error of played source
+	recorder atomic.Value // *Recorder of output
 }
 
 const (
-	stateBits = 1
+	stateBits = 2
 	srcBit    = 1
+	pauseBit  = 2
+	flagsMask = 1<<stateBits - 1
 )
 
-func process(nframes uint32) int {
-	chunkSize := mix.Tz(nframes)
-	streamList := streams.Load().([]*Stream)
-	for _, stream := range streamList {
-		if stream == nil {
-			continue
-		}
-		state := atomic.AddUint64(&stream.state, uint64(chunkSize<<stateBits))
-		posAfter := mix.Tz(state >> stateBits)
-		pos := posAfter - chunkSize
-		src := stream.sources[state&srcBit]
+// render advances Stream by chunkSize samples and writes them to outputs.
+// It is called from JACK thread, so it must not allocate memory, block or
+// make system calls. Sources must be preallocated (see mix.Preallocator)
+// for that.
+func (stream *Stream) render(chunkSize mix.Tz) {
+	stream.fill(chunkSize)
+	if rec, _ := stream.recorder.Load().(*Recorder); rec != nil {
+		rec.write(stream.outputs, int(chunkSize))
+	}
+}
 
-		if src == nil {
-			continue
+func (stream *Stream) fill(chunkSize mix.Tz) {
+	paused := atomic.LoadUint64(&stream.state)&pauseBit != 0
+	if !paused && atomic.LoadInt32(&stream.follow) != 0 {
+		paused = !stream.followTransport()
+	}
+	if paused {
+		for _, out := range stream.outputs {
+			silence(out[0:chunkSize])
 		}
+		return
+	}
+	state := atomic.AddUint64(&stream.state, uint64(chunkSize<<stateBits))
+	posAfter := mix.Tz(state >> stateBits)
+	pos := posAfter - chunkSize
+	src := stream.sources[state&srcBit]
 
-		end := src.Length()
-		if pos < end && posAfter >= end {
-			select {
-			case stream.end <- struct{}{}:
-			default:
-			}
-			continue
+	if src == nil || pos >= src.Length() {
+		for _, out := range stream.outputs {
+			silence(out[0:chunkSize])
 		}
+		return
+	}
+	length := chunkSize
+	if end := src.Length(); posAfter >= end { // unbounded sources never end
+		length = end - pos
+		stream.signalEnd()
+	}
 
-		for c, port := range stream.ports {
-			//TODO: get rid of copy, mix directly to buffer
-			dstBuf := port.GetBuffer(nframes)
-			srcBuf := src.Samples(c, pos, chunkSize)
-			for i, v := range srcBuf {
-				dstBuf[i] = jack.AudioSample(v / (1 + math32.Abs(v)))
-			}
-		}
+	for c, out := range stream.outputs {
+		//TODO: get rid of copy, mix directly to buffer
+		stream.stage.Process(c, samples(out), src.Samples(c, pos, length))
+		silence(out[length:chunkSize])
+	}
+	if err := mix.SourceErr(src); err != nil && stream.err.Load() == nil {
+		stream.err.Store(err)
+		rtlog.Log("jack: source error at", int64(pos))
+		stream.signalEnd()
 	}
-	return 0
 }
 
-func NewStream(numChannels int) (*Stream, error) {
-	log.Println("jack.NewStream()")
-	if client == nil {
-		return nil, errors.New("Can not create stream without jack connection")
+func (stream *Stream) signalEnd() {
+	select {
+	case stream.end <- struct{}{}:
+	default:
 	}
-	stream := &Stream{
-		ports: make([]*jack.Port, numChannels),
-		end:   make(chan struct{}, 1),
+}
+
+// samples returns port buffer as mix.Buffer without copying.
+func samples(buf []jack.AudioSample) mix.Buffer {
+	if len(buf) == 0 {
+		return nil
 	}
-	for i := range stream.ports {
-		portCount++
-		stream.ports[i] = client.PortRegister(fmt.Sprintf("out_%d", portCount),
-			jack.DEFAULT_AUDIO_TYPE, jack.PortIsOutput, 0)
-		if stream.ports[i] == nil {
-			return nil, errors.New("Can not register jack port")
-		}
-		outName := outputPorts[i%len(outputPorts)]
-		status := client.Connect(stream.ports[i].GetName(), outName)
-		if status != 0 {
-			return nil, fmt.Errorf("Can not connect %d to %s: %s", i,
-				outName, jack.StrError(status))
-		}
+	return unsafe.Slice((*float32)(unsafe.Pointer(&buf[0])), len(buf))
+}
+
+func silence(buf []jack.AudioSample) {
+	for i := range buf {
+		buf[i] = 0
 	}
-	oldStreams := streams.Load().([]*Stream)
-	newStreams := make([]*Stream, len(oldStreams)+1)
-	copy(newStreams, oldStreams)
-	newStreams[len(newStreams)-1] = stream
-	streams.Store(newStreams)
-	return stream, nil
 }
 
 func (s *Stream) Play(src mix.Source) {
@@ -154,7 +116,7 @@ func (s *Stream) Play(src mix.Source) {
 	//src bit must be changed only by controller thread
 	s.sources[(orig&srcBit)^srcBit] = src
 	for {
-		log.Println("jack.Stream.Play() iteration", s.state)
+		rtlog.Log("jack.Stream.Play() iteration", int64(orig))
 		upd := orig ^ srcBit
 		if atomic.CompareAndSwapUint64(&s.state, orig, upd) {
 			break
@@ -166,8 +128,8 @@ func (s *Stream) Play(src mix.Source) {
 func (s *Stream) Switch(generator mix.SourceMutator) {
 	var orig uint64
 	for {
-		log.Println("jack.Stream.Switch() iteration", s.state)
 		orig = atomic.LoadUint64(&s.state)
+		rtlog.Log("jack.Stream.Switch() iteration", int64(orig))
 		cur := s.sources[orig&srcBit]
 		pos := mix.Tz(orig >> stateBits)
 		s.sources[(orig&srcBit)^srcBit] = generator.Mutate(cur, pos)
@@ -178,16 +140,134 @@ func (s *Stream) Switch(generator mix.SourceMutator) {
 	}
 }
 
+// update atomically changes state with f.
+func (s *Stream) update(f func(state uint64) uint64) {
+	for {
+		orig := atomic.LoadUint64(&s.state)
+		if atomic.CompareAndSwapUint64(&s.state, orig, f(orig)) {
+			return
+		}
+	}
+}
+
+// Pause plays silence and holds position until Resume.
+func (s *Stream) Pause() {
+	s.update(func(state uint64) uint64 {
+		return state | pauseBit
+	})
+}
+
+// Resume continues playing after Pause.
+func (s *Stream) Resume() {
+	s.update(func(state uint64) uint64 {
+		return state &^ pauseBit
+	})
+}
+
+// Seek moves position of played source to pos.
+func (s *Stream) Seek(pos mix.Tz) {
+	s.update(func(state uint64) uint64 {
+		return uint64(pos)<<stateBits | state&flagsMask
+	})
+}
+
+// Stop fades out played source during fade samples, then stream plays
+// silence and signals end.
+func (s *Stream) Stop(fade mix.Tz) {
+	s.Switch(mix.SourceMutatorFunc(func(cur mix.Source, pos mix.Tz) mix.Source {
+		if cur == nil {
+			return nil
+		}
+		res := mix.FadeOut(cur, pos, fade)
+		mix.Preallocate(res, s.ChunkSize())
+		return res
+	}))
+}
+
+// Record starts recording of Stream output to encoder.
+// It replaces previous Recorder, that should be closed.
+func (s *Stream) Record(encoder mix.Encoder) *Recorder {
+	return s.record(encoder, -1)
+}
+
+func (s *Stream) record(encoder mix.Encoder, limit mix.Tz) *Recorder {
+	var rec *Recorder
+	rec = newRecorder(len(s.outputs), encoder, limit, func() {
+		s.recorder.CompareAndSwap(rec, (*Recorder)(nil))
+		s.client.waitCycle()
+	})
+	s.recorder.Store(rec)
+	return rec
+}
+
+// Close removes Stream from JACK client and unregisters its ports.
+func (s *Stream) Close() error {
+	s.client.remove(s)
+	err := unregister(s.client, s.ports)
+	s.ports = nil
+	return err
+}
+
+// unregister unregisters registered ports.
+func unregister(c *Client, ports []*jack.Port) error {
+	var err error
+	for _, port := range ports {
+		if port == nil {
+			continue
+		}
+		if status := c.client.PortUnregister(port); status != 0 && err == nil {
+			err = fmt.Errorf("Can not unregister jack port: %s",
+				jack.StrError(status))
+		}
+	}
+	return err
+}
+
+// End returns channel that is signalled when played source ends or fails.
 func (s *Stream) End() <-chan struct{} {
 	return s.end
 }
 
+// Err returns the first error reported by played sources.
+// Failed source is played as silence until it is replaced.
+func (s *Stream) Err() error {
+	err, _ := s.err.Load().(error)
+	return err
+}
+
+// Stage returns output stage of Stream, e.g. to check clipped samples.
+func (s *Stream) Stage() *output.Stage {
+	return s.stage
+}
+
+// Position returns position of samples, that are heard right now.
+func (s *Stream) Position() mix.Tz {
+	pos := mix.Tz(atomic.LoadUint64(&s.state) >> stateBits)
+	if pos < s.Latency() {
+		return 0
+	}
+	return pos - s.Latency()
+}
+
+// Latency returns size of current chunk plus playback latency of ports,
+// reported by JACK.
+func (s *Stream) Latency() mix.Tz {
+	var latency, r C.jack_latency_range_t
+	for _, port := range s.ports {
+		// go-jack Port is wrapper of JACK port.
+		handle := *(**C.jack_port_t)(unsafe.Pointer(port))
+		C.jack_port_get_latency_range(handle, C.JackPlaybackLatency, &r)
+		if r.max > latency.max {
+			latency = r
+		}
+	}
+	return s.ChunkSize() + mix.Tz(latency.max)
+}
+
 func (s *Stream) SampleRate() mix.Tz {
-	return mix.Tz(client.GetSampleRate())
+	return s.client.SampleRate()
 }
 
 func (s *Stream) ChunkSize() mix.Tz {
-	return mix.Tz(client.GetBufferSize())
+	return s.client.ChunkSize()
 }
-
-//TODO: stream destroy
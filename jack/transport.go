@@ -0,0 +1,137 @@
+package jack
+
+/*
+#cgo LDFLAGS: -ljack
+#include <jack/jack.h>
+*/
+import "C"
+
+import (
+	"github.com/kikht/mix"
+
+	"github.com/xthexder/go-jack"
+
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// position is JACK transport position, filled by queryTransport.
+type position C.jack_position_t
+
+// handle returns JACK client of go-jack Client, which is its first field.
+// go-jack does not wrap transport and freewheel functions.
+func handle(client *jack.Client) *C.jack_client_t {
+	return *(**C.jack_client_t)(unsafe.Pointer(client))
+}
+
+// queryTransport updates transport state of current process cycle.
+func (c *Client) queryTransport() {
+	pos := (*C.jack_position_t)(&c.position)
+	state := C.jack_transport_query(handle(c.client), pos)
+	c.rolling = state == C.JackTransportRolling
+	c.frame = mix.Tz(pos.frame)
+}
+
+// StartTransport starts JACK transport.
+func (c *Client) StartTransport() {
+	C.jack_transport_start(handle(c.client))
+}
+
+// StopTransport stops JACK transport.
+func (c *Client) StopTransport() {
+	C.jack_transport_stop(handle(c.client))
+}
+
+// Locate moves JACK transport to frame.
+func (c *Client) Locate(frame mix.Tz) error {
+	if frame < 0 || frame > 1<<32-1 {
+		return fmt.Errorf("Invalid transport frame %d", frame)
+	}
+	if C.jack_transport_locate(handle(c.client), C.jack_nframes_t(frame)) != 0 {
+		return errors.New("Can not locate transport")
+	}
+	return nil
+}
+
+// TransportFrame returns current frame of JACK transport.
+func (c *Client) TransportFrame() mix.Tz {
+	return mix.Tz(C.jack_get_current_transport_frame(handle(c.client)))
+}
+
+// FollowTransport makes Stream follow JACK transport: it plays only while
+// transport is rolling, and its position is transport frame minus origin.
+// So source is started, stopped and located with transport. Stream is
+// silent, while transport is before origin.
+func (s *Stream) FollowTransport(origin mix.Tz) {
+	atomic.StoreInt64(&s.origin, int64(origin))
+	if atomic.SwapInt32(&s.follow, 1) == 0 {
+		atomic.AddInt32(&s.client.followers, 1)
+	}
+}
+
+// UnfollowTransport makes Stream play independently of transport.
+func (s *Stream) UnfollowTransport() {
+	if atomic.SwapInt32(&s.follow, 0) == 1 {
+		atomic.AddInt32(&s.client.followers, -1)
+	}
+}
+
+// followTransport moves Stream to transport position. It returns false,
+// if transport is not rolling or it is before origin, so Stream is silent.
+func (s *Stream) followTransport() bool {
+	c := s.client
+	if !c.rolling {
+		return false
+	}
+	frame := c.frame - mix.Tz(atomic.LoadInt64(&s.origin))
+	if frame < 0 {
+		return false
+	}
+	pos := uint64(frame)
+	for {
+		orig := atomic.LoadUint64(&s.state)
+		upd := pos<<stateBits | orig&flagsMask
+		if atomic.CompareAndSwapUint64(&s.state, orig, upd) {
+			return true
+		}
+	}
+}
+
+// Bounce records length samples of Stream output to encoder in JACK
+// freewheel mode, i.e. as fast as CPU allows. Zero length means the rest
+// of current source. Controllers could be used with Stream during Bounce,
+// but their actions are applied at faster pace.
+func (s *Stream) Bounce(encoder mix.Encoder, length mix.Tz) error {
+	if length == 0 {
+		state := atomic.LoadUint64(&s.state)
+		src := s.sources[state&srcBit]
+		if src == nil || mix.IsUnbounded(src) {
+			return errors.New("Can not bounce unbounded source")
+		}
+		length = src.Length() - mix.Tz(state>>stateBits)
+	}
+	if length <= 0 {
+		return errors.New("Nothing to bounce")
+	}
+
+	rec := s.record(encoder, length)
+	client := handle(s.client.client)
+	if C.jack_set_freewheel(client, 1) != 0 {
+		rec.Close()
+		return errors.New("Can not start freewheel")
+	}
+	for !rec.full() && !rec.isFailed() {
+		time.Sleep(time.Millisecond)
+	}
+	var err error
+	if C.jack_set_freewheel(client, 0) != 0 {
+		err = errors.New("Can not stop freewheel")
+	}
+	if recErr := rec.Close(); err == nil {
+		err = recErr
+	}
+	return err
+}
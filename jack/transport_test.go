@@ -0,0 +1,115 @@
+package jack
+
+import (
+	"github.com/kikht/mix"
+
+	"github.com/xthexder/go-jack"
+
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFollowTransport(t *testing.T) {
+	data := mix.NewBuffer(10000)
+	for i := range data {
+		data[i] = float32(i) / 10000
+	}
+	c := &Client{}
+	s := testStream(mix.Loop(mix.MemSource{Rate: testRate,
+		Data: []mix.Buffer{data, data}}))
+	s.client = c
+	s.FollowTransport(1000)
+	s.FollowTransport(1000)
+	if c.followers != 1 {
+		t.Fatal("Invalid number of followers", c.followers)
+	}
+	expect := func(pos mix.Tz, v float32) {
+		t.Helper()
+		if p := mix.Tz(s.state >> stateBits); p != pos {
+			t.Error("Invalid position", p, "expected", pos)
+		}
+		if out := s.outputs[0][1]; out != jack.AudioSample(v/(1+v)) {
+			t.Error("Invalid sample", out, "expected", v/(1+v))
+		}
+	}
+
+	s.render(testChunk)
+	expect(0, 0)
+	// Transport before origin is silence, even for unbounded source.
+	c.rolling, c.frame = true, 500
+	s.render(testChunk)
+	expect(0, 0)
+	c.frame = 1500
+	s.render(testChunk)
+	expect(500+testChunk, data[501])
+	c.frame = 4000
+	s.render(testChunk)
+	expect(3000+testChunk, data[3001])
+	c.rolling = false
+	s.render(testChunk)
+	expect(3000+testChunk, 0)
+
+	s.UnfollowTransport()
+	s.render(testChunk)
+	expect(3000+2*testChunk, data[3000+testChunk+1])
+	if c.followers != 0 {
+		t.Error("Invalid number of followers", c.followers)
+	}
+}
+
+func TestLimitedRecorder(t *testing.T) {
+	buf := make([]jack.AudioSample, testChunk)
+	for i := range buf {
+		buf[i] = 0.5
+	}
+	const chunks = 1000
+	var out bytes.Buffer
+	rec := newRecorder(2, mix.NewRawEncoder(&out, mix.Int16),
+		chunks*testChunk-10, func() {})
+	// Ring overflows, so writer waits for encoder.
+	for i := 0; i < chunks+5; i++ {
+		if rec.full() != (i >= chunks) {
+			t.Fatal("Recorder is full after", i, "chunks")
+		}
+		rec.write([][]jack.AudioSample{buf, buf}, testChunk)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal("Error while recording:", err)
+	}
+	if rec.Dropped() != 0 || out.Len() != (chunks*testChunk-10)*2*2 {
+		t.Error("Invalid recording", rec.Dropped(), out.Len())
+	}
+}
+
+type failingEncoder struct{}
+
+func (failingEncoder) Encode(buffer []mix.Buffer) error {
+	return errors.New("Disk is full")
+}
+
+func (failingEncoder) Close() error {
+	return nil
+}
+
+func TestFailedRecorder(t *testing.T) {
+	buf := make([]jack.AudioSample, testChunk)
+	const chunks = 1000
+	rec := newRecorder(2, failingEncoder{}, 10*chunks*testChunk, func() {})
+	// Writer waits for encoder, until it fails.
+	for !rec.isFailed() {
+		rec.write([][]jack.AudioSample{buf, buf}, testChunk)
+	}
+	// Then frames are discarded without waiting, even if ring overflows.
+	head := atomic.LoadUint64(&rec.head)
+	for i := 0; i < chunks; i++ {
+		rec.write([][]jack.AudioSample{buf, buf}, testChunk)
+	}
+	if atomic.LoadUint64(&rec.head) != head || rec.full() {
+		t.Error("Frames are written after failure of encoder")
+	}
+	if err := rec.Close(); err == nil {
+		t.Error("Error of encoder is not returned")
+	}
+}
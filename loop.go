@@ -0,0 +1,77 @@
+package mix
+
+// Loop returns unbounded Source, that repeats src infinitely.
+// Sample at offset is taken from src at offset modulo src.Length(),
+// so negative offsets are also valid. Loop of empty src is silence.
+func Loop(src Source) Source {
+	if src.Length() == 0 {
+		return Silence(Infinite, src.SampleRate(), src.NumChannels())
+	}
+	return &loopSource{
+		src:    src,
+		buffer: make([]Buffer, src.NumChannels()),
+	}
+}
+
+type loopSource struct {
+	src    Source
+	buffer []Buffer // for chunks that wrap around end of src
+}
+
+// Samples returns length samples of channel starting at offset.
+// Chunks that wrap around end of looped Source are copied to internal buffer.
+func (l *loopSource) Samples(channel int, offset, length Tz) Buffer {
+	n := l.src.Length()
+	offset %= n
+	if offset < 0 {
+		offset += n
+	}
+	if offset+length <= n {
+		return l.src.Samples(channel, offset, length)
+	}
+
+	if Tz(cap(l.buffer[channel])) < length {
+		l.buffer[channel] = NewBuffer(length)
+	}
+	res := l.buffer[channel][0:length]
+	for dst := res; len(dst) > 0; offset = 0 {
+		part := n - offset
+		if part > Tz(len(dst)) {
+			part = Tz(len(dst))
+		}
+		copy(dst, l.src.Samples(channel, offset, part))
+		dst = dst[part:]
+	}
+	return res
+}
+
+func (l *loopSource) SampleRate() Tz {
+	return l.src.SampleRate()
+}
+
+func (l *loopSource) NumChannels() int {
+	return l.src.NumChannels()
+}
+
+// Length returns Infinite.
+func (l *loopSource) Length() Tz {
+	return Infinite
+}
+
+func (l *loopSource) Clone() Source {
+	return l.DeepClone(Source.Clone)
+}
+
+func (l *loopSource) DeepClone(clone func(Source) Source) Source {
+	return Loop(clone(l.src))
+}
+
+func (l *loopSource) Preallocate(chunkSize Tz) {
+	preallocate(l.buffer, chunkSize)
+	Preallocate(l.src, chunkSize)
+}
+
+// Err returns error of looped Source.
+func (l *loopSource) Err() error {
+	return SourceErr(l.src)
+}
@@ -0,0 +1,85 @@
+package mix
+
+import (
+	"testing"
+)
+
+func TestLoop(t *testing.T) {
+	src := MemSource{Rate: rate, Data: []Buffer{{0, 1, 2, 3, 4}}}
+	loop := Loop(src)
+	if !IsUnbounded(loop) {
+		t.Error("Loop is not unbounded", loop.Length())
+	}
+
+	tests := []struct {
+		offset, length Tz
+		expect         Buffer
+	}{
+		{0, 3, Buffer{0, 1, 2}},
+		{7, 3, Buffer{2, 3, 4}},
+		{3, 8, Buffer{3, 4, 0, 1, 2, 3, 4, 0}},
+		{-2, 4, Buffer{3, 4, 0, 1}},
+		{Infinite - 5, 2, Buffer{2, 3}},
+	}
+	for _, test := range tests {
+		res := loop.Samples(0, test.offset, test.length)
+		if len(res) != len(test.expect) {
+			t.Error("Invalid length of loop samples", test.offset, res)
+			continue
+		}
+		for i := range res {
+			if res[i] != test.expect[i] {
+				t.Error("Invalid loop samples at", test.offset, res)
+				break
+			}
+		}
+	}
+}
+
+func TestEmptyLoop(t *testing.T) {
+	loop := Loop(MemSource{Rate: rate, Data: []Buffer{{}}})
+	if !IsUnbounded(loop) || loop.NumChannels() != 1 {
+		t.Error("Invalid loop of empty source", loop.Length(), loop.NumChannels())
+	}
+	for _, v := range loop.Samples(0, 10, 3) {
+		if v != 0 {
+			t.Error("Loop of empty source is not silent", v)
+		}
+	}
+}
+
+func TestOpenEndedRegion(t *testing.T) {
+	s := NewSession(rate)
+	loop := Loop(getTestSource(1))
+	if err := s.AddRegion(Region{Source: loop, Volume: 1, FadeOut: 10}); err == nil {
+		t.Error("FadeOut of open-ended region is accepted")
+	}
+	if err := s.AddRegion(Region{Source: loop, Begin: 10, Volume: 1, FadeIn: 50}); err != nil {
+		t.Fatal("Error while adding open-ended region", err)
+	}
+	if s.Length() != Infinite {
+		t.Error("Session with open-ended region is bounded", s.Length())
+	}
+	err := s.AddRegion(Region{Source: loop, Offset: 3, Length: Infinite, Volume: 1})
+	if err != nil {
+		t.Error("Infinite length with offset is rejected:", err)
+	}
+	err = s.AddRegion(Region{Source: getTestSource(1), Length: Infinite, Volume: 1})
+	if err == nil {
+		t.Error("Infinite length of bounded source is accepted")
+	}
+	if _, err := s.Bounce(); err == nil {
+		t.Error("Unbounded session is bounced")
+	}
+
+	far := Tz(1) << 40
+	for _, off := range []Tz{0, 1000, far} {
+		buf := s.Samples(0, off, length)
+		if off > 0 && buf[0] == 0 {
+			t.Error("Open-ended region is not playing at", off)
+		}
+	}
+	if len(s.active) != 2 || s.active[0].End != Infinite || s.active[1].End != Infinite {
+		t.Error("Invalid active regions", s.active)
+	}
+}
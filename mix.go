@@ -1,14 +1,21 @@
 // Package mix implements golang audio sequencer.
 //
 // Demo:
-//	go run examples/main.go | aplay
+//	go run ./cmd/mixrender examples/sample.json | aplay
 package mix
 
-import "time"
+import (
+	"math"
+	"time"
+)
 
 // Tz represents time in number of samples
 type Tz int64
 
+// Infinite is Length of unbounded Sources, such as generators, live inputs
+// and loops. Such Sources never end and must accept any offset.
+const Infinite Tz = math.MaxInt64
+
 // DurationToTz converts time.Duration to number of samples for specified sample rate.
 func DurationToTz(d time.Duration, sampleRate Tz) Tz {
 	return Tz(d * time.Duration(sampleRate) / time.Second)
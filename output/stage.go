@@ -0,0 +1,168 @@
+// Package output implements the last stage of players, that converts
+// mixed samples to device format: it clips samples, that exceed [-1, 1],
+// and quantizes them to integer resolution with dither and noise shaping.
+//
+//	stage := output.New(output.Config{Clip: output.ClipTanh, Bits: 16,
+//		Dither: true, NoiseShaping: true}, 2)
+//	stage.Process(0, out[0], src.Samples(0, pos, length))
+//	...
+//	log.Println("Clipped samples:", stage.Clipped())
+package output
+
+import (
+	"github.com/kikht/mix"
+
+	"github.com/rkusa/gm/math32"
+
+	"math"
+	"sync/atomic"
+)
+
+// ClipMode defines how samples outside of [-1, 1] are handled.
+type ClipMode int
+
+const (
+	ClipRational ClipMode = iota // soft v/(1+|v|) curve on all samples
+	ClipHard                     // samples are limited to [-1, 1]
+	ClipTanh                     // soft tanh(v) curve on all samples
+	ClipNone                     // samples are passed as is
+)
+
+// Config describes conversion of Stage. Zero Config applies rational
+// curve and leaves float samples unquantized.
+type Config struct {
+	Clip ClipMode
+	// Bits is resolution of integer target, e.g. 16 or 24. Zero means
+	// float target, that is not quantized.
+	Bits int
+	// Dither adds TPDF dither of 2 LSB peak-to-peak before quantization.
+	Dither bool
+	// NoiseShaping moves quantization noise to high frequencies with
+	// second order error feedback. It is meant for 16-bit targets.
+	NoiseShaping bool
+}
+
+// maxShapedError limits feedback of noise shaping in LSB, so that
+// quantization stays stable after hard clipping of target range.
+const maxShapedError = 2
+
+// Stage converts samples of one stream. Process must be called from one
+// goroutine, Clipped is safe to call concurrently.
+type Stage struct {
+	cfg     Config
+	scale   float32      // maximum integer sample of target
+	errors  [][2]float32 // last quantization errors of channels in LSB
+	random  uint32       // state of xorshift generator
+	clipped uint64       // atomic
+}
+
+// New creates Stage for numChannels channels.
+func New(cfg Config, numChannels int) *Stage {
+	s := &Stage{
+		cfg:    cfg,
+		errors: make([][2]float32, numChannels),
+		random: 0x9e3779b9,
+	}
+	if cfg.Bits > 0 {
+		// Integer encoders of mix scale samples by the same factor.
+		s.scale = float32(int64(1)<<uint(cfg.Bits-1) - 1)
+	}
+	return s
+}
+
+// Config returns configuration of Stage.
+func (s *Stage) Config() Config {
+	return s.cfg
+}
+
+// Process converts samples of channel from src to dst. Dst may be the same
+// buffer as src, it must be not shorter than src. Samples of integer
+// target are multiples of 1/(2^(Bits-1)-1), so that mix encoders and
+// players convert them exactly.
+func (s *Stage) Process(channel int, dst, src mix.Buffer) {
+	var clipped uint64
+	dst = dst[0:len(src)]
+	for i, v := range src {
+		if v > 1 || v < -1 {
+			clipped++
+		}
+		dst[i] = s.clip(v)
+	}
+	if clipped != 0 {
+		atomic.AddUint64(&s.clipped, clipped)
+	}
+	if s.cfg.Bits > 0 {
+		s.quantize(channel, dst)
+	}
+}
+
+func (s *Stage) clip(v float32) float32 {
+	switch s.cfg.Clip {
+	case ClipHard:
+		if v > 1 {
+			return 1
+		} else if v < -1 {
+			return -1
+		}
+		return v
+	case ClipTanh:
+		return float32(math.Tanh(float64(v)))
+	case ClipNone:
+		return v
+	default:
+		return v / (1 + math32.Abs(v))
+	}
+}
+
+// quantize rounds samples of buf to target resolution in place.
+func (s *Stage) quantize(channel int, buf mix.Buffer) {
+	e := s.errors[channel]
+	for i, v := range buf {
+		x := v * s.scale
+		if s.cfg.NoiseShaping {
+			// Noise transfer function is (1 - z^-1)^2.
+			x -= 2*e[0] - e[1]
+		}
+		q := x
+		if s.cfg.Dither {
+			q += s.uniform() + s.uniform()
+		}
+		q = float32(math.Floor(float64(q) + 0.5))
+		if q > s.scale {
+			q = s.scale
+		} else if q < -s.scale {
+			q = -s.scale
+		}
+		if s.cfg.NoiseShaping {
+			err := q - x
+			if err > maxShapedError {
+				err = maxShapedError
+			} else if err < -maxShapedError {
+				err = -maxShapedError
+			}
+			e[0], e[1] = err, e[0]
+		}
+		buf[i] = q / s.scale
+	}
+	s.errors[channel] = e
+}
+
+// uniform returns pseudo-random number in [-0.5, 0.5).
+func (s *Stage) uniform() float32 {
+	r := s.random
+	r ^= r << 13
+	r ^= r >> 17
+	r ^= r << 5
+	s.random = r
+	return float32(r>>8)/(1<<24) - 0.5
+}
+
+// Clipped returns number of samples, that exceeded [-1, 1] before clipping.
+func (s *Stage) Clipped() uint64 {
+	return atomic.LoadUint64(&s.clipped)
+}
+
+// ResetClipped resets counter of clipped samples and returns its value.
+func (s *Stage) ResetClipped() uint64 {
+	return atomic.SwapUint64(&s.clipped, 0)
+}
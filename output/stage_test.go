@@ -0,0 +1,102 @@
+package output
+
+import (
+	"github.com/kikht/mix"
+
+	"math"
+	"testing"
+)
+
+func TestClip(t *testing.T) {
+	src := mix.Buffer{-2, -0.5, 0, 1, 3}
+	tests := []struct {
+		mode   ClipMode
+		expect mix.Buffer
+	}{
+		{ClipRational, mix.Buffer{-2.0 / 3, -1.0 / 3, 0, 0.5, 0.75}},
+		{ClipHard, mix.Buffer{-1, -0.5, 0, 1, 1}},
+		{ClipTanh, mix.Buffer{float32(math.Tanh(-2)), float32(math.Tanh(-0.5)), 0,
+			float32(math.Tanh(1)), float32(math.Tanh(3))}},
+		{ClipNone, src},
+	}
+	for _, test := range tests {
+		s := New(Config{Clip: test.mode}, 1)
+		dst := mix.NewBuffer(mix.Tz(len(src)))
+		s.Process(0, dst, src)
+		for i := range dst {
+			if math.Abs(float64(dst[i]-test.expect[i])) > 1e-6 {
+				t.Error("Invalid samples of mode", test.mode, dst, test.expect)
+				break
+			}
+		}
+		if s.Clipped() != 2 {
+			t.Error("Invalid number of clipped samples", s.Clipped())
+		}
+	}
+
+	s := New(Config{}, 1)
+	s.Process(0, src, src)
+	if src[3] != 0.5 || s.ResetClipped() != 2 || s.Clipped() != 0 {
+		t.Error("In-place conversion is broken", src, s.Clipped())
+	}
+}
+
+// quantized returns samples of constant input in LSB and checks, that
+// they are integer.
+func quantized(t *testing.T, cfg Config, v float32, n int) []float64 {
+	t.Helper()
+	s := New(cfg, 2)
+	src := mix.NewBuffer(mix.Tz(n))
+	for i := range src {
+		src[i] = v
+	}
+	dst := mix.NewBuffer(mix.Tz(n))
+	s.Process(1, dst, src)
+	res := make([]float64, n)
+	for i, q := range dst {
+		x := q * math.MaxInt16
+		if int16(x) != int16(math.Floor(float64(x)+0.5)) {
+			t.Fatalf("Sample %d is not quantized: %f", i, x)
+		}
+		res[i] = float64(int16(x))
+	}
+	return res
+}
+
+func TestQuantize(t *testing.T) {
+	const lsb = 1.0 / math.MaxInt16
+	cfg := Config{Clip: ClipNone, Bits: 16}
+	if q := quantized(t, cfg, 0.3*lsb, 100); q[0] != 0 || q[99] != 0 {
+		t.Error("Sample is not rounded", q[0])
+	}
+	if q := quantized(t, cfg, 2, 1); q[0] != math.MaxInt16 {
+		t.Error("Sample is not limited", q[0])
+	}
+
+	// Dither makes quantization error independent of signal, so that
+	// average of samples is preserved.
+	const n = 100000
+	cfg.Dither = true
+	q := quantized(t, cfg, 0.3*lsb, n)
+	var sum float64
+	levels := make(map[float64]bool)
+	for _, v := range q {
+		sum += v
+		levels[v] = true
+	}
+	if avg := sum / n; math.Abs(avg-0.3) > 0.01 || len(levels) != 3 {
+		t.Error("Invalid dither", avg, levels)
+	}
+
+	// Noise shaping cancels error at low frequencies, so that sum of
+	// errors is bounded.
+	cfg.NoiseShaping = true
+	q = quantized(t, cfg, 0.3*lsb, n)
+	sum = 0
+	for i, v := range q {
+		sum += v - 0.3
+		if math.Abs(sum) > 10 {
+			t.Fatal("Noise is not shaped at sample", i, sum)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Package pipe implements pure Go real-time player, that writes WAV or raw
+// PCM to io.Writer or to standard input of spawned command:
+//
+//	stream, _ := pipe.Command(pipe.Config{}, "aplay", "-q", "-")
+//	defer stream.Close()
+//	stream.Play(src)
+//	<-stream.End()
+//
+// Stream is paced by monotonic clock, so that it could be used with
+// controllers instead of jack or sfml players.
+package pipe
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/output"
+
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Config describes output of Stream. Zero fields are replaced by defaults.
+type Config struct {
+	SampleRate  mix.Tz           // 44100 by default
+	ChunkSize   mix.Tz           // 1024 by default
+	NumChannels int              // 2 by default
+	Format      mix.SampleFormat // mix.Float32 by default
+	Raw         bool             // write raw PCM instead of WAV
+	// Latency is number of samples written ahead of clock to fill
+	// buffers of consumer. 4 chunks by default.
+	Latency mix.Tz
+	// Output configures conversion of samples. Its Bits are set by Format:
+	// Int16 and Int24 samples are quantized, so that they could be
+	// dithered.
+	Output output.Config
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 44100
+	}
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = 1024
+	}
+	if cfg.NumChannels == 0 {
+		cfg.NumChannels = 2
+	}
+	if cfg.Latency == 0 {
+		cfg.Latency = 4 * cfg.ChunkSize
+	}
+}
+
+// Stream is mix.Player and mix.SwitchPlayer, that encodes played source
+// chunk by chunk in real-time pace.
+type Stream struct {
+	cfg     Config
+	encoder mix.Encoder
+	buffer  []mix.Buffer
+	stage   *output.Stage
+	cmd     *exec.Cmd
+	stdin   io.Closer
+
+	mu    sync.Mutex
+	src   mix.Source
+	pos   mix.Tz // position of the next written chunk
+	start time.Time
+	err   error
+	end   chan struct{}
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewStream starts Stream, that writes to w. It plays silence until
+// the first Play or Switch.
+func NewStream(w io.Writer, cfg Config) *Stream {
+	cfg.setDefaults()
+	var encoder mix.Encoder
+	if cfg.Raw {
+		encoder = mix.NewRawEncoder(w, cfg.Format)
+	} else {
+		encoder = mix.NewWavEncoder(w, cfg.SampleRate, cfg.NumChannels,
+			cfg.Format)
+	}
+	return NewEncoderStream(encoder, cfg)
+}
+
+// NewEncoderStream starts Stream, that passes every chunk to encoder,
+// e.g. to serve it to network clients. Raw field of cfg is ignored, while
+// Format defines quantization of output stage.
+func NewEncoderStream(encoder mix.Encoder, cfg Config) *Stream {
+	cfg.setDefaults()
+	cfg.Output.Bits = 0
+	if cfg.Format == mix.Int16 || cfg.Format == mix.Int24 {
+		cfg.Output.Bits = cfg.Format.Bits()
+	}
+	s := &Stream{
+		cfg:     cfg,
+		encoder: encoder,
+		buffer:  make([]mix.Buffer, cfg.NumChannels),
+		stage:   output.New(cfg.Output, cfg.NumChannels),
+		end:     make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for c := range s.buffer {
+		s.buffer[c] = mix.NewBuffer(cfg.ChunkSize)
+	}
+	s.start = time.Now()
+	go s.run()
+	return s
+}
+
+// Command spawns command and starts Stream, that writes to its standard
+// input. Output of command goes to standard output and error of process.
+func Command(cfg Config, name string, args ...string) (*Stream, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.New("Can not start player command: " + err.Error())
+	}
+	s := NewStream(stdin, cfg)
+	s.cmd = cmd
+	s.stdin = stdin
+	return s, nil
+}
+
+// Close stops Stream and finalizes output. If Stream was started with
+// Command, Close waits for command to exit.
+func (s *Stream) Close() error {
+	close(s.quit)
+	<-s.done
+	err := s.encoder.Close()
+	if s.cmd != nil {
+		s.stdin.Close()
+		if cmdErr := s.cmd.Wait(); err == nil {
+			err = cmdErr
+		}
+	}
+	return err
+}
+
+func (s *Stream) run() {
+	defer close(s.done)
+	for {
+		pos, err := s.render()
+		if err == nil {
+			err = s.encoder.Encode(s.buffer)
+			if err != nil {
+				err = errors.New("Can not write audio: " + err.Error())
+			}
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			s.signalEnd()
+			return
+		}
+
+		// Chunk after pos is written, when clock reaches its beginning
+		// minus latency.
+		next := pos + s.cfg.ChunkSize - s.cfg.Latency
+		wait := time.Until(s.start.Add(tzToDuration(next, s.cfg.SampleRate)))
+		if wait <= 0 {
+			select {
+			case <-s.quit:
+				return
+			default:
+				continue
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// render fills buffer with the next chunk and returns its position.
+func (s *Stream) render() (mix.Tz, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos, src := s.pos, s.src
+	s.pos += s.cfg.ChunkSize
+	if src == nil || pos >= src.Length() {
+		for _, buf := range s.buffer {
+			buf.Zero()
+		}
+		return pos, nil
+	}
+
+	length := s.cfg.ChunkSize
+	if end := src.Length(); pos+length > end {
+		length = end - pos
+	}
+	for c, buf := range s.buffer {
+		// Mono sources are played on all channels.
+		n := copy(buf, src.Samples(c%src.NumChannels(), pos, length))
+		buf[n:].Zero()
+		s.stage.Process(c, buf[0:n], buf[0:n])
+	}
+	if err := mix.SourceErr(src); err != nil {
+		return pos, err
+	}
+	if pos+s.cfg.ChunkSize >= src.Length() {
+		s.signalEnd()
+	}
+	return pos, nil
+}
+
+func (s *Stream) signalEnd() {
+	select {
+	case s.end <- struct{}{}:
+	default:
+	}
+}
+
+func tzToDuration(t, sampleRate mix.Tz) time.Duration {
+	return time.Duration(t) * time.Second / time.Duration(sampleRate)
+}
+
+// Play replaces played source with src from the next written chunk.
+func (s *Stream) Play(src mix.Source) {
+	s.mu.Lock()
+	s.src = src
+	s.mu.Unlock()
+}
+
+// Switch replaces played source with result of mutator, that is called
+// with position of the next written chunk.
+func (s *Stream) Switch(mutator mix.SourceMutator) {
+	s.mu.Lock()
+	s.src = mutator.Mutate(s.src, s.pos)
+	s.mu.Unlock()
+}
+
+// Position returns number of samples played according to clock.
+// It never exceeds number of written samples.
+func (s *Stream) Position() mix.Tz {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos := mix.DurationToTz(time.Since(s.start), s.cfg.SampleRate)
+	if pos > s.pos {
+		pos = s.pos
+	}
+	return pos
+}
+
+// Latency returns maximal number of samples written ahead of clock.
+func (s *Stream) Latency() mix.Tz {
+	return s.cfg.Latency
+}
+
+// End returns channel that is signalled when played source ends or fails.
+func (s *Stream) End() <-chan struct{} {
+	return s.end
+}
+
+// Err returns error, that stopped the stream.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Stage returns output stage of Stream, e.g. to check clipped samples.
+func (s *Stream) Stage() *output.Stage {
+	return s.stage
+}
+
+func (s *Stream) SampleRate() mix.Tz {
+	return s.cfg.SampleRate
+}
+
+func (s *Stream) ChunkSize() mix.Tz {
+	return s.cfg.ChunkSize
+}
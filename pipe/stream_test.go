@@ -0,0 +1,129 @@
+package pipe
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/output"
+
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const rate = 8000
+
+func constSource(v float32, n mix.Tz) mix.Source {
+	buf := mix.NewBuffer(n)
+	for i := range buf {
+		buf[i] = v
+	}
+	return mix.MemSource{Rate: rate, Data: []mix.Buffer{buf}}
+}
+
+// delayed returns mutator, that starts src at current position.
+func delayed(src mix.Source, start *mix.Tz) mix.SourceMutator {
+	return mix.SourceMutatorFunc(func(cur mix.Source, pos mix.Tz) mix.Source {
+		*start = pos
+		res, _ := mix.Concat(mix.Silence(pos, rate, 1), src)
+		return res
+	})
+}
+
+func TestStream(t *testing.T) {
+	var (
+		out    bytes.Buffer
+		start  mix.Tz
+		length mix.Tz = rate / 10
+	)
+	cfg := Config{SampleRate: rate, ChunkSize: 80, Latency: 160, Raw: true}
+	stream := NewStream(&out, cfg)
+	began := time.Now()
+	stream.Switch(delayed(constSource(0.5, length), &start))
+	<-stream.End()
+	elapsed := time.Since(began)
+	if err := stream.Close(); err != nil {
+		t.Fatal("Error while closing stream:", err)
+	}
+	if stream.Err() != nil {
+		t.Error("Unexpected error:", stream.Err())
+	}
+
+	// Source is written in real time minus latency and current chunk.
+	if min := tzToDuration(length-cfg.Latency-2*cfg.ChunkSize, rate); elapsed < min {
+		t.Errorf("Stream is too fast: %v, expected at least %v", elapsed, min)
+	}
+	if pos := stream.Position(); pos < start+length-cfg.Latency-cfg.ChunkSize {
+		t.Error("Invalid position", pos, "source ends at", start+length)
+	}
+
+	data := out.Bytes()
+	if mix.Tz(len(data)) < (start+length)*2*4 {
+		t.Fatal("Output is too short", len(data))
+	}
+	for i := mix.Tz(0); i < (start+length)*2; i++ {
+		v := math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+		expect := float32(0)
+		if i >= start*2 {
+			expect = 0.5 / 1.5
+		}
+		if v != expect {
+			t.Fatalf("Invalid sample %d: %f, expected %f", i, v, expect)
+		}
+	}
+}
+
+func TestOutputStage(t *testing.T) {
+	var out bytes.Buffer
+	cfg := Config{SampleRate: rate, ChunkSize: 80, Latency: 80, Raw: true,
+		Format: mix.Int16, Output: output.Config{Clip: output.ClipHard}}
+	stream := NewStream(&out, cfg)
+	stream.Play(constSource(2, 160))
+	<-stream.End()
+	if err := stream.Close(); err != nil {
+		t.Fatal("Error while closing stream:", err)
+	}
+	if stream.Stage().Config().Bits != 16 || stream.Stage().Clipped() != 2*160 {
+		t.Error("Invalid output stage", stream.Stage().Config(),
+			stream.Stage().Clipped())
+	}
+	data := out.Bytes()
+	for i := 0; i < 2*160; i++ {
+		if v := int16(binary.LittleEndian.Uint16(data[2*i:])); v != math.MaxInt16 {
+			t.Fatalf("Invalid sample %d: %d", i, v)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWriteError(t *testing.T) {
+	stream := NewStream(failingWriter{}, Config{SampleRate: rate})
+	<-stream.End()
+	if stream.Err() == nil {
+		t.Error("Write error is not reported")
+	}
+	stream.Close()
+}
+
+func TestCommand(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat is not available")
+	}
+	stream, err := Command(Config{SampleRate: rate}, "sh", "-c", "cat > /dev/null")
+	if err != nil {
+		t.Fatal("Can not start command:", err)
+	}
+	var start mix.Tz
+	stream.Switch(delayed(constSource(0.5, rate/20), &start))
+	<-stream.End()
+	if err := stream.Close(); err != nil {
+		t.Error("Error while closing command stream:", err)
+	}
+}
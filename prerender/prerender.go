@@ -0,0 +1,313 @@
+// Package prerender implements render-ahead stage between mixer and audio
+// device callback.
+//
+// Renderer mixes its Source in background goroutine into lock-free ring
+// buffer of chunks, while device callback only takes ready chunks from it.
+// Renderer itself is unbounded Source, that should be played by device
+// player, and it is Player and SwitchPlayer for controllers:
+//
+//	stream, _ := jack.NewStream(2)
+//	r := prerender.New(stream, 2, 4)
+//	defer r.Close()
+//	stream.Play(r)
+//	ctrl := controller.NewSwitchController(r)
+package prerender
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/rtlog"
+
+	"sync/atomic"
+	"time"
+)
+
+// Renderer is a Source, that plays pre-rendered chunks of other Source.
+// Device must read it by chunks of ChunkSize() samples, aligned to chunk
+// boundaries, from one goroutine.
+type Renderer struct {
+	rate      mix.Tz
+	chunkSize mix.Tz
+	slots     []slot
+
+	// High 32 bits are number of released slots, low 32 bits are number of
+	// published slots. Both are changed with CAS, so that Renderer could
+	// drop published slots, which are not played yet.
+	state uint64
+
+	want      int64 // position after chunk missed by device, atomic
+	underruns uint64
+	playing   uint32 // whether there is a source, atomic
+	err       atomic.Value
+	end       chan struct{}
+
+	silence  []mix.Buffer
+	requests chan request
+	quit     chan struct{}
+
+	// Owned by render goroutine.
+	src  mix.Source
+	next mix.Tz
+}
+
+type slot struct {
+	pos    mix.Tz
+	buffer []mix.Buffer
+}
+
+type request struct {
+	mutator mix.SourceMutator
+	done    chan struct{}
+}
+
+// New starts Renderer, that renders ahead chunks of player.ChunkSize()
+// samples with numChannels channels. Device callback is not blocked
+// by mixing, unless it is more than ahead chunks late.
+func New(player mix.PlayerState, numChannels, ahead int) *Renderer {
+	r := &Renderer{
+		rate:      player.SampleRate(),
+		chunkSize: player.ChunkSize(),
+		slots:     make([]slot, ahead+1),
+		end:       make(chan struct{}, 1),
+		silence:   make([]mix.Buffer, numChannels),
+		requests:  make(chan request),
+		quit:      make(chan struct{}),
+	}
+	for i := range r.slots {
+		r.slots[i].buffer = make([]mix.Buffer, numChannels)
+		for c := range r.slots[i].buffer {
+			r.slots[i].buffer[c] = mix.NewBuffer(r.chunkSize)
+		}
+	}
+	for c := range r.silence {
+		r.silence[c] = mix.NewBuffer(r.chunkSize)
+	}
+	go r.run()
+	return r
+}
+
+// Close stops render goroutine.
+func (r *Renderer) Close() {
+	close(r.quit)
+}
+
+func split(state uint64) (released, published uint32) {
+	return uint32(state >> 32), uint32(state)
+}
+
+func join(released, published uint32) uint64 {
+	return uint64(released)<<32 | uint64(published)
+}
+
+// Samples returns pre-rendered samples. It does not block or allocate.
+// If chunk is not rendered yet, it returns silence and Renderer skips
+// to requested position.
+func (r *Renderer) Samples(channel int, offset, length mix.Tz) mix.Buffer {
+	for {
+		state := atomic.LoadUint64(&r.state)
+		released, published := split(state)
+		if released == published {
+			break
+		}
+		s := &r.slots[released%uint32(len(r.slots))]
+		if s.pos+r.chunkSize <= offset {
+			// Device went further, release slot.
+			atomic.CompareAndSwapUint64(&r.state, state, join(released+1, published))
+			continue
+		}
+		if s.pos == offset && length <= r.chunkSize {
+			return s.buffer[channel][0:length]
+		}
+		break
+	}
+
+	if channel == 0 && atomic.LoadUint32(&r.playing) != 0 {
+		atomic.AddUint64(&r.underruns, 1)
+	}
+	atomic.StoreInt64(&r.want, int64(offset+r.chunkSize))
+	if length > r.chunkSize {
+		length = r.chunkSize
+	}
+	return r.silence[channel][0:length]
+}
+
+// SampleRate returns sample rate of device.
+func (r *Renderer) SampleRate() mix.Tz {
+	return r.rate
+}
+
+// ChunkSize returns size of rendered chunks.
+func (r *Renderer) ChunkSize() mix.Tz {
+	return r.chunkSize
+}
+
+// NumChannels returns number of rendered channels.
+func (r *Renderer) NumChannels() int {
+	return len(r.silence)
+}
+
+// Length returns mix.Infinite, Renderer never ends.
+func (r *Renderer) Length() mix.Tz {
+	return mix.Infinite
+}
+
+// Clone returns Renderer itself, because it could have only one reader.
+func (r *Renderer) Clone() mix.Source {
+	return r
+}
+
+// Err returns the first error of rendered sources.
+func (r *Renderer) Err() error {
+	err, _ := r.err.Load().(error)
+	return err
+}
+
+// Latency returns maximal number of samples rendered ahead of device.
+func (r *Renderer) Latency() mix.Tz {
+	return mix.Tz(len(r.slots)-1) * r.chunkSize
+}
+
+// Underruns returns number of chunks, that were not rendered in time.
+func (r *Renderer) Underruns() uint64 {
+	return atomic.LoadUint64(&r.underruns)
+}
+
+// End returns channel, that is signalled, when rendered source ends.
+func (r *Renderer) End() <-chan struct{} {
+	return r.end
+}
+
+// Play replaces rendered source with src.
+// See Switch for position, where it happens.
+func (r *Renderer) Play(src mix.Source) {
+	r.Switch(mix.SourceMutatorFunc(func(cur mix.Source, pos mix.Tz) mix.Source {
+		return src
+	}))
+}
+
+// Switch replaces rendered source with result of mutator. Chunks rendered
+// ahead are dropped, so mutator is called with position of the first chunk,
+// that is not played by device yet. That's where new source starts to sound.
+// Switch returns after new source is used.
+//
+// Dropped chunks are rendered again right after Switch, when new source
+// is likely the heaviest to mix, e.g. it starts crossfade. Device has only
+// the chunk, that it plays now, so heavy switches may cause underruns.
+// Use more ahead chunks, if that happens.
+func (r *Renderer) Switch(mutator mix.SourceMutator) {
+	done := make(chan struct{})
+	select {
+	case r.requests <- request{mutator, done}:
+		<-done
+	case <-r.quit:
+	}
+}
+
+func (r *Renderer) run() {
+	chunkTime := time.Duration(r.chunkSize) * time.Second / time.Duration(r.rate)
+	for {
+		select {
+		case req := <-r.requests:
+			r.apply(req)
+			continue
+		case <-r.quit:
+			return
+		default:
+		}
+
+		if !r.render() {
+			// Wait until device plays some chunks.
+			select {
+			case req := <-r.requests:
+				r.apply(req)
+			case <-time.After(chunkTime / 4):
+			case <-r.quit:
+				return
+			}
+		}
+	}
+}
+
+// apply drops chunks, that are not played yet, and mutates source
+// at the first dropped position.
+func (r *Renderer) apply(req request) {
+	var pos mix.Tz
+	for {
+		state := atomic.LoadUint64(&r.state)
+		released, published := split(state)
+		if released == published {
+			r.catchUp()
+			pos = r.next
+			break
+		}
+		// Slot at released index may be played right now, keep it.
+		pos = r.slots[released%uint32(len(r.slots))].pos + r.chunkSize
+		if atomic.CompareAndSwapUint64(&r.state, state, join(released, released+1)) {
+			break
+		}
+	}
+	rtlog.Log("prerender: switch at", int64(pos), int64(r.next-pos))
+	r.next = pos
+	r.src = req.mutator.Mutate(r.src, pos)
+	if r.src != nil {
+		atomic.StoreUint32(&r.playing, 1)
+	}
+	close(req.done)
+}
+
+// catchUp skips to position, that device wants after underrun.
+// It must be called only when the ring is empty.
+func (r *Renderer) catchUp() {
+	if want := mix.Tz(atomic.LoadInt64(&r.want)); want > r.next {
+		r.next = want
+	}
+}
+
+// render renders one chunk, if there is free slot. It returns false, if
+// the ring is full or there is nothing to render.
+func (r *Renderer) render() bool {
+	state := atomic.LoadUint64(&r.state)
+	released, published := split(state)
+	if r.src == nil || int(published-released) >= len(r.slots) {
+		return false
+	}
+	if released == published {
+		r.catchUp()
+	}
+
+	s := &r.slots[published%uint32(len(r.slots))]
+	s.pos = r.next
+	// Bounded source must not be read past its end.
+	n := r.chunkSize
+	if rest := r.src.Length() - r.next; rest < n {
+		n = rest
+	}
+	if n < 0 {
+		n = 0
+	}
+	for c, buf := range s.buffer {
+		if n > 0 {
+			copy(buf, r.src.Samples(c, r.next, n))
+		}
+		buf[n:].Zero()
+	}
+	if err := mix.SourceErr(r.src); err != nil && r.err.Load() == nil {
+		r.err.Store(err)
+	}
+	if end := r.src.Length(); r.next < end && r.next+r.chunkSize >= end {
+		select {
+		case r.end <- struct{}{}:
+		default:
+		}
+	}
+	r.next += r.chunkSize
+
+	// Publish slot. Device may release slots meanwhile, but only this
+	// goroutine changes number of published slots.
+	for {
+		if atomic.CompareAndSwapUint64(&r.state, state, join(released, published+1)) {
+			return true
+		}
+		state = atomic.LoadUint64(&r.state)
+		released, _ = split(state)
+	}
+}
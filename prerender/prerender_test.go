@@ -0,0 +1,172 @@
+package prerender
+
+import (
+	"github.com/kikht/mix"
+
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	rate  = 44100
+	chunk = 256
+	ahead = 4
+)
+
+type device struct{}
+
+func (device) SampleRate() mix.Tz {
+	return rate
+}
+
+func (device) ChunkSize() mix.Tz {
+	return chunk
+}
+
+func rampSource(channels int, n, start mix.Tz) mix.Source {
+	res := mix.MemSource{Rate: rate, Data: make([]mix.Buffer, channels)}
+	for c := range res.Data {
+		res.Data[c] = mix.NewBuffer(n)
+		for i := range res.Data[c] {
+			res.Data[c][i] = float32(start + 100000*mix.Tz(c) + mix.Tz(i))
+		}
+	}
+	return mix.Loop(res)
+}
+
+// waitFull waits until all slots are rendered.
+func waitFull(r *Renderer) {
+	for {
+		released, published := split(atomic.LoadUint64(&r.state))
+		if int(published-released) >= len(r.slots)-1 {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func expectChunk(t *testing.T, r *Renderer, pos, start mix.Tz) {
+	t.Helper()
+	waitFull(r)
+	for c := 0; c < 2; c++ {
+		buf := r.Samples(c, pos, chunk)
+		for i, v := range buf {
+			// Loop period is large enough for tested positions.
+			expect := float32(start + 100000*mix.Tz(c) + mix.Tz(i))
+			if v != expect {
+				t.Fatalf("Invalid sample %d of channel %d at %d: %f, expected %f",
+					i, c, pos, v, expect)
+			}
+		}
+	}
+}
+
+func TestRenderer(t *testing.T) {
+	r := New(device{}, 2, ahead)
+	defer r.Close()
+	if r.Latency() != ahead*chunk || !mix.IsUnbounded(r) {
+		t.Error("Invalid renderer", r.Latency(), r.Length())
+	}
+
+	r.Play(rampSource(2, 1<<16, 0))
+	var pos mix.Tz
+	for ; pos < 10*chunk; pos += chunk {
+		expectChunk(t, r, pos, pos)
+	}
+
+	var switchPos mix.Tz
+	r.Switch(mix.SourceMutatorFunc(func(cur mix.Source, p mix.Tz) mix.Source {
+		switchPos = p
+		return rampSource(2, 1<<16, 50000)
+	}))
+	if switchPos != pos {
+		t.Fatal("Switch at", switchPos, "expected", pos)
+	}
+	for end := pos + 10*chunk; pos < end; pos += chunk {
+		expectChunk(t, r, pos, 50000+pos)
+	}
+	if r.Underruns() != 0 {
+		t.Error("Unexpected underruns", r.Underruns())
+	}
+}
+
+func TestUnderrun(t *testing.T) {
+	r := New(device{}, 2, ahead)
+	defer r.Close()
+	r.Play(rampSource(2, 1<<16, 0))
+	expectChunk(t, r, 0, 0)
+
+	// Device skipped far ahead of rendered chunks.
+	pos := mix.Tz(100 * chunk)
+	for c := 0; c < 2; c++ {
+		for i, v := range r.Samples(c, pos, chunk) {
+			if v != 0 {
+				t.Fatalf("Sample %d of channel %d is not silent: %f", i, c, v)
+			}
+		}
+	}
+	if r.Underruns() != 1 {
+		t.Error("Invalid number of underruns", r.Underruns())
+	}
+	for pos += chunk; pos < 110*chunk; pos += chunk {
+		expectChunk(t, r, pos, pos)
+	}
+}
+
+type endSource struct {
+	mix.Source
+}
+
+func (endSource) Length() mix.Tz {
+	return 3 * chunk
+}
+
+func TestEnd(t *testing.T) {
+	r := New(device{}, 2, ahead)
+	defer r.Close()
+	r.Play(endSource{rampSource(2, 1<<16, 0)})
+	<-r.End()
+	for pos := mix.Tz(0); pos < 3*chunk; pos += chunk {
+		expectChunk(t, r, pos, pos)
+	}
+	for c := 0; c < 2; c++ {
+		for i, v := range r.Samples(c, 3*chunk, chunk) {
+			if v != 0 {
+				t.Fatalf("Sample %d of channel %d after end: %f", i, c, v)
+			}
+		}
+	}
+	if r.Underruns() != 0 {
+		t.Error("Unexpected underruns", r.Underruns())
+	}
+}
+
+func TestPartialChunk(t *testing.T) {
+	r := New(device{}, 2, ahead)
+	defer r.Close()
+	// Length is not a multiple of chunk, last chunk is padded with silence.
+	src := mix.MemSource{Rate: rate, Data: []mix.Buffer{
+		mix.NewBuffer(1000), mix.NewBuffer(1000)}}
+	for c := range src.Data {
+		for i := range src.Data[c] {
+			src.Data[c][i] = 1
+		}
+	}
+	r.Play(src)
+	<-r.End()
+	waitFull(r)
+	for pos := mix.Tz(0); pos < 5*chunk; pos += chunk {
+		for c := 0; c < 2; c++ {
+			for i, v := range r.Samples(c, pos, chunk) {
+				if expect := pos+mix.Tz(i) < 1000; (v == 1) != expect {
+					t.Fatalf("Invalid sample %d of channel %d at %d: %f",
+						i, c, pos, v)
+				}
+			}
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,249 @@
+package project
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/session"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Error describes problem in project file and its location.
+type Error struct {
+	File         string // Name of project file.
+	Line, Column int    // Position in file, zero if unknown.
+	Path         string // Path to invalid value, like "sources.drums.session.regions[2]".
+	Err          error
+}
+
+func (e *Error) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, ":%d:%d", e.Line, e.Column)
+	}
+	if e.Path != "" {
+		buf.WriteString(": ")
+		buf.WriteString(e.Path)
+	}
+	buf.WriteString(": ")
+	buf.WriteString(e.Err.Error())
+	return buf.String()
+}
+
+// LoadMix reads project file and builds mix.Session from it.
+// Audio files are opened with load.
+func LoadMix(path string, load Loader) (*mix.Session, error) {
+	l, err := newLoader(path, load)
+	if err != nil {
+		return nil, err
+	}
+	l.newSession = func(ref *SessionRef) adder {
+		return mixAdder{mix.NewSession(l.file.SampleRate)}
+	}
+	s, err := l.build()
+	if err != nil {
+		return nil, err
+	}
+	return s.(mixAdder).Session, nil
+}
+
+// LoadSession reads project file and builds session.Session from it.
+// Audio files are opened with load.
+func LoadSession(path string, load Loader) (*session.Session, error) {
+	l, err := newLoader(path, load)
+	if err != nil {
+		return nil, err
+	}
+	l.newSession = func(ref *SessionRef) adder {
+		return sessionAdder{session.NewSession(l.file.SampleRate, ref.ForgetPast)}
+	}
+	s, err := l.build()
+	if err != nil {
+		return nil, err
+	}
+	return s.(sessionAdder).Session, nil
+}
+
+// adder hides difference between Session types.
+type adder interface {
+	add(r RegionRef, src mix.Source) error
+	session() mix.Source
+}
+
+type mixAdder struct{ *mix.Session }
+
+func (a mixAdder) add(r RegionRef, src mix.Source) error {
+	return a.AddRegion(mix.Region{
+		Source: src, Begin: r.Begin, Offset: r.Offset, Length: r.Length,
+		Volume: r.Volume, Pan: r.Pan, FadeIn: r.FadeIn, FadeOut: r.FadeOut,
+	})
+}
+
+func (a mixAdder) session() mix.Source { return a.Session }
+
+type sessionAdder struct{ *session.Session }
+
+func (a sessionAdder) session() mix.Source { return a.Session }
+
+func (a sessionAdder) add(r RegionRef, src mix.Source) error {
+	return a.AddRegion(session.Region{
+		Source: src, Begin: r.Begin, Offset: r.Offset, Length: r.Length,
+		Volume: r.Volume, Pan: r.Pan, FadeIn: r.FadeIn, FadeOut: r.FadeOut,
+	})
+}
+
+type loader struct {
+	path       string
+	data       []byte
+	file       File
+	load       Loader
+	newSession func(ref *SessionRef) adder
+
+	sources  map[string]mix.Source
+	visiting map[string]bool
+}
+
+func newLoader(path string, load Loader) (*loader, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &loader{
+		path:     path,
+		data:     data,
+		load:     load,
+		sources:  make(map[string]mix.Source),
+		visiting: make(map[string]bool),
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&l.file); err != nil {
+		return nil, l.decodeError(err)
+	}
+
+	switch {
+	case l.file.Version == 0:
+		return nil, l.errorf("version", "Project version is missing")
+	case l.file.Version > Version:
+		return nil, l.errorf("version", "Unsupported project version %d, "+
+			"latest supported is %d", l.file.Version, Version)
+	case l.file.Version < 0:
+		return nil, l.errorf("version", "Invalid project version %d",
+			l.file.Version)
+	}
+	if l.file.SampleRate <= 0 {
+		return nil, l.errorf("sampleRate", "Invalid sample rate %d",
+			l.file.SampleRate)
+	}
+	return l, nil
+}
+
+func (l *loader) build() (adder, error) {
+	// Open all sources, so errors in unused ones are reported too.
+	for _, name := range l.file.SourceNames() {
+		if _, err := l.source(name, "sources."+name); err != nil {
+			return nil, err
+		}
+	}
+	return l.session(&l.file.SessionRef, "regions")
+}
+
+func (l *loader) session(ref *SessionRef, path string) (adder, error) {
+	s := l.newSession(ref)
+	for i, r := range ref.Regions {
+		rPath := fmt.Sprintf("%s[%d]", path, i)
+		src, err := l.source(r.Source, rPath+".source")
+		if err != nil {
+			return nil, err
+		}
+		if err := s.add(r, src); err != nil {
+			return nil, l.errorf(rPath, "%s", err)
+		}
+	}
+	return s, nil
+}
+
+func (l *loader) source(name, path string) (mix.Source, error) {
+	if src, ok := l.sources[name]; ok {
+		return src, nil
+	}
+	ref, ok := l.file.Sources[name]
+	if !ok || ref == nil {
+		return nil, l.errorf(path, "Unknown source %q", name)
+	}
+	if l.visiting[name] {
+		return nil, l.errorf(path, "Source %q references itself", name)
+	}
+	l.visiting[name] = true
+	defer delete(l.visiting, name)
+
+	refPath := "sources." + name
+	var (
+		src mix.Source
+		err error
+	)
+	switch {
+	case ref.Session != nil && ref.Path != "":
+		return nil, l.errorf(refPath, "Source must have either path or session")
+	case ref.Session != nil:
+		s, err := l.session(ref.Session, refPath+".session.regions")
+		if err != nil {
+			return nil, err
+		}
+		src = s.session()
+	case ref.Path != "":
+		src, err = Open(*ref, filepath.Dir(l.path), l.load)
+		if err != nil {
+			return nil, l.errorf(refPath+".path", "%s", err)
+		}
+		if src.SampleRate() != l.file.SampleRate {
+			return nil, l.errorf(refPath, "Sample rate %d is different from "+
+				"project sample rate %d", src.SampleRate(), l.file.SampleRate)
+		}
+	default:
+		return nil, l.errorf(refPath, "Source must have either path or session")
+	}
+	l.sources[name] = src
+	return src, nil
+}
+
+func (l *loader) errorf(path, format string, args ...interface{}) error {
+	return &Error{File: l.path, Path: path, Err: fmt.Errorf(format, args...)}
+}
+
+func (l *loader) decodeError(err error) error {
+	res := &Error{File: l.path, Err: err}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		res.Line, res.Column = l.position(e.Offset - 1)
+	case *json.UnmarshalTypeError:
+		res.Line, res.Column = l.position(e.Offset - 1)
+		res.Path = e.Field
+		res.Err = fmt.Errorf("Can not use %s value as %s", e.Value, e.Type)
+	default:
+		if err == io.EOF {
+			res.Err = errors.New("Project file is empty")
+		}
+	}
+	return res
+}
+
+// position converts byte offset to 1-based line and column.
+func (l *loader) position(offset int64) (line, col int) {
+	if offset > int64(len(l.data)) {
+		offset = int64(len(l.data))
+	} else if offset < 0 {
+		offset = 0
+	}
+	before := l.data[:offset]
+	line = bytes.Count(before, []byte{'\n'}) + 1
+	col = int(offset) - bytes.LastIndexByte(before, '\n')
+	return
+}
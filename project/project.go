@@ -0,0 +1,269 @@
+// Package project implements versioned JSON project files, that describe
+// mix.Session and session.Session.
+//
+// Example of project file:
+//
+//	{
+//	  "version": 1,
+//	  "sampleRate": 44100,
+//	  "sources": {
+//	    "kick": {"path": "audio/kick.ogg", "loader": "sox"},
+//	    "drums": {"session": {"regions": [
+//	      {"source": "kick", "begin": 0, "volume": 1}
+//	    ]}}
+//	  },
+//	  "regions": [
+//	    {"source": "drums", "begin": 0, "volume": 1, "fadeIn": 44100}
+//	  ]
+//	}
+//
+// Region volume defaults to 1 when omitted. Length 0 plays Source till its end.
+package project
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/session"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version of project file format written by Save functions.
+const Version = 1
+
+// File is the top-level structure of project file.
+type File struct {
+	Version    int                   `json:"version"`
+	SampleRate mix.Tz                `json:"sampleRate"`
+	Sources    map[string]*SourceRef `json:"sources"`
+	SessionRef
+}
+
+// SessionRef describes Session: either top-level or nested one.
+type SessionRef struct {
+	ForgetPast bool        `json:"forgetPast,omitempty"` // Only for session.Session.
+	Regions    []RegionRef `json:"regions"`
+}
+
+// SourceRef describes Source of audio. It is either a file with path
+// relative to project file or a nested session.
+type SourceRef struct {
+	Path    string            `json:"path,omitempty"`
+	Loader  string            `json:"loader,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+	Session *SessionRef       `json:"session,omitempty"`
+}
+
+// RegionRef describes Region, that references Source by name.
+type RegionRef struct {
+	Source  string  `json:"source"`
+	Begin   mix.Tz  `json:"begin"`
+	Offset  mix.Tz  `json:"offset,omitempty"`
+	Length  mix.Tz  `json:"length,omitempty"`
+	Volume  float32 `json:"volume"`
+	Pan     float32 `json:"pan,omitempty"`
+	FadeIn  mix.Tz  `json:"fadeIn,omitempty"`
+	FadeOut mix.Tz  `json:"fadeOut,omitempty"`
+}
+
+// UnmarshalJSON decodes RegionRef with default volume of 1.
+func (r *RegionRef) UnmarshalJSON(data []byte) error {
+	type plain RegionRef
+	res := plain{Volume: 1}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	*r = RegionRef(res)
+	return nil
+}
+
+// Loader opens audio file described by ref. Path in ref is already resolved
+// relative to project file.
+type Loader func(ref SourceRef) (mix.Source, error)
+
+// FileSource is a Source opened from file. It remembers its reference,
+// so Session that uses it could be saved.
+type FileSource struct {
+	mix.Source
+	Ref SourceRef
+}
+
+// Open loads file referenced by ref with load and wraps it into FileSource.
+// Relative path is resolved against dir.
+func Open(ref SourceRef, dir string, load Loader) (*FileSource, error) {
+	if ref.Path == "" {
+		return nil, errors.New("Source path is empty")
+	}
+	resolved := ref
+	if !filepath.IsAbs(ref.Path) {
+		resolved.Path = filepath.Join(dir, ref.Path)
+	}
+	src, err := load(resolved)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSource{src, ref}, nil
+}
+
+// Clone returns FileSource with cloned underlying Source.
+func (f *FileSource) Clone() mix.Source {
+	return f.DeepClone(mix.Source.Clone)
+}
+
+// DeepClone returns FileSource with underlying Source cloned by clone,
+// see mix.DeepCloner.
+func (f *FileSource) DeepClone(clone func(mix.Source) mix.Source) mix.Source {
+	return &FileSource{clone(f.Source), f.Ref}
+}
+
+// Concurrent reports whether underlying Source is concurrent.
+func (f *FileSource) Concurrent() bool {
+	return mix.IsConcurrent(f.Source)
+}
+
+// Preallocate preallocates underlying Source, see mix.Preallocator.
+func (f *FileSource) Preallocate(chunkSize mix.Tz) {
+	mix.Preallocate(f.Source, chunkSize)
+}
+
+// Err returns error of underlying Source, see mix.ErrorSource.
+func (f *FileSource) Err() error {
+	return mix.SourceErr(f.Source)
+}
+
+// SaveMix writes project file, that describes s.
+// All sources in s must be either FileSource or nested mix.Session.
+func SaveMix(w io.Writer, s *mix.Session) error {
+	return save(w, s)
+}
+
+// SaveSession writes project file, that describes s.
+// All sources in s must be either FileSource or nested session.Session.
+func SaveSession(w io.Writer, s *session.Session) error {
+	return save(w, s)
+}
+
+func save(w io.Writer, s mix.Source) error {
+	sv := saver{
+		file: File{
+			Version:    Version,
+			SampleRate: s.SampleRate(),
+			Sources:    make(map[string]*SourceRef),
+		},
+		names: make(map[mix.Source]string),
+	}
+	ref, err := sv.session(s, "regions")
+	if err != nil {
+		return err
+	}
+	sv.file.SessionRef = *ref
+
+	data, err := json.MarshalIndent(sv.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+type saver struct {
+	file  File
+	names map[mix.Source]string
+}
+
+func (sv *saver) session(s mix.Source, path string) (*SessionRef, error) {
+	var (
+		res     SessionRef
+		regions []RegionRef
+		sources []mix.Source
+	)
+	switch s := s.(type) {
+	case *mix.Session:
+		for _, r := range s.Regions() {
+			regions = append(regions, RegionRef{
+				Begin: r.Begin, Offset: r.Offset, Length: r.Length,
+				Volume: r.Volume, Pan: r.Pan,
+				FadeIn: r.FadeIn, FadeOut: r.FadeOut,
+			})
+			sources = append(sources, r.Source)
+		}
+	case *session.Session:
+		res.ForgetPast = s.ForgetPast()
+		for _, r := range s.Regions() {
+			regions = append(regions, RegionRef{
+				Begin: r.Begin, Offset: r.Offset, Length: r.Length,
+				Volume: r.Volume, Pan: r.Pan,
+				FadeIn: r.FadeIn, FadeOut: r.FadeOut,
+			})
+			sources = append(sources, r.Source)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported session type %T", path, s)
+	}
+
+	for i := range regions {
+		name, err := sv.source(sources[i], fmt.Sprintf("%s[%d].source", path, i))
+		if err != nil {
+			return nil, err
+		}
+		regions[i].Source = name
+	}
+	res.Regions = regions
+	if res.Regions == nil {
+		res.Regions = []RegionRef{}
+	}
+	return &res, nil
+}
+
+func (sv *saver) source(src mix.Source, path string) (string, error) {
+	var base string
+	switch s := src.(type) {
+	case *FileSource:
+		base = s.Ref.Path
+		base = strings.TrimSuffix(filepath.Base(base), filepath.Ext(base))
+	case *mix.Session, *session.Session:
+		base = "session"
+	default:
+		return "", fmt.Errorf("%s: source %T has no file reference", path, src)
+	}
+
+	if name, ok := sv.names[src]; ok {
+		return name, nil
+	}
+	name := base
+	for i := 2; sv.file.Sources[name] != nil; i++ {
+		name = base + "_" + strconv.Itoa(i)
+	}
+	sv.names[src] = name
+
+	if f, ok := src.(*FileSource); ok {
+		ref := f.Ref
+		sv.file.Sources[name] = &ref
+		return name, nil
+	}
+	// Reserve name before descending to handle repeated nested sessions.
+	ref := &SourceRef{}
+	sv.file.Sources[name] = ref
+	nested, err := sv.session(src, "sources."+name+".session.regions")
+	if err != nil {
+		return "", err
+	}
+	ref.Session = nested
+	return name, nil
+}
+
+// SourceNames returns sorted names of sources in project file.
+func (f *File) SourceNames() []string {
+	res := make([]string, 0, len(f.Sources))
+	for name := range f.Sources {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
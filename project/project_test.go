@@ -0,0 +1,173 @@
+package project
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/session"
+
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	rate   = 44100
+	length = 100
+)
+
+func testLoader(ref SourceRef) (mix.Source, error) {
+	channels := 1
+	if ref.Options["channels"] == "2" {
+		channels = 2
+	}
+	res := mix.MemSource{
+		Rate: rate,
+		Data: make([]mix.Buffer, channels),
+	}
+	for i := range res.Data {
+		res.Data[i] = mix.NewBuffer(length)
+	}
+	return res, nil
+}
+
+func writeTemp(t *testing.T, data []byte) string {
+	dir, err := ioutil.TempDir("", "project")
+	if err != nil {
+		t.Fatal("Can't create temp dir:", err)
+	}
+	path := filepath.Join(dir, "project.json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal("Can't write project:", err)
+	}
+	return path
+}
+
+func TestSaveLoadMix(t *testing.T) {
+	kick, _ := Open(SourceRef{Path: "audio/kick.ogg"}, "", testLoader)
+	pad, _ := Open(SourceRef{Path: "audio/pad.ogg",
+		Options: map[string]string{"channels": "2"}}, "", testLoader)
+
+	drums := mix.NewSession(rate)
+	drums.AddRegion(mix.Region{Source: kick, Begin: 0, Volume: 1})
+	drums.AddRegion(mix.Region{Source: kick, Begin: length / 2, Volume: 0.5, Pan: -0.3})
+
+	sess := mix.NewSession(rate)
+	sess.AddRegion(mix.Region{Source: drums, Begin: 0, Volume: 1, FadeIn: length / 4})
+	sess.AddRegion(mix.Region{Source: drums, Begin: 2 * length, Volume: 1})
+	sess.AddRegion(mix.Region{Source: pad, Begin: 10, Offset: 5, Length: 50,
+		Volume: 0.7, FadeIn: 10, FadeOut: 20})
+
+	var saved bytes.Buffer
+	if err := SaveMix(&saved, sess); err != nil {
+		t.Fatal("Error while saving:", err)
+	}
+	path := writeTemp(t, saved.Bytes())
+	defer os.RemoveAll(filepath.Dir(path))
+
+	loaded, err := LoadMix(path, testLoader)
+	if err != nil {
+		t.Fatal("Error while loading:", err)
+	}
+	if loaded.Length() != sess.Length() {
+		t.Errorf("Invalid length. Expected %v, got %v",
+			sess.Length(), loaded.Length())
+	}
+	regions := loaded.Regions()
+	if len(regions) != 3 {
+		t.Fatal("Invalid number of regions", len(regions))
+	}
+	if regions[0].Source != regions[2].Source {
+		t.Error("Nested session is not shared between regions")
+	}
+	if regions[0].FadeIn != length/4 || regions[1].Offset != 5 ||
+		regions[1].Length != 50 || regions[1].FadeOut != 20 {
+		t.Error("Invalid regions", regions)
+	}
+
+	var resaved bytes.Buffer
+	if err := SaveMix(&resaved, loaded); err != nil {
+		t.Fatal("Error while saving:", err)
+	}
+	if saved.String() != resaved.String() {
+		t.Errorf("Project changed after load. Expected:\n%s\ngot:\n%s",
+			saved.String(), resaved.String())
+	}
+}
+
+func TestSaveLoadSession(t *testing.T) {
+	kick, _ := Open(SourceRef{Path: "kick.ogg"}, "", testLoader)
+	sess := session.NewSession(rate, true)
+	sess.AddRegion(session.Region{Source: kick, Begin: 10, Volume: 1})
+
+	var saved bytes.Buffer
+	if err := SaveSession(&saved, sess); err != nil {
+		t.Fatal("Error while saving:", err)
+	}
+	path := writeTemp(t, saved.Bytes())
+	defer os.RemoveAll(filepath.Dir(path))
+
+	loaded, err := LoadSession(path, testLoader)
+	if err != nil {
+		t.Fatal("Error while loading:", err)
+	}
+	if !loaded.ForgetPast() {
+		t.Error("ForgetPast flag is lost")
+	}
+	if regions := loaded.Regions(); len(regions) != 1 || regions[0].Begin != 10 {
+		t.Error("Invalid regions", regions)
+	}
+}
+
+func TestSaveUnsupportedSource(t *testing.T) {
+	sess := mix.NewSession(rate)
+	src, _ := testLoader(SourceRef{})
+	sess.AddRegion(mix.Region{Source: src, Volume: 1})
+	var buf bytes.Buffer
+	err := SaveMix(&buf, sess)
+	if err == nil || !strings.Contains(err.Error(), "regions[0].source") {
+		t.Error("Expected error with location, got", err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		data, err string
+	}{
+		{``, "Project file is empty"},
+		{"{\n  \"version\": 1,\n  \"sampleRate\": 44100,,\n}", ":3:23: invalid character"},
+		{`{"version": 2, "sampleRate": 44100}`, "version: Unsupported project version 2"},
+		{`{"sampleRate": 44100}`, "version: Project version is missing"},
+		{`{"version": 1}`, "sampleRate: Invalid sample rate 0"},
+		{`{"version": 1, "sampleRate": "fast"}`, ":1:35: sampleRate: Can not use string value"},
+		{`{"version": 1, "sampleRate": 44100, "tempo": 1}`, `unknown field "tempo"`},
+		{`{"version": 1, "sampleRate": 44100, "regions": [{"source": "x"}]}`,
+			`regions[0].source: Unknown source "x"`},
+		{`{"version": 1, "sampleRate": 44100, "sources": {"a": {}}}`,
+			"sources.a: Source must have either path or session"},
+		{`{"version": 1, "sampleRate": 44100, "sources": {"a": {"path": "a.ogg"}},
+		  "regions": [{"source": "a"}, {"source": "a", "fadeIn": -1}]}`,
+			"regions[1]: Invalid fadeIn"},
+		{`{"version": 1, "sampleRate": 44100, "sources": {
+		    "a": {"session": {"regions": [{"source": "b"}]}},
+		    "b": {"session": {"regions": [{"source": "a"}]}}}}`,
+			`sources.b.session.regions[0].source: Source "a" references itself`},
+	}
+
+	for _, test := range tests {
+		path := writeTemp(t, []byte(test.data))
+		_, err := LoadMix(path, testLoader)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil {
+			t.Errorf("Expected error %q for %s", test.err, test.data)
+			continue
+		}
+		if _, ok := err.(*Error); !ok {
+			t.Errorf("Unexpected error type %T", err)
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error %q, got %q", test.err, err.Error())
+		}
+	}
+}
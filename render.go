@@ -0,0 +1,200 @@
+package mix
+
+import (
+	"errors"
+	"sync"
+)
+
+// Number of samples rendered by one worker at once.
+const renderSegment = 1 << 18
+
+// ErrCanceled is returned by RenderParallelCancel, when cancel is closed.
+var ErrCanceled = errors.New("Rendering is canceled")
+
+// RenderParallel mixes length samples of s starting from its current position
+// and writes them to enc. Mixing is done by numWorkers goroutines, each with
+// its own clone of s and nested Sessions. Output is bit-identical to calling
+// s.Play(chunkSize) in a loop. Position of s is advanced by length.
+//
+// Sources other than Session are cloned with Clone(), so they must be safe
+// for concurrent reading after that. Sessions nested in DeepCloners, e.g.
+// in adapters, are cloned too.
+func RenderParallel(s *Session, enc Encoder, length, chunkSize Tz,
+	numWorkers int) error {
+
+	return RenderParallelCancel(s, enc, length, chunkSize, numWorkers, nil)
+}
+
+// RenderParallelCancel is RenderParallel, that is stopped, when cancel is
+// closed. Workers check cancel before every chunk. Then ErrCanceled is
+// returned, enc may have got part of samples and position of s is not changed.
+func RenderParallelCancel(s *Session, enc Encoder, length, chunkSize Tz,
+	numWorkers int, cancel <-chan struct{}) error {
+
+	if length < 0 {
+		return errors.New("Can't render length < 0")
+	}
+	if chunkSize <= 0 {
+		return errors.New("Chunk size must be positive")
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	// Segment boundaries must match chunk boundaries of serial Play loop,
+	// because fades are computed per mixed chunk.
+	segment := (renderSegment + chunkSize - 1) / chunkSize * chunkSize
+	start := s.pos
+	numSegments := int((length + segment - 1) / segment)
+
+	type job struct {
+		pos, length Tz
+		buffer      []Buffer
+		err         error
+		done        chan struct{}
+	}
+	var (
+		jobs    = make([]*job, numSegments)
+		queue   = make(chan *job)
+		window  = make(chan struct{}, 2*numWorkers) // limits memory usage
+		quit    = make(chan struct{})
+		workers sync.WaitGroup
+	)
+	for i := range jobs {
+		pos := Tz(i) * segment
+		jobs[i] = &job{
+			pos:    start + pos,
+			length: segment,
+			done:   make(chan struct{}),
+		}
+		if pos+segment > length {
+			jobs[i].length = length - pos
+		}
+	}
+
+	go func() {
+		defer close(queue)
+		for _, j := range jobs {
+			select {
+			case window <- struct{}{}:
+			case <-quit:
+				return
+			}
+			select {
+			case queue <- j:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < numWorkers; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			clone := deepClone(s, make(map[*Session]*Session))
+			for j := range queue {
+				clone.SetPosition(j.pos)
+				j.buffer = make([]Buffer, numChannels)
+				for c := range j.buffer {
+					j.buffer[c] = NewBuffer(j.length)
+				}
+				for off := Tz(0); off < j.length && j.err == nil; off += chunkSize {
+					select {
+					case <-cancel:
+						j.err = ErrCanceled
+						continue
+					default:
+					}
+					end := off + chunkSize
+					if end > j.length {
+						end = j.length
+					}
+					clone.mix([]Buffer{
+						j.buffer[0][off:end],
+						j.buffer[1][off:end],
+					})
+				}
+				if j.err == nil {
+					j.err = clone.Err()
+				}
+				close(j.done)
+			}
+		}()
+	}
+
+	var err error
+	for _, j := range jobs {
+		<-j.done
+		if j.err == ErrCanceled {
+			err = j.err
+			break
+		}
+		if j.err != nil {
+			err = errors.New("error while mixing audio: " + j.err.Error())
+			break
+		}
+		err = enc.Encode(j.buffer)
+		j.buffer = nil
+		if err != nil {
+			err = errors.New("error while writing audio buffer: " + err.Error())
+			break
+		}
+		<-window
+	}
+	close(quit)
+	workers.Wait()
+
+	if err == nil {
+		s.SetPosition(start + length)
+	}
+	return err
+}
+
+// deepClone clones Session together with all nested Sessions, also ones
+// wrapped by DeepCloners, so that the clone could be mixed concurrently with
+// original. Nested Session used by several regions stays shared within clone.
+func deepClone(s *Session, cloned map[*Session]*Session) *Session {
+	if res, ok := cloned[s]; ok {
+		return res
+	}
+	res := s.Clone().(*Session)
+	res.buffer = nil
+	cloned[s] = res
+
+	prepared := make(map[*preparedRegion]*preparedRegion)
+	cloneRegion := func(r *preparedRegion) *preparedRegion {
+		if c, ok := prepared[r]; ok {
+			return c
+		}
+		c := *r
+		c.Src = deepCloneSource(r.Src, cloned)
+		prepared[r] = &c
+		return &c
+	}
+	for i, r := range res.regions {
+		res.regions[i] = cloneRegion(r)
+	}
+	for i, r := range res.active {
+		res.active[i] = cloneRegion(r)
+	}
+	res.nested = nil
+	for _, r := range res.regions {
+		res.addNested(r.Src)
+	}
+	return res
+}
+
+// deepCloneSource clones src with deepClone, if it is Session, or clones its
+// nested Sources so, if it is DeepCloner.
+func deepCloneSource(src Source, cloned map[*Session]*Session) Source {
+	switch src := src.(type) {
+	case *Session:
+		return deepClone(src, cloned)
+	case DeepCloner:
+		return src.DeepClone(func(nested Source) Source {
+			return deepCloneSource(nested, cloned)
+		})
+	}
+	return src.Clone()
+}
@@ -0,0 +1,102 @@
+package mix
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func getRenderSession() *Session {
+	src := MemSource{Rate: rate, Data: make([]Buffer, 2)}
+	for c := range src.Data {
+		src.Data[c] = NewBuffer(10000)
+		for i := range src.Data[c] {
+			src.Data[c][i] = float32((i*(c+3))%101)/100 - 0.5
+		}
+	}
+
+	inner := NewSession(rate)
+	inner.AddRegion(Region{Source: getTestSource(1), Begin: 3000, Volume: 0.3, Pan: 0.4})
+	nested := NewSession(rate)
+	nested.AddRegion(Region{Source: src, Begin: 0, Volume: 0.7, FadeOut: 5000})
+	nested.AddRegion(Region{Source: inner, Volume: 1})
+
+	// Every other region wraps nested Session, which is cloned deeply
+	// with inner one.
+	s := NewSession(rate)
+	for b, i := Tz(0), 0; b < 1000000; b, i = b+7777, i+1 {
+		var sub Source = nested
+		if i%2 == 1 {
+			sub = Gain(nested, 0.8)
+		}
+		s.AddRegion(Region{Source: sub, Begin: b, Volume: 0.9, FadeIn: 1000, Pan: -0.2})
+		s.AddRegion(Region{Source: src, Begin: b + 1234, Offset: 100, Length: 5000,
+			Volume: 0.5, FadeIn: 333, FadeOut: 777, Pan: 0.3})
+	}
+	return s
+}
+
+func TestRenderParallel(t *testing.T) {
+	const chunk = 1000
+
+	var serial bytes.Buffer
+	s := getRenderSession()
+	s.SetEncoder(NewRawEncoder(&serial, Float32))
+	for pos := Tz(0); pos < s.Length(); pos += chunk {
+		length := Tz(chunk)
+		if pos+length > s.Length() {
+			length = s.Length() - pos
+		}
+		if err := s.Play(length); err != nil {
+			t.Fatal("Error while playing:", err)
+		}
+	}
+
+	for _, workers := range []int{1, 3, 8} {
+		var parallel bytes.Buffer
+		s := getRenderSession()
+		err := RenderParallel(s, NewRawEncoder(&parallel, Float32),
+			s.Length(), chunk, workers)
+		if err != nil {
+			t.Fatal("Error while rendering:", err)
+		}
+		if s.Position() != s.Length() {
+			t.Error("Invalid position after render", s.Position())
+		}
+		if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+			t.Errorf("Output of %d workers is different from serial", workers)
+		}
+	}
+}
+
+func TestRenderParallelCancel(t *testing.T) {
+	var out bytes.Buffer
+	s := getRenderSession()
+	cancel := make(chan struct{})
+	close(cancel)
+	err := RenderParallelCancel(s, NewRawEncoder(&out, Float32),
+		s.Length(), 1000, 3, cancel)
+	if err != ErrCanceled {
+		t.Fatal("Canceled render returned", err)
+	}
+	if s.Position() != 0 || out.Len() != 0 {
+		t.Error("Canceled render is not stopped", s.Position(), out.Len())
+	}
+}
+
+func BenchmarkRenderSerial(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		s := getRenderSession()
+		s.SetEncoder(NewRawEncoder(ioutil.Discard, Float32))
+		for pos := Tz(0); pos < s.Length(); pos += 4096 {
+			s.Play(4096)
+		}
+	}
+}
+
+func BenchmarkRenderParallel(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		s := getRenderSession()
+		RenderParallel(s, NewRawEncoder(ioutil.Discard, Float32), s.Length(), 4096, 4)
+	}
+}
@@ -0,0 +1,125 @@
+// Package rtlog implements logging, that is safe for real-time threads.
+//
+// Messages are written to lock-free ring buffer without memory allocation
+// and printed with standard log package by background goroutine.
+// Messages are dropped, when ring is full.
+package rtlog
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxArgs is maximal number of arguments of one message.
+const MaxArgs = 4
+
+// DrainPeriod is how often background goroutine prints messages.
+const DrainPeriod = 50 * time.Millisecond
+
+type record struct {
+	seq  uint64 // sequence number of ring position, that slot is ready for
+	msg  string
+	args [MaxArgs]int64
+	n    int
+}
+
+// Ring is bounded multi-producer single-consumer queue of log messages.
+type Ring struct {
+	slots   []record
+	mask    uint64
+	head    uint64 // next position to write, accessed atomically
+	tail    uint64 // next position to read, owned by drain goroutine
+	dropped uint64 // accessed atomically
+	started uint32 // accessed atomically
+	once    sync.Once
+	args    []interface{} // of printed message, owned by drain goroutine
+}
+
+// NewRing creates Ring with capacity rounded up to power of two.
+func NewRing(capacity int) *Ring {
+	size := 1
+	for size < capacity {
+		size <<= 1
+	}
+	r := &Ring{
+		slots: make([]record, size),
+		mask:  uint64(size - 1),
+	}
+	for i := range r.slots {
+		r.slots[i].seq = uint64(i)
+	}
+	return r
+}
+
+// Default is Ring used by package level Log.
+var Default = NewRing(1024)
+
+// Log writes message to Default ring.
+func Log(msg string, args ...int64) {
+	Default.Log(msg, args...)
+}
+
+// Log writes message with up to MaxArgs integer arguments to ring.
+// msg should be constant, because it is kept until message is printed.
+// On the first call Log starts goroutine, that prints messages.
+// Log never blocks and does not allocate memory after the first call.
+func (r *Ring) Log(msg string, args ...int64) {
+	if atomic.LoadUint32(&r.started) == 0 {
+		r.once.Do(r.start)
+	}
+	for {
+		pos := atomic.LoadUint64(&r.head)
+		slot := &r.slots[pos&r.mask]
+		seq := atomic.LoadUint64(&slot.seq)
+		switch {
+		case seq == pos:
+			if !atomic.CompareAndSwapUint64(&r.head, pos, pos+1) {
+				continue
+			}
+			slot.msg = msg
+			slot.n = copy(slot.args[:], args)
+			atomic.StoreUint64(&slot.seq, pos+1)
+			return
+		case seq < pos:
+			// Ring is full.
+			atomic.AddUint64(&r.dropped, 1)
+			return
+		}
+		// Other producer took this position, try the next one.
+	}
+}
+
+func (r *Ring) start() {
+	atomic.StoreUint32(&r.started, 1)
+	go func() {
+		for range time.Tick(DrainPeriod) {
+			r.Drain()
+		}
+	}()
+}
+
+// Drain prints all messages, that are ready. It is called periodically
+// by background goroutine and must not be called concurrently.
+func (r *Ring) Drain() {
+	if n := atomic.SwapUint64(&r.dropped, 0); n > 0 {
+		log.Println("rtlog: dropped", n, "messages")
+	}
+	if r.args == nil {
+		r.args = make([]interface{}, 0, MaxArgs+1)
+	}
+	for {
+		slot := &r.slots[r.tail&r.mask]
+		if atomic.LoadUint64(&slot.seq) != r.tail+1 {
+			return
+		}
+		args := append(r.args[0:0], slot.msg)
+		for _, a := range slot.args[0:slot.n] {
+			args = append(args, a)
+		}
+		atomic.StoreUint64(&slot.seq, r.tail+r.mask+1)
+		r.tail++
+		log.Println(args...)
+	}
+}
@@ -0,0 +1,81 @@
+package rtlog
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	r := NewRing(4)
+	r.started = 1 // drain manually
+	for i := 0; i < 6; i++ {
+		r.Log("message", int64(i), 42)
+	}
+	r.Drain()
+	res := out.String()
+	for _, expect := range []string{"message 0 42", "message 3 42", "dropped 2"} {
+		if !strings.Contains(res, expect) {
+			t.Errorf("Output %q does not contain %q", res, expect)
+		}
+	}
+	if strings.Contains(res, "message 4") {
+		t.Error("Message is not dropped from full ring")
+	}
+}
+
+func TestRingConcurrent(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	r := NewRing(64)
+	r.started = 1
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				r.Log("msg")
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		r.Drain()
+	}
+	wg.Wait()
+	r.Drain()
+	printed, dropped := 0, 0
+	for _, line := range strings.Split(out.String(), "\n") {
+		var n int
+		if strings.HasSuffix(line, "msg") {
+			printed++
+		} else if i := strings.Index(line, "rtlog:"); i >= 0 {
+			fmt.Sscanf(line[i:], "rtlog: dropped %d messages", &n)
+			dropped += n
+		}
+	}
+	if printed+dropped != 4000 {
+		t.Error("Messages are lost:", printed, dropped)
+	}
+}
+
+func TestLogAllocs(t *testing.T) {
+	r := NewRing(1 << 10)
+	r.started = 1
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Log("message", 1, 2, 3)
+	})
+	if allocs != 0 {
+		t.Error("Log allocates memory:", allocs)
+	}
+}
@@ -0,0 +1,358 @@
+package rtp
+
+import (
+	"github.com/kikht/mix"
+
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const receiverHistory = 1 << 16 // frames kept by Receiver, must be power of 2
+
+// ReceiverConfig describes RTP stream of Receiver. It must match
+// SenderConfig of stream, zero fields are replaced by the same defaults.
+type ReceiverConfig struct {
+	// Address is host:port to listen. Multicast group is joined on
+	// Interface, or on system default interface, if Interface is empty.
+	Address     string
+	Interface   string
+	SampleRate  mix.Tz
+	NumChannels int
+	Format      mix.SampleFormat
+	PayloadType uint8
+	// Delay is jitter buffer: number of samples between the newest
+	// received sample and the played one. 20ms by default.
+	Delay mix.Tz
+}
+
+// Stats describes received stream.
+type Stats struct {
+	Received uint64 // packets
+	Lost     uint64 // packets, that never arrived
+	Late     uint64 // packets, that arrived after they were played
+	Resyncs  uint64 // jumps of played position to Delay
+}
+
+// Receiver is live unbounded Source of RTP stream. Samples, that were
+// lost or are not received yet, are silent. Offsets of Receiver are
+// in time of player: the first Samples call is played Delay samples
+// behind the newest received sample, and later calls follow it, until
+// jitter buffer runs dry or grows twice longer than Delay.
+//
+// Samples must be called from one goroutine, e.g. by stream, that plays
+// Receiver.
+type Receiver struct {
+	cfg       ReceiverConfig
+	conn      *net.UDPConn
+	frameSize int
+	ring      [][]uint32 // bits of samples, atomic
+	stamps    []int64    // media time of ring frames plus one, atomic
+	latest    int64      // media time after the newest received frame, atomic
+	played    int64      // media time after the last played frame, atomic
+
+	// State of receiving goroutine.
+	ssrc       uint32
+	started    bool
+	base       int64 // media time minus RTP timestamp
+	maxSeq     int64 // extended sequence numbers
+	minSeq     int64
+	numPackets int64 // packets of current stream
+	lostBefore int64 // lost packets of previous streams
+
+	// State of Samples.
+	anchored bool
+	delta    mix.Tz // media time minus offset
+	lastSeen int64  // latest at the previous Samples call
+	buffer   []mix.Buffer
+
+	received, lost, late, resyncs uint64 // atomic
+
+	mu   sync.Mutex
+	err  error
+	done chan struct{}
+}
+
+// NewReceiver starts Receiver, that listens to Address.
+func NewReceiver(cfg ReceiverConfig) (*Receiver, error) {
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 48000
+	}
+	if cfg.NumChannels == 0 {
+		cfg.NumChannels = 2
+	}
+	if cfg.Format == mix.Float32 {
+		cfg.Format = mix.Int24
+	}
+	if cfg.PayloadType == 0 {
+		cfg.PayloadType = 96
+	}
+	if cfg.Delay == 0 {
+		cfg.Delay = cfg.SampleRate / 50
+	}
+	if cfg.Format != mix.Int16 && cfg.Format != mix.Int24 {
+		return nil, fmt.Errorf("RTP does not support %s samples", cfg.Format)
+	}
+	if cfg.Delay < 0 || cfg.Delay > receiverHistory/4 {
+		return nil, fmt.Errorf("Jitter buffer delay %d is out of range", cfg.Delay)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RTP address: %v", err)
+	}
+	var conn *net.UDPConn
+	if addr.IP.IsMulticast() {
+		var iface *net.Interface
+		if cfg.Interface != "" {
+			if iface, err = net.InterfaceByName(cfg.Interface); err != nil {
+				return nil, err
+			}
+		}
+		conn, err = net.ListenMulticastUDP("udp", iface, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can not open RTP socket: %v", err)
+	}
+
+	r := &Receiver{
+		cfg:       cfg,
+		conn:      conn,
+		frameSize: cfg.NumChannels * cfg.Format.Bits() / 8,
+		ring:      make([][]uint32, cfg.NumChannels),
+		stamps:    make([]int64, receiverHistory),
+		buffer:    make([]mix.Buffer, cfg.NumChannels),
+		done:      make(chan struct{}),
+	}
+	for c := range r.ring {
+		r.ring[c] = make([]uint32, receiverHistory)
+	}
+	go r.run()
+	return r, nil
+}
+
+// Addr returns local address of socket, e.g. to find port of ":0".
+func (r *Receiver) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Close stops receiving. Receiver plays silence after Close.
+func (r *Receiver) Close() error {
+	err := r.conn.Close()
+	<-r.done
+	return err
+}
+
+// Err returns error of socket, that stopped receiving.
+func (r *Receiver) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Stats returns statistics of received stream.
+func (r *Receiver) Stats() Stats {
+	return Stats{
+		Received: atomic.LoadUint64(&r.received),
+		Lost:     atomic.LoadUint64(&r.lost),
+		Late:     atomic.LoadUint64(&r.late),
+		Resyncs:  atomic.LoadUint64(&r.resyncs),
+	}
+}
+
+func (r *Receiver) run() {
+	defer close(r.done)
+	packet := make([]byte, maxPacketSize)
+	for {
+		n, err := r.conn.Read(packet)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				r.mu.Lock()
+				r.err = fmt.Errorf("Can not receive RTP: %v", err)
+				r.mu.Unlock()
+			}
+			return
+		}
+		r.receive(packet[0:n])
+	}
+}
+
+// receive stores samples of packet in history. Invalid packets and
+// packets of other payload types are ignored.
+func (r *Receiver) receive(packet []byte) {
+	if len(packet) < headerSize || packet[0]>>6 != 2 ||
+		packet[1]&0x7f != r.cfg.PayloadType {
+		return
+	}
+	payload := packet[headerSize:]
+	if csrc := 4 * int(packet[0]&0x0f); csrc <= len(payload) {
+		payload = payload[csrc:]
+	} else {
+		return
+	}
+	if packet[0]&0x10 != 0 { // extension
+		if len(payload) < 4 {
+			return
+		}
+		ext := 4 + 4*int(binary.BigEndian.Uint16(payload[2:]))
+		if ext > len(payload) {
+			return
+		}
+		payload = payload[ext:]
+	}
+	if packet[0]&0x20 != 0 { // padding
+		if len(payload) == 0 || int(payload[len(payload)-1]) > len(payload) {
+			return
+		}
+		payload = payload[0 : len(payload)-int(payload[len(payload)-1])]
+	}
+	if len(payload)%r.frameSize != 0 {
+		return
+	}
+	seq := binary.BigEndian.Uint16(packet[2:])
+	timestamp := binary.BigEndian.Uint32(packet[4:])
+	ssrc := binary.BigEndian.Uint32(packet[8:])
+
+	latest := atomic.LoadInt64(&r.latest)
+	// Extend timestamp to media time closest to the newest sample.
+	pos := latest + int64(int32(timestamp-uint32(latest-r.base)))
+	if !r.started || ssrc != r.ssrc ||
+		pos-latest > receiverHistory/4 || latest-pos > receiverHistory/4 {
+		// New stream or jump of timestamps continues after the newest
+		// sample.
+		if r.started {
+			r.lostBefore = r.numLost()
+		}
+		r.started, r.ssrc = true, ssrc
+		r.base, pos = latest-int64(timestamp), latest
+		r.maxSeq, r.minSeq, r.numPackets = int64(seq), int64(seq), 0
+	}
+	ext := r.maxSeq + int64(int16(seq-uint16(r.maxSeq)))
+	if ext > r.maxSeq {
+		r.maxSeq = ext
+	} else if ext < r.minSeq {
+		r.minSeq = ext
+	}
+	r.numPackets++
+	atomic.AddUint64(&r.received, 1)
+	atomic.StoreUint64(&r.lost, uint64(r.numLost()))
+
+	n := int64(len(payload) / r.frameSize)
+	if pos+n <= atomic.LoadInt64(&r.played) {
+		atomic.AddUint64(&r.late, 1)
+		return
+	}
+	for i := int64(0); i < n; i++ {
+		idx := (pos + i) & (receiverHistory - 1)
+		if atomic.LoadInt64(&r.stamps[idx]) == pos+i+1 {
+			continue // duplicate
+		}
+		// Frame is invalidated, while it is written, so that Samples
+		// does not return samples of different frames.
+		atomic.StoreInt64(&r.stamps[idx], 0)
+		frame := payload[int(i)*r.frameSize:]
+		for c, ring := range r.ring {
+			atomic.StoreUint32(&ring[idx], math.Float32bits(r.sample(frame, c)))
+		}
+		atomic.StoreInt64(&r.stamps[idx], pos+i+1)
+	}
+	if pos+n > latest {
+		atomic.StoreInt64(&r.latest, pos+n)
+	}
+}
+
+// numLost returns number of packets, that are lost since the first stream.
+func (r *Receiver) numLost() int64 {
+	lost := r.maxSeq - r.minSeq + 1 - r.numPackets
+	if lost < 0 {
+		lost = 0 // duplicates
+	}
+	return r.lostBefore + lost
+}
+
+// sample returns sample of channel c in frame.
+func (r *Receiver) sample(frame []byte, c int) float32 {
+	if r.cfg.Format == mix.Int16 {
+		return float32(int16(binary.BigEndian.Uint16(frame[2*c:]))) / math.MaxInt16
+	}
+	b := frame[3*c:]
+	return float32(int32(b[0])<<24>>8|int32(b[1])<<8|int32(b[2])) / (1<<23 - 1)
+}
+
+// Samples returns received samples, that are played at offset.
+func (r *Receiver) Samples(channel int, offset, length mix.Tz) mix.Buffer {
+	if mix.Tz(cap(r.buffer[channel])) < length {
+		r.buffer[channel] = mix.NewBuffer(length)
+	}
+	res := r.buffer[channel][0:length]
+	latest := atomic.LoadInt64(&r.latest)
+	if channel == 0 && latest != 0 {
+		// Jitter buffer is checked only while packets arrive, so that
+		// the last samples are not replayed after stream stops.
+		fill := latest - int64(offset+r.delta+length)
+		if !r.anchored || latest != r.lastSeen &&
+			(fill < 0 || fill > 2*int64(r.cfg.Delay)) {
+			if r.anchored {
+				atomic.AddUint64(&r.resyncs, 1)
+			}
+			r.anchored = true
+			r.delta = mix.Tz(latest) - r.cfg.Delay - offset - length
+		}
+		r.lastSeen = latest
+	}
+	if !r.anchored {
+		res.Zero()
+		return res
+	}
+
+	pos := int64(offset + r.delta)
+	ring := r.ring[channel]
+	for i := range res {
+		p := pos + int64(i)
+		idx := p & (receiverHistory - 1)
+		res[i] = 0
+		if atomic.LoadInt64(&r.stamps[idx]) == p+1 {
+			v := math.Float32frombits(atomic.LoadUint32(&ring[idx]))
+			// Frame could be overwritten while it is read.
+			if atomic.LoadInt64(&r.stamps[idx]) == p+1 {
+				res[i] = v
+			}
+		}
+	}
+	if channel == 0 && pos+int64(length) > atomic.LoadInt64(&r.played) {
+		atomic.StoreInt64(&r.played, pos+int64(length))
+	}
+	return res
+}
+
+func (r *Receiver) SampleRate() mix.Tz {
+	return r.cfg.SampleRate
+}
+
+func (r *Receiver) NumChannels() int {
+	return r.cfg.NumChannels
+}
+
+// Length returns mix.Infinite, live stream never ends.
+func (r *Receiver) Length() mix.Tz {
+	return mix.Infinite
+}
+
+// Clone returns Receiver itself, it is played in one place.
+func (r *Receiver) Clone() mix.Source {
+	return r
+}
+
+func (r *Receiver) Preallocate(chunkSize mix.Tz) {
+	for c := range r.buffer {
+		if mix.Tz(cap(r.buffer[c])) < chunkSize {
+			r.buffer[c] = mix.NewBuffer(chunkSize)
+		}
+	}
+}
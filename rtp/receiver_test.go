@@ -0,0 +1,161 @@
+package rtp
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/output"
+
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+const rate = 8000
+
+func constSource(v float32, n mix.Tz) mix.Source {
+	buf := mix.NewBuffer(n)
+	for i := range buf {
+		buf[i] = v
+	}
+	return mix.MemSource{Rate: rate, Data: []mix.Buffer{buf}}
+}
+
+func waitStats(t *testing.T, r *Receiver, ok func(Stats) bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !ok(r.Stats()); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Invalid receiver stats %+v", r.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	r, err := NewReceiver(ReceiverConfig{Address: "127.0.0.1:0", SampleRate: rate,
+		NumChannels: 1, Format: mix.Int16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	s, err := NewSender(SenderConfig{Address: r.Addr().String(), SampleRate: rate,
+		NumChannels: 1, Format: mix.Int16, Output: output.Config{Clip: output.ClipHard}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Switch(mix.SourceMutatorFunc(func(cur mix.Source, pos mix.Tz) mix.Source {
+		res, _ := mix.Concat(mix.Silence(pos, rate, 1), constSource(0.5, 10*rate))
+		return res
+	}))
+	// Packets of 1ms are sent just in time.
+	time.Sleep(300 * time.Millisecond)
+	if sent := s.Sent(); sent < 100 || sent > 400 {
+		t.Error("Invalid number of sent packets", sent)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitStats(t, r, func(st Stats) bool { return st.Received == s.Sent() })
+	if st := r.Stats(); st.Lost != 0 || st.Late != 0 {
+		t.Errorf("Invalid receiver stats %+v", st)
+	}
+
+	for _, v := range r.Samples(0, 0, 80) {
+		if math.Abs(float64(v)-0.5) > 2./32767 {
+			t.Fatal("Invalid received sample", v)
+		}
+	}
+	// Stream is stopped: jitter buffer is played out and the last samples
+	// are not replayed.
+	for i, v := range r.Samples(0, 80, 1000) {
+		if (v != 0) != (i < rate/50) {
+			t.Fatal("Invalid sample after stream stopped", i, v)
+		}
+	}
+	for _, v := range r.Samples(0, 1080, 1000) {
+		if v != 0 {
+			t.Fatal("Stopped stream is not silent", v)
+		}
+	}
+	if err := mix.SourceErr(r); err != nil {
+		t.Error(err)
+	}
+}
+
+// value returns sample of test packet with sequence number seq.
+func value(seq uint16) float32 {
+	return float32(int16(seq)) / 100
+}
+
+// received returns value of test packet as it is received.
+func received(seq uint16) float32 {
+	return float32(int16(value(seq)*math.MaxInt16)) / math.MaxInt16
+}
+
+// packet returns RTP packet of n mono samples, that are equal to value.
+func packet(seq uint16, timestamp uint32, n int) []byte {
+	b := make([]byte, headerSize, headerSize+2*n)
+	b[0], b[1] = 2<<6, 96
+	binary.BigEndian.PutUint16(b[2:], seq)
+	binary.BigEndian.PutUint32(b[4:], timestamp)
+	binary.BigEndian.PutUint32(b[8:], 42)
+	for i := 0; i < n; i++ {
+		b = putSample(b, mix.Int16, value(seq))
+	}
+	return b
+}
+
+func TestJitterBuffer(t *testing.T) {
+	r, err := NewReceiver(ReceiverConfig{Address: "127.0.0.1:0", SampleRate: rate,
+		NumChannels: 1, Format: mix.Int16, Delay: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	conn, err := net.Dial("udp", r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send := func(seqs ...uint16) {
+		for _, seq := range seqs {
+			// Timestamps and sequence numbers wrap around.
+			conn.Write(packet(seq-5, uint32(seq)*10-50, 10))
+		}
+	}
+
+	// Packet 3 is lost, packets 4 and 5 are reordered.
+	send(0, 1, 2, 5, 4, 6, 7, 8, 9)
+	waitStats(t, r, func(st Stats) bool { return st.Received == 9 })
+	if st := r.Stats(); st.Lost != 1 || st.Late != 0 || st.Resyncs != 0 {
+		t.Errorf("Invalid receiver stats %+v", st)
+	}
+	res := r.Samples(0, 1000, 80)
+	for i, v := range res {
+		expect := received(uint16(i/10 - 5))
+		if i/10 == 3 {
+			expect = 0
+		}
+		if v != expect {
+			t.Fatal("Invalid sample", i, v, expect)
+		}
+	}
+
+	// Packet 3 arrives after it was played.
+	send(3)
+	waitStats(t, r, func(st Stats) bool { return st.Late == 1 })
+	if st := r.Stats(); st.Lost != 0 {
+		t.Errorf("Invalid receiver stats %+v", st)
+	}
+
+	// Player runs ahead of stream and resyncs, when packets arrive.
+	send(10, 11)
+	waitStats(t, r, func(st Stats) bool { return st.Received == 12 })
+	res = r.Samples(0, 1500, 10)
+	if expect := received(9 - 5); res[0] != expect {
+		t.Error("Samples after resync are not delayed", res[0], expect)
+	}
+	if st := r.Stats(); st.Resyncs != 1 {
+		t.Errorf("Invalid receiver stats %+v", st)
+	}
+}
@@ -0,0 +1,242 @@
+// Package rtp streams live mix to LAN speakers as RTP packets of L16 or L24
+// samples, like AES67 devices do. Sender is real-time player, that sends
+// one packet per packet time to unicast or multicast address:
+//
+//	sender, err := rtp.NewSender(rtp.SenderConfig{Address: "239.69.0.1:5004"})
+//	if err != nil {
+//		return err
+//	}
+//	defer sender.Close()
+//	ctrl := controller.NewSwitchController(sender)
+//
+// Receiver is live Source, that plays received packets after jitter
+// buffer delay, e.g. by pipe or jack stream of small box near speakers:
+//
+//	recv, err := rtp.NewReceiver(rtp.ReceiverConfig{Address: "239.69.0.1:5004"})
+//	if err != nil {
+//		return err
+//	}
+//	defer recv.Close()
+//	stream.Play(recv)
+//
+// Receivers with the same Delay play the same packet at about the same
+// time, since packets reach all of them at once. Clocks of devices are not
+// synchronized, so receivers resync, when their buffer runs dry or
+// overflows.
+package rtp
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/output"
+	"github.com/kikht/mix/pipe"
+
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	headerSize    = 12   // RTP header without CSRC and extension
+	maxPacketSize = 1472 // UDP payload of Ethernet frame
+)
+
+// SenderConfig describes RTP stream of Sender. Zero fields are replaced
+// by defaults of AES67.
+type SenderConfig struct {
+	Address     string // host:port, may be multicast group
+	SampleRate  mix.Tz // 48000 by default
+	NumChannels int    // 2 by default
+	// Format is mix.Int16 for L16 or mix.Int24 for L24 payload. Float32,
+	// the zero value, means Int24.
+	Format mix.SampleFormat
+	// PacketTime is number of samples in packet, 1ms by default.
+	PacketTime  mix.Tz
+	PayloadType uint8 // dynamic type 96 by default
+	// Latency is number of samples rendered ahead of clock. Packets are
+	// sent just in time by default.
+	Latency mix.Tz
+	Output  output.Config
+}
+
+// Sender is mix.Player and mix.SwitchPlayer, that sends played source
+// to UDP address. Its Stream methods control playback, Close also closes
+// socket.
+type Sender struct {
+	*pipe.Stream
+	packetizer *packetizer
+}
+
+// NewSender starts Sender, that sends silence until the first Play or
+// Switch. Multicast packets are sent with default TTL of 1, so they stay
+// in local network.
+func NewSender(cfg SenderConfig) (*Sender, error) {
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 48000
+	}
+	if cfg.NumChannels == 0 {
+		cfg.NumChannels = 2
+	}
+	if cfg.Format == mix.Float32 {
+		cfg.Format = mix.Int24
+	}
+	if cfg.PacketTime == 0 {
+		cfg.PacketTime = cfg.SampleRate / 1000
+	}
+	if cfg.PayloadType == 0 {
+		cfg.PayloadType = 96
+	}
+	if cfg.Latency == 0 {
+		cfg.Latency = cfg.PacketTime
+	}
+	if cfg.Format != mix.Int16 && cfg.Format != mix.Int24 {
+		return nil, fmt.Errorf("RTP does not support %s samples", cfg.Format)
+	}
+	if cfg.PayloadType > 127 {
+		return nil, fmt.Errorf("Invalid payload type %d", cfg.PayloadType)
+	}
+	frameSize := cfg.NumChannels * cfg.Format.Bits() / 8
+	if size := headerSize + int(cfg.PacketTime)*frameSize; size > maxPacketSize {
+		return nil, fmt.Errorf("RTP packet of %d bytes is too long", size)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RTP address: %v", err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("Can not open RTP socket: %v", err)
+	}
+	p := &packetizer{
+		cfg:       cfg,
+		conn:      conn,
+		packet:    make([]byte, headerSize, maxPacketSize),
+		seq:       uint16(rand.Uint32()),
+		timestamp: rand.Uint32(),
+		ssrc:      rand.Uint32(),
+	}
+	return &Sender{
+		Stream: pipe.NewEncoderStream(p, pipe.Config{
+			SampleRate:  cfg.SampleRate,
+			ChunkSize:   cfg.PacketTime,
+			NumChannels: cfg.NumChannels,
+			Format:      cfg.Format,
+			Latency:     cfg.Latency,
+			Output:      cfg.Output,
+		}),
+		packetizer: p,
+	}, nil
+}
+
+// Sent returns number of sent packets.
+func (s *Sender) Sent() uint64 {
+	return atomic.LoadUint64(&s.packetizer.sent)
+}
+
+// Failed returns number of packets, that socket failed to send, e.g.
+// while network was down. Sender does not stop on such errors.
+func (s *Sender) Failed() uint64 {
+	return atomic.LoadUint64(&s.packetizer.failed)
+}
+
+// SDP returns session description of stream, that could be announced to
+// AES67 receivers.
+func (s *Sender) SDP(name string) string {
+	p := s.packetizer
+	local := p.conn.LocalAddr().(*net.UDPAddr)
+	remote := p.conn.RemoteAddr().(*net.UDPAddr)
+	encoding := "L24"
+	if p.cfg.Format == mix.Int16 {
+		encoding = "L16"
+	}
+	conn := remote.IP.String()
+	if remote.IP.IsMulticast() {
+		conn += "/1"
+	}
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- %d 0 IN %s %s", p.ssrc, ipVersion(local.IP), local.IP),
+		"s=" + name,
+		fmt.Sprintf("c=IN %s %s", ipVersion(remote.IP), conn),
+		"t=0 0",
+		fmt.Sprintf("m=audio %d RTP/AVP %d", remote.Port, p.cfg.PayloadType),
+		fmt.Sprintf("a=rtpmap:%d %s/%d/%d", p.cfg.PayloadType, encoding,
+			p.cfg.SampleRate, p.cfg.NumChannels),
+		fmt.Sprintf("a=ptime:%g", 1000*float64(p.cfg.PacketTime)/float64(p.cfg.SampleRate)),
+		"a=sendonly",
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func ipVersion(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IP4"
+	}
+	return "IP6"
+}
+
+// packetizer is mix.Encoder, that sends every chunk as RTP packet.
+type packetizer struct {
+	cfg       SenderConfig
+	conn      *net.UDPConn
+	packet    []byte
+	seq       uint16
+	timestamp uint32
+	ssrc      uint32
+	sent      uint64 // atomic
+	failed    uint64 // atomic
+}
+
+func (p *packetizer) Encode(buffer []mix.Buffer) error {
+	if len(buffer) != p.cfg.NumChannels {
+		return fmt.Errorf("Expected %d channels, got %d",
+			p.cfg.NumChannels, len(buffer))
+	}
+	length := len(buffer[0])
+	if length == 0 {
+		return nil
+	}
+	b := p.packet[0:headerSize]
+	b[0] = 2 << 6 // version
+	b[1] = p.cfg.PayloadType
+	binary.BigEndian.PutUint16(b[2:], p.seq)
+	binary.BigEndian.PutUint32(b[4:], p.timestamp)
+	binary.BigEndian.PutUint32(b[8:], p.ssrc)
+	for i := 0; i < length; i++ {
+		for _, buf := range buffer {
+			b = putSample(b, p.cfg.Format, buf[i])
+		}
+	}
+	p.packet = b
+	p.seq++
+	p.timestamp += uint32(length)
+	if _, err := p.conn.Write(b); err != nil {
+		atomic.AddUint64(&p.failed, 1)
+	} else {
+		atomic.AddUint64(&p.sent, 1)
+	}
+	return nil
+}
+
+func (p *packetizer) Close() error {
+	return p.conn.Close()
+}
+
+// putSample appends big-endian integer sample v to b.
+func putSample(b []byte, format mix.SampleFormat, v float32) []byte {
+	if v > 1 {
+		v = 1
+	} else if v < -1 {
+		v = -1
+	}
+	if format == mix.Int16 {
+		i := int16(v * math.MaxInt16)
+		return append(b, byte(i>>8), byte(i))
+	}
+	i := int32(v * (1<<23 - 1))
+	return append(b, byte(i>>16), byte(i>>8), byte(i))
+}
@@ -0,0 +1,42 @@
+package rtp
+
+import (
+	"github.com/kikht/mix"
+
+	"strings"
+	"testing"
+)
+
+func TestSenderConfig(t *testing.T) {
+	for _, cfg := range []SenderConfig{
+		{Address: "127.0.0.1:5004", Format: mix.Int32},
+		{Address: "127.0.0.1:5004", PayloadType: 128},
+		{Address: "127.0.0.1:5004", PacketTime: 1000},
+		{Address: "127.0.0.1"},
+	} {
+		if s, err := NewSender(cfg); err == nil {
+			s.Close()
+			t.Errorf("Invalid config is accepted %+v", cfg)
+		}
+	}
+}
+
+func TestSDP(t *testing.T) {
+	s, err := NewSender(SenderConfig{Address: "239.69.0.1:5004"})
+	if err != nil {
+		t.Skip("Multicast is not available:", err)
+	}
+	defer s.Close()
+	sdp := s.SDP("Table")
+	for _, line := range []string{
+		"s=Table\r\n",
+		"c=IN IP4 239.69.0.1/1\r\n",
+		"m=audio 5004 RTP/AVP 96\r\n",
+		"a=rtpmap:96 L24/48000/2\r\n",
+		"a=ptime:1\r\n",
+	} {
+		if !strings.Contains(sdp, line) {
+			t.Errorf("SDP does not contain %q:\n%s", line, sdp)
+		}
+	}
+}
@@ -1,30 +1,23 @@
 package mix
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
-	"os"
 	"sort"
-	"syscall"
 	"time"
 )
 
-// Session mixes collection of Regions. Output is done in 32-bit float WAV.
+// Session mixes collection of Regions. Output is done with Encoder,
+// 32-bit float WAV by default.
 // Session implements Source, so it could be nested.
 type Session struct {
 	sampleRate Tz
 	pos        Tz
 	length     Tz
 
-	//TODO: separate wav (or other format) writer
-	output io.Writer
-	numOut Tz
+	output Encoder
 
 	buffer []Buffer
 
@@ -32,6 +25,11 @@ type Session struct {
 	regions []*preparedRegion
 	rPos    int
 	active  []*preparedRegion
+	version int        // incremented on every change of regions
+	nested  []*Session // distinct Sessions in sources of regions
+
+	cache *renderCache
+	err   error // first error of region sources
 }
 
 const numChannels = 2
@@ -53,6 +51,11 @@ func (s *Session) Clone() Source {
 	copy(clone.regions, s.regions)
 	clone.active = make([]*preparedRegion, len(s.active))
 	copy(clone.active, s.active)
+	clone.nested = append([]*Session(nil), s.nested...)
+	clone.err = nil
+	if s.cache != nil {
+		clone.cache = newRenderCache(s.cache.blockSize, s.cache.maxBlocks)
+	}
 	return &clone
 }
 
@@ -66,6 +69,8 @@ type Region struct {
 }
 
 // AddRegion adds region to the Session mix.
+// Region of unbounded Source with zero or Infinite Length is open-ended:
+// it never ends, so Session becomes unbounded too.
 func (s *Session) AddRegion(r Region) error {
 	if r.Source.SampleRate() != s.sampleRate {
 		return errors.New("Source sample rate is different from session")
@@ -73,16 +78,24 @@ func (s *Session) AddRegion(r Region) error {
 	if chans := r.Source.NumChannels(); chans < 1 || chans > 2 {
 		return errors.New("Only mono and stereo sources are supported")
 	}
+	orig := r
 
 	sLen := r.Source.Length()
 	if r.Offset > sLen || r.Offset < 0 {
 		return errors.New("Invalid offset")
 	}
-	if r.Length > sLen-r.Offset || r.Length < 0 {
+	openEnded := sLen == Infinite && r.Length == Infinite
+	if r.Length > sLen-r.Offset && !openEnded || r.Length < 0 {
 		return errors.New("Invalid length")
 	}
 	if r.Length == 0 {
 		r.Length = sLen - r.Offset
+		if sLen == Infinite {
+			r.Length = Infinite
+		}
+	}
+	if r.Length == Infinite && r.FadeOut != 0 {
+		return errors.New("Open-ended region can't have fadeOut")
 	}
 
 	if r.FadeIn < 0 || r.FadeIn > r.Length {
@@ -96,8 +109,12 @@ func (s *Session) AddRegion(r Region) error {
 	}
 
 	end := r.Begin + r.Length
+	if r.Length == Infinite {
+		end = Infinite
+	}
 	if r.FadeIn > 0 {
 		fi := preparedRegion{
+			Reg:    &orig,
 			Src:    r.Source,
 			Beg:    r.Begin,
 			End:    r.Begin + r.FadeIn,
@@ -108,8 +125,9 @@ func (s *Session) AddRegion(r Region) error {
 		}
 		s.insertRegion(fi)
 	}
-	if r.Begin+r.FadeIn != r.Begin+r.Length-r.FadeOut {
+	if r.FadeIn+r.FadeOut != r.Length {
 		sr := preparedRegion{
+			Reg:    &orig,
 			Src:    r.Source,
 			Beg:    r.Begin + r.FadeIn,
 			End:    end - r.FadeOut,
@@ -122,6 +140,7 @@ func (s *Session) AddRegion(r Region) error {
 	}
 	if r.FadeOut > 0 {
 		fo := preparedRegion{
+			Reg:    &orig,
 			Src:    r.Source,
 			Beg:    end - r.FadeOut,
 			End:    end,
@@ -141,6 +160,12 @@ func (s *Session) AddRegion(r Region) error {
 }
 
 func (s *Session) insertRegion(r preparedRegion) {
+	s.version++
+	s.addNested(r.Src)
+	// Already mixed data is stale, so fast path of Samples is disabled.
+	for c := range s.buffer {
+		s.buffer[c] = s.buffer[c][0:0]
+	}
 	rLen := len(s.regions)
 	rPos := sort.Search(rLen, func(i int) bool {
 		return s.regions[i].Beg > r.Beg
@@ -161,7 +186,51 @@ func (s *Session) insertRegion(r preparedRegion) {
 	}
 }
 
-// Play mixes length samples, writes them to output and advances currernt position by length.
+// addNested remembers Sessions, that are nested in src, also ones wrapped
+// by DeepCloners. Wrappers are visited with DeepClone, that returns nested
+// Sources as they are.
+func (s *Session) addNested(src Source) {
+	switch src := src.(type) {
+	case *Session:
+		for _, n := range s.nested {
+			if n == src {
+				return
+			}
+		}
+		s.nested = append(s.nested, src)
+	case DeepCloner:
+		src.DeepClone(func(nested Source) Source {
+			s.addNested(nested)
+			return nested
+		})
+	}
+}
+
+// treeVersion returns version, that is changed by every change of regions
+// of Session or its nested Sessions.
+func (s *Session) treeVersion() int {
+	res := s.version
+	for _, n := range s.nested {
+		res += n.treeVersion()
+	}
+	return res
+}
+
+// Regions returns copy of regions as they were added to the Session,
+// sorted by Begin.
+func (s *Session) Regions() []Region {
+	var res []Region
+	seen := make(map[*Region]bool)
+	for _, r := range s.regions {
+		if r.Reg != nil && !seen[r.Reg] {
+			seen[r.Reg] = true
+			res = append(res, *r.Reg)
+		}
+	}
+	return res
+}
+
+// Play mixes length samples, encodes them to output and advances currernt position by length.
 func (s *Session) Play(length Tz) error {
 	if length < 0 {
 		return errors.New("Can't play length < 0")
@@ -169,25 +238,29 @@ func (s *Session) Play(length Tz) error {
 
 	buf := s.allocateBuffer(length)
 	s.mix(buf)
-
-	if s.numOut == 0 {
-		_, err := s.output.Write(s.wavHeader(-1))
-		if err != nil {
-			return err
-		}
+	if s.err != nil {
+		return errors.New("error while mixing audio: " + s.err.Error())
 	}
-	s.numOut += length
-	err := s.writeBuffer(buf)
+
+	err := s.output.Encode(buf)
 	if err != nil {
 		return errors.New("error while writing audio buffer: " + err.Error())
 	}
-	err = s.updateHeader()
-	if err != nil {
-		return errors.New("error while updating WAV header: " + err.Error())
-	}
 	return nil
 }
 
+// Err returns the first error reported by sources of Session regions.
+// Failed sources are mixed as silence.
+func (s *Session) Err() error {
+	return s.err
+}
+
+func (s *Session) setErr(r *preparedRegion, err error) {
+	if s.err == nil {
+		s.err = fmt.Errorf("Region %v: %v", r, err)
+	}
+}
+
 func (s *Session) mix(buffer []Buffer) {
 	if len(buffer) != numChannels {
 		panic("invalid buffer")
@@ -237,7 +310,8 @@ func (s *Session) mix(buffer []Buffer) {
 		case 2:
 			gain[0][0], gain[0][1], gain[1][0], gain[1][1] = PanStereoGain(r.Pan)
 		default:
-			panic("Invalid number of channels")
+			s.setErr(r, fmt.Errorf("Invalid number of channels %d", schan))
+			schan = 0
 		}
 
 		//log.Printf("Mixing region %v, pos=%v end=%v rOff=%v bOff=%v rEnd=%v bEnd=%v rLen=%v gain=%v\n", r, s.pos, end, rOff, bOff, rEnd, bEnd, rLen, gain)
@@ -272,6 +346,9 @@ func (s *Session) mix(buffer []Buffer) {
 				}
 			}
 		}
+		if err := SourceErr(r.Src); err != nil {
+			s.setErr(r, err)
+		}
 
 		if end < r.End {
 			s.active[lastActive] = r
@@ -298,6 +375,10 @@ func (s *Session) NumChannels() int {
 }
 
 func (s *Session) Samples(channel int, offset, length Tz) Buffer {
+	if s.cache != nil {
+		return s.cache.samples(s, channel, offset, length)
+	}
+
 	// Fast-path for already mixed data
 	if offset+length == s.pos &&
 		len(s.buffer) > channel &&
@@ -348,10 +429,53 @@ func (s *Session) SampleRate() Tz {
 	return s.sampleRate
 }
 
-// SetOutput redirects session output to given io.Writer.
+// Preallocate allocates mixing buffers for chunks up to chunkSize samples
+// and preallocates sources of regions. Render cache still allocates blocks.
+func (s *Session) Preallocate(chunkSize Tz) {
+	s.allocateBuffer(chunkSize)
+	for c := range s.buffer {
+		s.buffer[c] = s.buffer[c][0:0]
+	}
+	if size := s.overlap(chunkSize); cap(s.active) < size {
+		active := make([]*preparedRegion, len(s.active), size)
+		copy(active, s.active)
+		s.active = active
+	}
+	for _, r := range s.regions {
+		Preallocate(r.Src, chunkSize)
+	}
+}
+
+// overlap returns maximal number of regions, that are mixed in one chunk
+// of given length: Beg < pos+length and End > pos.
+func (s *Session) overlap(length Tz) int {
+	ends := make([]Tz, len(s.regions))
+	for i, r := range s.regions {
+		ends[i] = r.End
+	}
+	sort.Slice(ends, func(i, j int) bool { return ends[i] < ends[j] })
+	res, cur, j := 0, 0, 0
+	for _, r := range s.regions { // sorted by Beg
+		for ; j < len(ends) && ends[j] <= r.Beg-length+1; j++ {
+			cur--
+		}
+		cur++
+		if cur > res {
+			res = cur
+		}
+	}
+	return res
+}
+
+// SetOutput redirects session output to given io.Writer in 32-bit float WAV.
 func (s *Session) SetOutput(output io.Writer) {
-	s.output = output
-	s.numOut = 0
+	s.SetEncoder(NewWavEncoder(output, s.sampleRate, numChannels, Float32))
+}
+
+// SetEncoder redirects session output to given Encoder.
+// Encoder must accept stereo buffers.
+func (s *Session) SetEncoder(enc Encoder) {
+	s.output = enc
 }
 
 func (s *Session) allocateBuffer(length Tz) []Buffer {
@@ -371,6 +495,7 @@ func (s *Session) allocateBuffer(length Tz) []Buffer {
 
 // Immutable region info with precomputed values
 type preparedRegion struct {
+	Reg                 *Region // Region as it was added, nil for internal ones
 	Src                 Source
 	Beg, End, Off       Tz
 	VolBeg, VolEnd, Pan float32
@@ -381,135 +506,6 @@ func (r preparedRegion) String() string {
 		r.Beg, r.End, r.Off, r.VolBeg, r.VolEnd, r.Pan)
 }
 
-// WAV functions
-
-const (
-	bitsPerSample      = 32
-	sampleFormat       = 3 //for float, 1 for PCM
-	sampleFormatSuffix = "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xAA\x00\x38\x9B\x71"
-	blockAlign         = numChannels * bitsPerSample / 8
-
-	extSize        = 2 + 4 + 16
-	fmtSize        = 2 + 2 + 4 + 4 + 2 + 2 + 2 + extSize
-	riffSizeOff    = 4
-	riffHeaderSize = 4 + 4 + 4 + fmtSize + 4 + 4
-	dataSizeOff    = riffHeaderSize + 4
-)
-
-func (s *Session) wavSizes(numSamples Tz) (riffSize, dataSize uint32) {
-	if numSamples < 0 {
-		riffSize = math.MaxUint32
-		dataSize = riffSize - riffHeaderSize
-	} else {
-		dataSize = uint32(numSamples * blockAlign)
-		riffSize = dataSize + riffHeaderSize
-	}
-	return
-}
-
-func (s *Session) wavHeader(numSamples Tz) []byte {
-	var (
-		byteRate           = s.sampleRate * blockAlign
-		riffSize, dataSize = s.wavSizes(numSamples)
-	)
-
-	//  0  4 "RIFF"
-	//  4  4 riffSize = header + samples * byteRate (or just maximum possible)
-	//  8  4 "WAVE"
-	// 12  4 "fmt "
-	// 16  4 fmtSize
-	// 20  2 smplFmt
-	// 22  2 numChan
-	// 24  4 smpRate
-	// 28  4 byteRate
-	// 32  2 block
-	// 34  2 bits
-	// 36  2 extSize
-	// 38  2 validBits
-	// 40  4 channelMask
-	// 44 16 format
-	// 60  4 "data"
-	// 64  4 dataSize = samples * byteRate
-	// 68  ...
-
-	buf := new(bytes.Buffer)
-	buf.Write([]byte("RIFF"))
-	binary.Write(buf, binary.LittleEndian, uint32(riffSize))
-	buf.Write([]byte("WAVE"))
-	buf.Write([]byte("fmt "))
-	binary.Write(buf, binary.LittleEndian, uint32(fmtSize))
-	binary.Write(buf, binary.LittleEndian, uint16(sampleFormat))
-	binary.Write(buf, binary.LittleEndian, uint16(numChannels))
-	binary.Write(buf, binary.LittleEndian, uint32(s.sampleRate))
-	binary.Write(buf, binary.LittleEndian, uint32(byteRate))
-	binary.Write(buf, binary.LittleEndian, uint16(blockAlign))
-	binary.Write(buf, binary.LittleEndian, uint16(bitsPerSample))
-	binary.Write(buf, binary.LittleEndian, uint16(extSize))
-	binary.Write(buf, binary.LittleEndian, uint16(bitsPerSample))
-	binary.Write(buf, binary.LittleEndian, uint32(0))
-	binary.Write(buf, binary.LittleEndian, uint16(sampleFormat))
-	buf.Write([]byte(sampleFormatSuffix))
-	buf.Write([]byte("data"))
-	binary.Write(buf, binary.LittleEndian, uint32(dataSize))
-
-	return buf.Bytes()
-}
-
-func (s *Session) writeBuffer(buffer []Buffer) error {
-	if len(buffer) != numChannels {
-		return errors.New("Only stereo buffers are supported")
-	}
-	length := len(buffer[0])
-	if len(buffer[1]) != length {
-		return errors.New("invalid buffer")
-	}
-
-	out := bufio.NewWriter(s.output)
-	b := make([]byte, 8)
-	for i := 0; i < length; i++ {
-		l := math.Float32bits(buffer[0][i])
-		r := math.Float32bits(buffer[1][i])
-		binary.LittleEndian.PutUint32(b[0:4], l)
-		binary.LittleEndian.PutUint32(b[4:8], r)
-		out.Write(b)
-	}
-	return out.Flush()
-}
-
-func (s *Session) updateHeader() error {
-	if w, ok := s.output.(io.WriterAt); ok {
-		var (
-			buf                = make([]byte, 4)
-			riffSize, dataSize = s.wavSizes(s.numOut)
-			err                error
-		)
-		binary.LittleEndian.PutUint32(buf, riffSize)
-		_, err = w.WriteAt(buf, riffSizeOff)
-		if err != nil {
-			if isPipeErr(err) {
-				return nil
-			}
-			return err
-		}
-		binary.LittleEndian.PutUint32(buf, dataSize)
-		_, err = w.WriteAt(buf, dataSizeOff)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func isPipeErr(err error) bool {
-	if perr, ok := err.(*os.PathError); ok {
-		err = perr.Err
-	}
-	if err == syscall.ESPIPE {
-		return true
-	}
-	return false
-}
-
 func assert(b bool) {
 	if !b {
 		panic("assert failed")
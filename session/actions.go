@@ -2,152 +2,137 @@ package session
 
 import (
 	"github.com/kikht/mix"
-	"log"
+	"github.com/kikht/mix/rtlog"
 )
 
 type Ambience struct {
-	*Session
-	fade mix.Tz
+	next            mix.Source
+	fade, chunkSize mix.Tz
 }
 
+// NewAmbience returns mutator, that crossfades current source to next.
+// Next source is played in session time, so it is usually unbounded,
+// e.g. mix.Loop of ambience bed.
 func NewAmbience(next mix.Source, fade, chunkSize mix.Tz) mix.SourceMutator {
-	res := &Session{
-		sampleRate: next.SampleRate(),
-		length:     next.Length(),
-		forgetPast: true,
-		regions: []*preparedRegion{
-			&preparedRegion{
-				VolBeg: 1,
-				VolEnd: 0,
-			},
-			&preparedRegion{
-				Src:    next,
-				VolBeg: 0,
-				VolEnd: 1,
-			},
-			&preparedRegion{
-				Src:    next,
-				End:    next.Length(),
-				VolBeg: 1,
-				VolEnd: 1,
-			},
-		},
-		active: make([]*preparedRegion, 0, 4),
-	}
-	res.allocateBuffer(chunkSize)
-	return Ambience{res, fade}
+	return Ambience{next, fade, chunkSize}
 }
 
 func (a Ambience) Mutate(cur mix.Source, pos mix.Tz) mix.Source {
-	log.Println("Ambience.Mutate()", pos)
-	var (
-		fadeOut = a.regions[0]
-		fadeIn  = a.regions[1]
-		next    = a.regions[2]
-	)
-
-	fadeOut.Src = cur
-	fadeOut.Beg = pos
-	fadeOut.End = pos + a.fade
-	fadeOut.Off = pos
-
-	fadeIn.Beg = pos
-	fadeIn.End = pos + a.fade
-	fadeIn.Off = pos
-
-	next.Beg = pos + a.fade
-	next.Off = pos + a.fade
-
-	a.pos = pos
-	return a.Session
+	rtlog.Log("Ambience.Mutate()", int64(pos))
+	res := newActionSession(a.next.SampleRate(), a.chunkSize, pos)
+	res.insert(a.next.Length(),
+		preparedRegion{ // fade out of current source
+			Src:    cur,
+			Beg:    pos,
+			End:    pos + a.fade,
+			Off:    pos,
+			VolBeg: 1,
+			VolEnd: 0,
+		},
+		preparedRegion{ // fade in of next
+			Src:    a.next,
+			Beg:    pos,
+			End:    pos + a.fade,
+			Off:    pos,
+			VolBeg: 0,
+			VolEnd: 1,
+		},
+		preparedRegion{
+			Src:    a.next,
+			Beg:    pos + a.fade,
+			End:    a.next.Length(),
+			Off:    pos + a.fade,
+			VolBeg: 1,
+			VolEnd: 1,
+		})
+	mix.Preallocate(a.next, a.chunkSize)
+	return res
 }
 
 type Music struct {
-	*Session
-	fade mix.Tz
+	mus, next       mix.Source
+	fade, chunkSize mix.Tz
 }
 
 func NewMusic(mus, next mix.Source, fade, chunkSize mix.Tz) mix.SourceMutator {
-	res := &Session{
-		sampleRate: next.SampleRate(),
-		length:     next.Length(),
-		forgetPast: true,
-		regions: []*preparedRegion{
-			&preparedRegion{
-				VolBeg: 1,
-				VolEnd: 0,
-			},
-			&preparedRegion{
-				Src:    mus,
-				VolBeg: 0,
-				VolEnd: 1,
-			},
-			&preparedRegion{
-				Src:    mus,
-				VolBeg: 1,
-				VolEnd: 1,
-			},
-			&preparedRegion{
-				Src:    mus,
-				VolBeg: 1,
-				VolEnd: 0,
-			},
-			&preparedRegion{
-				Src:    next,
-				VolBeg: 0,
-				VolEnd: 1,
-			},
-			&preparedRegion{
-				Src:    next,
-				End:    next.Length(),
-				VolBeg: 1,
-				VolEnd: 1,
-			},
-		},
-		active: make([]*preparedRegion, 0, 4),
-	}
-	res.allocateBuffer(chunkSize)
-	return Music{res, fade}
+	return Music{mus, next, fade, chunkSize}
 }
 
 func (m Music) Mutate(cur mix.Source, pos mix.Tz) mix.Source {
-	log.Println("Music.Mutate()", pos)
-	var (
-		prevFadeOut = m.regions[0]
-		musFadeIn   = m.regions[1]
-		music       = m.regions[2]
-		musFadeOut  = m.regions[3]
-		nextFadeIn  = m.regions[4]
-		next        = m.regions[5]
-	)
-	musLen := music.Src.Length()
-
-	prevFadeOut.Src = cur
-	prevFadeOut.Beg = pos
-	prevFadeOut.End = pos + m.fade
-	prevFadeOut.Off = pos
-
-	musFadeIn.Beg = pos
-	musFadeIn.End = pos + m.fade
-	musFadeIn.Off = 0
-
-	music.Beg = pos + m.fade
-	music.End = pos + musLen - m.fade
-	music.Off = m.fade
-
-	musFadeOut.Beg = pos + musLen - m.fade
-	musFadeOut.End = pos + musLen
-	musFadeOut.Off = musLen - m.fade
-
-	nextFadeIn.Beg = pos + musLen - m.fade
-	nextFadeIn.End = pos + musLen
-	nextFadeIn.Off = pos + musLen - m.fade
+	rtlog.Log("Music.Mutate()", int64(pos))
+	res := newActionSession(m.next.SampleRate(), m.chunkSize, pos)
+	musLen := m.mus.Length()
+	mix.Preallocate(m.mus, m.chunkSize)
+
+	prevFadeOut := preparedRegion{
+		Src:    cur,
+		Beg:    pos,
+		End:    pos + m.fade,
+		Off:    pos,
+		VolBeg: 1,
+		VolEnd: 0,
+	}
+	musFadeIn := preparedRegion{
+		Src:    m.mus,
+		Beg:    pos,
+		End:    pos + m.fade,
+		Off:    0,
+		VolBeg: 0,
+		VolEnd: 1,
+	}
+	music := preparedRegion{
+		Src:    m.mus,
+		Beg:    pos + m.fade,
+		End:    pos + musLen - m.fade,
+		Off:    m.fade,
+		VolBeg: 1,
+		VolEnd: 1,
+	}
+	if musLen == mix.Infinite {
+		// Endless music is never followed by next source.
+		music.End = mix.Infinite
+		res.insert(mix.Infinite, prevFadeOut, musFadeIn, music)
+		return res
+	}
 
-	next.Beg = pos + musLen
-	next.Off = pos + musLen
+	res.insert(m.next.Length(), prevFadeOut, musFadeIn, music,
+		preparedRegion{ // music fade out
+			Src:    m.mus,
+			Beg:    pos + musLen - m.fade,
+			End:    pos + musLen,
+			Off:    musLen - m.fade,
+			VolBeg: 1,
+			VolEnd: 0,
+		},
+		preparedRegion{ // next fade in
+			Src:    m.next,
+			Beg:    pos + musLen - m.fade,
+			End:    pos + musLen,
+			Off:    pos + musLen - m.fade,
+			VolBeg: 0,
+			VolEnd: 1,
+		},
+		preparedRegion{
+			Src:    m.next,
+			Beg:    pos + musLen,
+			End:    m.next.Length(),
+			Off:    pos + musLen,
+			VolBeg: 1,
+			VolEnd: 1,
+		})
+	mix.Preallocate(m.next, m.chunkSize)
+	return res
+}
 
-	m.pos = pos
-	return m.Session
+// newActionSession creates forgetful Session, that starts playing at pos.
+// New sources of action must be preallocated, before it is returned by
+// Mutate. Current source is already played, so it is not preallocated.
+func newActionSession(sampleRate, chunkSize, pos mix.Tz) *Session {
+	res := NewSession(sampleRate, true)
+	res.allocate(chunkSize, 0)
+	res.pos = pos
+	res.played = int64(pos)
+	return res
 }
 
 type Effect struct {
@@ -0,0 +1,126 @@
+package session
+
+import (
+	"github.com/kikht/mix"
+)
+
+// MixPool is a set of goroutines, that mix active regions of Session
+// in parallel. Regions are split into contiguous groups, each group is mixed
+// into its own buffer and buffers are summed in fixed order, so output is
+// reproducible for the same number of workers. Only regions with concurrent
+// sources (see mix.IsConcurrent) are mixed in parallel, others are mixed
+// by the calling goroutine.
+//
+// MixPool does not allocate memory while mixing chunks up to maxChunk samples.
+// It must not be used by several Sessions at once.
+type MixPool struct {
+	workers    []*poolWorker
+	maxChunk   mix.Tz
+	minRegions int
+}
+
+type poolTask struct {
+	regions  []*preparedRegion
+	pos, end mix.Tz
+}
+
+type poolWorker struct {
+	tasks  chan poolTask
+	done   chan error
+	buffer [numChannels]mix.Buffer
+}
+
+// NewMixPool starts numWorkers goroutines, that mix chunks of maxChunk samples
+// or less. Calling goroutine also takes part in mixing, so numWorkers of
+// runtime.NumCPU()-1 will load all cores.
+func NewMixPool(numWorkers int, maxChunk mix.Tz) *MixPool {
+	p := &MixPool{
+		workers:    make([]*poolWorker, numWorkers),
+		maxChunk:   maxChunk,
+		minRegions: 2 * (numWorkers + 1),
+	}
+	for i := range p.workers {
+		w := &poolWorker{
+			tasks: make(chan poolTask, 1),
+			done:  make(chan error, 1),
+		}
+		for c := range w.buffer {
+			w.buffer[c] = mix.NewBuffer(maxChunk)
+		}
+		p.workers[i] = w
+		go w.run()
+	}
+	return p
+}
+
+// Close stops pool goroutines. Pool must not be used after Close.
+func (p *MixPool) Close() {
+	for _, w := range p.workers {
+		close(w.tasks)
+	}
+}
+
+// SetMixPool enables parallel mixing of Session regions with pool.
+// Nil pool disables it. Nested sessions are not affected.
+// Preallocate sizes regions of pool too, so that mixing does not allocate.
+func (s *Session) SetMixPool(pool *MixPool) {
+	s.pool = pool
+	if pool != nil && s.parallel == nil {
+		s.parallel = make([]*preparedRegion, 0, 4*pool.minRegions)
+	}
+}
+
+func (p *MixPool) fits(length mix.Tz) bool {
+	return length <= p.maxChunk
+}
+
+// mix returns the first error in order of regions.
+func (p *MixPool) mix(regions []*preparedRegion, buffer [numChannels]mix.Buffer,
+	pos, end mix.Tz) error {
+
+	n := len(p.workers) + 1
+	if len(regions) < p.minRegions {
+		n = 1
+	}
+	group := func(i int) []*preparedRegion {
+		return regions[len(regions)*i/n : len(regions)*(i+1)/n]
+	}
+
+	for i := 1; i < n; i++ {
+		p.workers[i-1].tasks <- poolTask{group(i), pos, end}
+	}
+	var res error
+	for _, r := range group(0) {
+		if err := mixRegion(r, buffer, pos, end); res == nil {
+			res = err
+		}
+	}
+	length := end - pos
+	for i := 1; i < n; i++ {
+		w := p.workers[i-1]
+		if err := <-w.done; res == nil {
+			res = err
+		}
+		for c := range buffer {
+			buffer[c].Mix(w.buffer[c][0:length])
+		}
+	}
+	return res
+}
+
+func (w *poolWorker) run() {
+	for t := range w.tasks {
+		var buf [numChannels]mix.Buffer
+		for c := range buf {
+			buf[c] = w.buffer[c][0 : t.end-t.pos]
+			buf[c].Zero()
+		}
+		var res error
+		for _, r := range t.regions {
+			if err := mixRegion(r, buf, t.pos, t.end); res == nil {
+				res = err
+			}
+		}
+		w.done <- res
+	}
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"github.com/kikht/mix"
+
+	"math"
+	"runtime"
+	"testing"
+)
+
+const poolChunk = 256
+
+func getDenseSession(pool *MixPool) *Session {
+	s := NewSession(rate, false)
+	for i := 0; i < 300; i++ {
+		src := getTestSource(1 + i%2)
+		s.AddRegion(Region{
+			Source: src,
+			Begin:  mix.Tz(i % 37),
+			Volume: float32(i%10) / 10,
+			Pan:    float32(i%7)/3 - 1,
+			FadeIn: mix.Tz(i % 20),
+		})
+	}
+	nested := NewSession(rate, false)
+	nested.AddRegion(Region{Source: getTestSource(2), Volume: 1})
+	s.AddRegion(Region{Source: nested, Begin: 5, Volume: 0.5})
+	s.SetMixPool(pool)
+	return s
+}
+
+func TestMixPool(t *testing.T) {
+	pool := NewMixPool(3, poolChunk)
+	defer pool.Close()
+
+	serial := getDenseSession(nil)
+	parallel := getDenseSession(pool)
+	again := getDenseSession(pool)
+	for off := mix.Tz(0); off < length*2; off += poolChunk / 4 {
+		for c := 0; c < numChannels; c++ {
+			s := serial.Samples(c, off, poolChunk/4)
+			p := parallel.Samples(c, off, poolChunk/4)
+			a := again.Samples(c, off, poolChunk/4)
+			for i := range s {
+				if math.Abs(float64(s[i]-p[i])) > 1e-4 {
+					t.Fatal("Parallel mix is different from serial at",
+						off+mix.Tz(i), s[i], p[i])
+				}
+				if p[i] != a[i] {
+					t.Fatal("Parallel mix is not reproducible at",
+						off+mix.Tz(i), p[i], a[i])
+				}
+			}
+		}
+	}
+	if parallel.Clone().(*Session).pool != nil {
+		t.Error("Clone shares MixPool")
+	}
+}
+
+func TestMixPoolAllocs(t *testing.T) {
+	pool := NewMixPool(3, poolChunk)
+	defer pool.Close()
+	// Goroutines take sudogs for channels from cache of their P, so use
+	// one P like testing.AllocsPerRun does.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	warmUp(pool)
+	s := getDenseSession(pool)
+	s.Preallocate(poolChunk)
+
+	// Even the first chunk must not allocate.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for pos := mix.Tz(0); pos < 100*poolChunk; pos += poolChunk {
+		s.SetPosition(pos % length)
+		s.Samples(0, pos%length, poolChunk)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.Mallocs - before.Mallocs; n != 0 {
+		t.Error("Mixing with pool allocates memory:", n)
+	}
+}
+
+func BenchmarkMixSerial(b *testing.B) { benchmarkMixPool(nil, b) }
+
+func BenchmarkMixPool(b *testing.B) {
+	pool := NewMixPool(3, poolChunk)
+	defer pool.Close()
+	benchmarkMixPool(pool, b)
+}
+
+func benchmarkMixPool(pool *MixPool, b *testing.B) {
+	s := getDenseSession(pool)
+	for n := 0; n < b.N; n++ {
+		s.SetPosition(0)
+		s.Samples(0, 0, poolChunk)
+	}
+}
@@ -5,24 +5,56 @@ import (
 
 	"errors"
 	"fmt"
-	"log"
+	"math"
 	"sort"
+	"sync/atomic"
 )
 
 // Session mixes collection of Regions. Output is done in 32-bit float WAV.
 // Session implements Source, so it could be nested.
+//
+// Regions are kept in immutable snapshot, that is replaced atomically
+// on every edit. So one goroutine may edit Session or Clone it, while other
+// one plays it: player never sees partly updated Session and never waits.
+// Clone shares regions with original and does not copy them.
 type Session struct {
 	sampleRate mix.Tz
-	pos        mix.Tz
-	length     mix.Tz
 	forgetPast bool
+	chunkSize  mix.Tz // size of preallocated buffers
+
+	// Editors reserve room for active regions before snapshot is published,
+	// so that player takes it from spare instead of allocating.
+	reserved int64        // capacity of active regions, accessed atomically
+	spare    atomic.Value // *regionBuffers
+
+	snap   atomic.Value // *snapshot
+	played int64        // end of last mixed chunk, position set by SetPosition or notPlayed, accessed atomically
+
+	// Playback state, owned by goroutine that reads samples.
+	pos      mix.Tz
+	cur      *snapshot // snapshot, that active regions are found in
+	active   []*preparedRegion
+	buffer   [numChannels]mix.Buffer
+	pool     *MixPool
+	parallel []*preparedRegion // regions mixed by pool in current chunk
+	err      error             // first error of seek or region sources
+}
+
+// snapshot is immutable state of Session regions.
+type snapshot struct {
+	root   *regionNode
+	length mix.Tz
+	seq    uint64 // number of inserted regions
 
-	buffer [numChannels]mix.Buffer
+	// Upper bound of number of regions, that are mixed in one chunk of
+	// chunkSize samples.
+	overlap   int
+	chunkSize mix.Tz
+}
 
-	//TODO: separate regions collection & implement as tree
-	regions []*preparedRegion
-	rPos    int
-	active  []*preparedRegion
+// regionBuffers are buffers of active regions, reserved for player.
+type regionBuffers struct {
+	active, parallel []*preparedRegion
 }
 
 // Region defines where and how Source audio (or its part) will be played.
@@ -34,29 +66,138 @@ type Region struct {
 	FadeIn, FadeOut mix.Tz     // Length of fades.
 }
 
-const numChannels = 2
+const (
+	numChannels = 2
+	notPlayed   = math.MinInt64
+)
 
 // NewSession creates Session with given sampleRate.
 func NewSession(sampleRate mix.Tz, forgetPast bool) *Session {
 	sess := &Session{
 		sampleRate: sampleRate,
 		forgetPast: forgetPast,
+		played:     notPlayed,
 	}
+	sess.snap.Store(&snapshot{})
 	return sess
 }
 
 // Returns shallow copy of Session.
 // Sources that are used in regions are not cloned.
+// Clone could be called concurrently with playing of Session.
+// Clone starts at position, where Session was last played or set.
+// Clone has no MixPool, because pool is not shared by Sessions.
 func (s *Session) Clone() mix.Source {
-	clone := *s
-	clone.regions = make([]*preparedRegion, len(s.regions))
-	copy(clone.regions, s.regions)
-	clone.active = make([]*preparedRegion, len(s.active))
-	copy(clone.active, s.active)
-	return &clone
+	clone := &Session{
+		sampleRate: s.sampleRate,
+		forgetPast: s.forgetPast,
+		played:     atomic.LoadInt64(&s.played),
+	}
+	clone.snap.Store(s.snapshot())
+	if clone.played != notPlayed {
+		clone.pos = mix.Tz(clone.played)
+	}
+	clone.allocate(s.chunkSize, int(atomic.LoadInt64(&s.reserved)))
+	// Active regions are found here, not by player.
+	clone.cur = clone.snapshot()
+	clone.cur.root.active(clone, clone.pos)
+	return clone
+}
+
+// Preallocate allocates buffers for mixing chunks of chunkSize samples,
+// so that playing does not allocate memory, and preallocates sources of
+// regions (see mix.Preallocator). Clones allocate their buffers too.
+// Later edits reserve room for their regions before they are published.
+func (s *Session) Preallocate(chunkSize mix.Tz) {
+	// All regions of one chunk must fit, so that append never grows.
+	s.allocate(chunkSize, s.snapshot().root.overlap(chunkSize))
+	s.snapshot().root.each(func(r *preparedRegion) {
+		if r.Src != nil {
+			mix.Preallocate(r.Src, chunkSize)
+		}
+	})
+}
+
+// allocate allocates own buffers of Session for chunks of chunkSize, where
+// up to size regions are mixed.
+func (s *Session) allocate(chunkSize mix.Tz, size int) {
+	s.chunkSize = chunkSize
+	if chunkSize > 0 {
+		s.allocateBuffer(chunkSize)
+		for c := range s.buffer {
+			s.buffer[c] = s.buffer[c][0:0]
+		}
+		if size < 16 {
+			size = 16
+		}
+		if cap(s.active) < size {
+			active := make([]*preparedRegion, len(s.active), size)
+			copy(active, s.active)
+			s.active = active
+		}
+		if cap(s.parallel) < size {
+			s.parallel = make([]*preparedRegion, 0, size)
+		}
+		atomic.StoreInt64(&s.reserved, int64(cap(s.active)))
+	}
+}
+
+// reserve makes sure, that regions of snapshot, which is not published yet,
+// fit into active regions of player. Exact overlap of regions is computed
+// only when its upper bound does not fit, and room is reserved twice
+// as large, so that it is rarely done.
+func (s *Session) reserve(snap *snapshot) {
+	if s.chunkSize <= 0 {
+		return
+	}
+	reserved := int(atomic.LoadInt64(&s.reserved))
+	if snap.chunkSize == s.chunkSize && snap.overlap <= reserved {
+		return
+	}
+	snap.overlap, snap.chunkSize = snap.root.overlap(s.chunkSize), s.chunkSize
+	if snap.overlap <= reserved {
+		return
+	}
+	size := 2 * snap.overlap
+	s.spare.Store(&regionBuffers{
+		active:   make([]*preparedRegion, 0, size),
+		parallel: make([]*preparedRegion, 0, size),
+	})
+	atomic.StoreInt64(&s.reserved, int64(size))
+}
+
+// grow takes buffers, that were reserved by editors, keeping active regions.
+func (s *Session) grow() {
+	spare, _ := s.spare.Swap((*regionBuffers)(nil)).(*regionBuffers)
+	if spare == nil {
+		return
+	}
+	if cap(spare.active) > cap(s.active) {
+		s.active = append(spare.active, s.active...)
+	}
+	if cap(spare.parallel) > cap(s.parallel) {
+		s.parallel = spare.parallel
+	}
+}
+
+func (s *Session) snapshot() *snapshot {
+	return s.snap.Load().(*snapshot)
+}
+
+// edit atomically replaces snapshot with result of f.
+// f may be called several times, if Session is edited concurrently.
+func (s *Session) edit(f func(old *snapshot) *snapshot) {
+	for {
+		old := s.snapshot()
+		if s.snap.CompareAndSwap(old, f(old)) {
+			return
+		}
+	}
 }
 
 // AddRegion adds region to the Session mix.
+// Region of unbounded Source with zero or Infinite Length is open-ended:
+// it never ends, so Session becomes unbounded too.
 func (s *Session) AddRegion(r Region) error {
 	if r.Source.SampleRate() != s.sampleRate {
 		return errors.New("Source sample rate is different from session")
@@ -64,16 +205,24 @@ func (s *Session) AddRegion(r Region) error {
 	if chans := r.Source.NumChannels(); chans < 1 || chans > 2 {
 		return errors.New("Only mono and stereo sources are supported")
 	}
+	orig := r
 
 	sLen := r.Source.Length()
 	if r.Offset > sLen || r.Offset < 0 {
 		return errors.New("Invalid offset")
 	}
-	if r.Length > sLen-r.Offset || r.Length < 0 {
+	openEnded := sLen == mix.Infinite && r.Length == mix.Infinite
+	if r.Length > sLen-r.Offset && !openEnded || r.Length < 0 {
 		return errors.New("Invalid length")
 	}
 	if r.Length == 0 {
 		r.Length = sLen - r.Offset
+		if sLen == mix.Infinite {
+			r.Length = mix.Infinite
+		}
+	}
+	if r.Length == mix.Infinite && r.FadeOut != 0 {
+		return errors.New("Open-ended region can't have fadeOut")
 	}
 
 	if r.FadeIn < 0 || r.FadeIn > r.Length {
@@ -87,8 +236,13 @@ func (s *Session) AddRegion(r Region) error {
 	}
 
 	end := r.Begin + r.Length
+	if r.Length == mix.Infinite {
+		end = mix.Infinite
+	}
+	var pieces []preparedRegion
 	if r.FadeIn > 0 {
 		fi := preparedRegion{
+			Reg:    &orig,
 			Src:    r.Source,
 			Beg:    r.Begin,
 			End:    r.Begin + r.FadeIn,
@@ -97,10 +251,11 @@ func (s *Session) AddRegion(r Region) error {
 			VolEnd: r.Volume,
 			Pan:    r.Pan,
 		}
-		s.insertRegion(fi)
+		pieces = append(pieces, fi)
 	}
-	if r.Begin+r.FadeIn != r.Begin+r.Length-r.FadeOut {
+	if r.FadeIn+r.FadeOut != r.Length {
 		sr := preparedRegion{
+			Reg:    &orig,
 			Src:    r.Source,
 			Beg:    r.Begin + r.FadeIn,
 			End:    end - r.FadeOut,
@@ -109,10 +264,11 @@ func (s *Session) AddRegion(r Region) error {
 			VolEnd: r.Volume,
 			Pan:    r.Pan,
 		}
-		s.insertRegion(sr)
+		pieces = append(pieces, sr)
 	}
 	if r.FadeOut > 0 {
 		fo := preparedRegion{
+			Reg:    &orig,
 			Src:    r.Source,
 			Beg:    end - r.FadeOut,
 			End:    end,
@@ -121,35 +277,59 @@ func (s *Session) AddRegion(r Region) error {
 			VolEnd: 0,
 			Pan:    r.Pan,
 		}
-		s.insertRegion(fo)
-	}
-
-	if s.length < end {
-		s.length = end
+		pieces = append(pieces, fo)
 	}
 
+	s.insert(end, pieces...)
 	return nil
 }
 
-func (s *Session) insertRegion(r preparedRegion) {
-	rLen := len(s.regions)
-	rPos := sort.Search(rLen, func(i int) bool {
-		return s.regions[i].Beg > r.Beg
+// insert publishes snapshot with regions added. Length of Session becomes
+// at least length. Forgetful Session also drops already played regions.
+func (s *Session) insert(length mix.Tz, regions ...preparedRegion) {
+	s.edit(func(old *snapshot) *snapshot {
+		res := *old
+		if s.forgetPast {
+			res.root = res.root.forget(mix.Tz(atomic.LoadInt64(&s.played)))
+		}
+		for i := range regions {
+			res.seq++
+			res.root = res.root.insert(&regionNode{r: &regions[i], seq: res.seq})
+		}
+		if res.length < length {
+			res.length = length
+		}
+		res.overlap += len(regions)
+		s.reserve(&res)
+		return &res
 	})
-	//log.Println("insert: regions=", s.regions, "r=", r, "rPos=", rPos)
-	if rPos < s.rPos || (rPos == s.rPos && r.Beg < s.pos) {
-		s.rPos++
-	}
-	s.regions = append(s.regions, &r)
-	if rPos < rLen {
-		copy(s.regions[rPos+1:], s.regions[rPos:])
-		s.regions[rPos] = &r
-	}
+}
 
-	if s.pos > r.Beg && s.pos < r.End {
-		//log.Println("insert: New active region", r)
-		s.active = append(s.active, &r)
-	}
+// Regions returns copy of regions as they were added to the Session,
+// sorted by Begin. Forgetful Session returns only regions that are not
+// completely played yet.
+func (s *Session) Regions() []Region {
+	var res []Region
+	seen := make(map[*Region]bool)
+	played := mix.Tz(atomic.LoadInt64(&s.played))
+	s.snapshot().root.each(func(r *preparedRegion) {
+		if s.forgetPast && r.End <= played {
+			return
+		}
+		if r.Reg != nil && !seen[r.Reg] {
+			seen[r.Reg] = true
+			res = append(res, *r.Reg)
+		}
+	})
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Begin < res[j].Begin
+	})
+	return res
+}
+
+// ForgetPast reports whether Session drops regions that were already played.
+func (s *Session) ForgetPast() bool {
+	return s.forgetPast
 }
 
 func (s *Session) mix(buffer [2]mix.Buffer) {
@@ -159,47 +339,26 @@ func (s *Session) mix(buffer [2]mix.Buffer) {
 	}
 	end := s.pos + length
 
-	// Add new active regions
-	for ; s.rPos < len(s.regions); s.rPos++ {
-		r := s.regions[s.rPos]
-		if r.Beg < end {
-			//log.Println("mix: New active region", r)
-			s.active = append(s.active, r)
-			if s.forgetPast {
-				s.regions[s.rPos] = nil
-			}
-		} else {
-			break
+	// Add active regions, that were inserted since last chunk
+	if snap := s.snapshot(); snap != s.cur {
+		s.grow()
+		var seq uint64
+		if s.cur != nil {
+			seq = s.cur.seq
 		}
+		snap.root.added(s, s.pos, seq)
+		s.cur = snap
 	}
-	if s.forgetPast {
-		if s.rPos > 0 {
-			//log.Printf("Session: %p GC regions: %d active %d\n", s, s.rPos, len(s.regions))
-		}
-		s.regions = s.regions[s.rPos:]
-		s.rPos = 0
-	}
+	// Add new active regions
+	s.cur.root.starting(s, s.pos, end)
 
 	// Mix active regions and filter completed
 	lastActive := 0
+	parallel := s.pool != nil && s.pool.fits(length)
+	if parallel {
+		s.parallel = s.parallel[0:0]
+	}
 	for _, r := range s.active {
-		var rOff, bOff mix.Tz
-		if r.Beg < s.pos {
-			rOff = s.pos - r.Beg
-		} else {
-			bOff = r.Beg - s.pos
-		}
-
-		rEnd := r.End
-		bEnd := end
-		if r.End < end {
-			bEnd = rEnd
-		} else {
-			rEnd = bEnd
-		}
-		rLen := rEnd - r.Beg - rOff
-		bEnd -= s.pos
-
 		if end < r.End {
 			s.active[lastActive] = r
 			lastActive++
@@ -208,58 +367,106 @@ func (s *Session) mix(buffer [2]mix.Buffer) {
 		if r.Src == nil {
 			continue
 		}
-
-		var gain [numChannels][numChannels]float32
-		schan := r.Src.NumChannels()
-		switch schan {
-		case 1:
-			gain[0][0], gain[0][1] = mix.PanMonoGain(r.Pan)
-		case 2:
-			gain[0][0], gain[0][1], gain[1][0], gain[1][1] = mix.PanStereoGain(r.Pan)
-		default:
-			panic("Invalid number of channels")
+		if parallel && mix.IsConcurrent(r.Src) {
+			s.parallel = append(s.parallel, r)
+			continue
 		}
+		s.setErr(mixRegion(r, buffer, s.pos, end))
+	}
+	if parallel {
+		s.setErr(s.pool.mix(s.parallel, buffer, s.pos, end))
+	}
+	s.active = s.active[0:lastActive]
+	s.pos += length
+	atomic.StoreInt64(&s.played, int64(s.pos))
+}
 
-		//log.Printf("Mixing region %v, pos=%v end=%v rOff=%v bOff=%v rEnd=%v bEnd=%v rLen=%v gain=%v\n", r, s.pos, end, rOff, bOff, rEnd, bEnd, rLen, gain)
+// Err returns the first error of Session: invalid seek or failure of region
+// source. Failed sources are mixed as silence.
+func (s *Session) Err() error {
+	return s.err
+}
 
-		for i := 0; i < schan; i++ {
-			src := r.Src.Samples(i, r.Off+rOff, rLen)
-			init, targ := r.VolBeg, r.VolEnd
+func (s *Session) setErr(err error) {
+	if s.err == nil && err != nil {
+		s.err = err
+	}
+}
 
-			if init != targ {
-				initsqr := init * init
-				coef := (targ*targ - initsqr) / float32(r.End-r.Beg)
-				init = initsqr + coef*float32(rOff)
-				targ = initsqr + coef*float32(rOff+rLen)
-			}
+// mixRegion mixes part of r that overlaps [pos, end) into buffer,
+// that starts at pos.
+func mixRegion(r *preparedRegion, buffer [numChannels]mix.Buffer,
+	pos, end mix.Tz) error {
+
+	var rOff, bOff mix.Tz
+	if r.Beg < pos {
+		rOff = pos - r.Beg
+	} else {
+		bOff = r.Beg - pos
+	}
+
+	rEnd := r.End
+	bEnd := end
+	if r.End < end {
+		bEnd = rEnd
+	} else {
+		rEnd = bEnd
+	}
+	rLen := rEnd - r.Beg - rOff
+	bEnd -= pos
+
+	var gain [numChannels][numChannels]float32
+	schan := r.Src.NumChannels()
+	switch schan {
+	case 1:
+		gain[0][0], gain[0][1] = mix.PanMonoGain(r.Pan)
+	case 2:
+		gain[0][0], gain[0][1], gain[1][0], gain[1][1] = mix.PanStereoGain(r.Pan)
+	default:
+		return fmt.Errorf("Region %v: invalid number of channels %d", r, schan)
+	}
+
+	//log.Printf("Mixing region %v, pos=%v end=%v rOff=%v bOff=%v rEnd=%v bEnd=%v rLen=%v gain=%v\n", r, pos, end, rOff, bOff, rEnd, bEnd, rLen, gain)
 
-			for j := 0; j < numChannels; j++ {
-				dst := buffer[j][bOff:bEnd]
-				assert(len(src) == len(dst))
-				if init == targ {
-					g := init * gain[i][j]
-					switch {
-					case g == 1:
-						dst.Mix(src)
-					case g < 1e-8:
-						//do nothing
-					default:
-						dst.MixGain(src, g)
-					}
-				} else {
-					g := gain[i][j] * gain[i][j]
-					dst.MixSqrtRamp(src, g*init, g*targ)
+	for i := 0; i < schan; i++ {
+		src := r.Src.Samples(i, r.Off+rOff, rLen)
+		init, targ := r.VolBeg, r.VolEnd
+
+		if init != targ {
+			initsqr := init * init
+			coef := (targ*targ - initsqr) / float32(r.End-r.Beg)
+			init = initsqr + coef*float32(rOff)
+			targ = initsqr + coef*float32(rOff+rLen)
+		}
+
+		for j := 0; j < numChannels; j++ {
+			dst := buffer[j][bOff:bEnd]
+			assert(len(src) == len(dst))
+			if init == targ {
+				g := init * gain[i][j]
+				switch {
+				case g == 1:
+					dst.Mix(src)
+				case g < 1e-8:
+					//do nothing
+				default:
+					dst.MixGain(src, g)
 				}
+			} else {
+				g := gain[i][j] * gain[i][j]
+				dst.MixSqrtRamp(src, g*init, g*targ)
 			}
 		}
 	}
-	s.active = s.active[0:lastActive]
-	s.pos += length
+	if err := mix.SourceErr(r.Src); err != nil {
+		return fmt.Errorf("Region %v: %v", r, err)
+	}
+	return nil
 }
 
 // Length returns end of last region in Session
 func (s *Session) Length() mix.Tz {
-	return s.length
+	return s.snapshot().length
 }
 
 // NumChannels returns number of channels in Session
@@ -278,37 +485,36 @@ func (s *Session) Samples(channel int, offset, length mix.Tz) mix.Buffer {
 
 	s.SetPosition(offset)
 	buf := s.allocateBuffer(length)
+	if s.pos != offset {
+		// Seek failed, return silence.
+		return buf[channel]
+	}
 	s.mix(buf)
 	return buf[channel]
 }
 
-// SetPosition sets current Session position.
+// SetPosition sets current Session position. Rewind of forgetful Session
+// is ignored and reported by Err.
 func (s *Session) SetPosition(pos mix.Tz) {
 	if s.pos == pos {
 		return
 	}
 	if pos < s.pos && s.forgetPast {
-		log.Fatalf("Rewind of forgetful session %d < %d", pos, s.pos)
+		s.setErr(fmt.Errorf("Rewind of forgetful session %d < %d", pos, s.pos))
+		return
 	}
 	s.pos = pos
+	atomic.StoreInt64(&s.played, int64(pos))
 
 	// Shrink buffer for fast path in Samples()
 	for c := range s.buffer {
 		s.buffer[c] = s.buffer[c][0:0]
 	}
 
-	//Simple linear algorithm, interval tree will do it in log(n)
+	s.grow()
+	s.cur = s.snapshot()
 	s.active = s.active[0:0]
-	for s.rPos = 0; s.rPos < len(s.regions); s.rPos++ {
-		r := s.regions[s.rPos]
-		if pos <= r.Beg {
-			break
-		}
-		if pos < r.End {
-			s.active = append(s.active, r)
-			//log.Println("SetPosition: New active region", r)
-		}
-	}
+	s.cur.root.active(s, pos)
 }
 
 // Position returns current Session position.
@@ -335,6 +541,7 @@ func (s *Session) allocateBuffer(length mix.Tz) [2]mix.Buffer {
 
 // Immutable region info with precomputed values
 type preparedRegion struct {
+	Reg                 *Region // Region as it was added, nil for internal ones
 	Src                 mix.Source
 	Beg, End, Off       mix.Tz
 	VolBeg, VolEnd, Pan float32
@@ -1,7 +1,10 @@
 package session
 
 import (
+	"errors"
 	"github.com/kikht/mix"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -52,63 +55,64 @@ func TestAddRegion(t *testing.T) {
 	if err != nil {
 		t.Error("error while adding region", err)
 	}
-	if len(s.regions) != 1 {
-		t.Error("invalid number of regions", len(s.regions))
+	if n := len(regionList(s)); n != 1 {
+		t.Error("invalid number of regions", n)
 	}
-	if len(s.active) != 0 {
-		t.Error("invalid number of active regions", len(s.active))
+	if n := numActive(s); n != 0 {
+		t.Error("invalid number of active regions", n)
 	}
-	if s.rPos != 0 {
-		t.Error("invalid rPos", s.rPos)
+	if n := numStarting(s); n != 1 {
+		t.Error("invalid number of starting regions", n)
 	}
 
 	err = s.AddRegion(Region{Source: src, Begin: -length, Volume: 1})
 	if err != nil {
 		t.Error("error while adding region", err)
 	}
-	if len(s.regions) != 2 {
-		t.Error("invalid number of regions", len(s.regions))
+	if n := len(regionList(s)); n != 2 {
+		t.Error("invalid number of regions", n)
 	}
-	if len(s.active) != 0 {
-		t.Error("invalid number of active regions", len(s.active))
+	if n := numActive(s); n != 0 {
+		t.Error("invalid number of active regions", n)
 	}
-	if s.rPos != 1 {
-		t.Error("invalid rPos", s.rPos)
+	if n := numStarting(s); n != 1 {
+		t.Error("invalid number of starting regions", n)
 	}
 
 	err = s.AddRegion(Region{Source: src, Begin: 0, Volume: 1})
 	if err != nil {
 		t.Error("error while adding region", err)
 	}
-	if len(s.regions) != 3 {
-		t.Error("invalid number of regions", len(s.regions))
+	if n := len(regionList(s)); n != 3 {
+		t.Error("invalid number of regions", n)
 	}
-	if len(s.active) != 0 {
-		t.Error("invalid number of active regions", len(s.active))
+	if n := numActive(s); n != 0 {
+		t.Error("invalid number of active regions", n)
 	}
-	if s.rPos != 1 {
-		t.Error("invalid rPos", s.rPos)
+	if n := numStarting(s); n != 2 {
+		t.Error("invalid number of starting regions", n)
 	}
 
 	err = s.AddRegion(Region{Source: src, Begin: -length / 2, Volume: 1})
 	if err != nil {
 		t.Error("error while adding region", err)
 	}
-	if len(s.regions) != 4 {
-		t.Error("invalid number of regions", len(s.regions))
+	if n := len(regionList(s)); n != 4 {
+		t.Error("invalid number of regions", n)
 	}
-	if len(s.active) != 1 {
-		t.Error("invalid number of active regions", len(s.active))
+	if n := numActive(s); n != 1 {
+		t.Error("invalid number of active regions", n)
 	}
-	if s.rPos != 2 {
-		t.Error("invalid rPos", s.rPos)
+	if n := numStarting(s); n != 2 {
+		t.Error("invalid number of starting regions", n)
 	}
 
-	prev := s.regions[0].Beg
-	for _, r := range s.regions[1:] {
+	regions := regionList(s)
+	prev := regions[0].Beg
+	for _, r := range regions[1:] {
 		cur := r.Beg
 		if cur < prev {
-			t.Error("regions are not sorted", s.regions)
+			t.Error("regions are not sorted", regions)
 			break
 		}
 		prev = cur
@@ -124,24 +128,27 @@ func TestSetPosition(t *testing.T) {
 	if len(s.active) != 0 {
 		t.Error("invalid number of active regions", len(s.active))
 	}
-	if s.rPos != 1 {
-		t.Error("invalid rPos", s.rPos)
+	if n := numStarting(s); n != 0 {
+		t.Error("invalid number of starting regions", n)
 	}
 
 	s.SetPosition(0)
 	if len(s.active) != 0 {
 		t.Error("invalid number of active regions", len(s.active))
 	}
-	if s.rPos != 0 {
-		t.Error("invalid rPos", s.rPos)
+	if n := numStarting(s); n != 1 {
+		t.Error("invalid number of starting regions", n)
 	}
 
 	s.SetPosition(length / 2)
 	if len(s.active) != 1 {
 		t.Error("invalid number of active regions", len(s.active))
 	}
-	if s.rPos != 1 {
-		t.Error("invalid rPos", s.rPos)
+	if n := numStarting(s); n != 0 {
+		t.Error("invalid number of starting regions", n)
+	}
+	if pos := s.Clone().(*Session).Position(); pos != length/2 {
+		t.Error("Clone ignores position, that is not played yet", pos)
 	}
 }
 
@@ -326,7 +333,7 @@ func TestFade(t *testing.T) {
 		FadeOut: length / 2,
 	})
 
-	if len(s.regions) != 2 {
+	if len(regionList(s)) != 2 {
 		t.Error("Invalid number of regions")
 	}
 
@@ -425,3 +432,180 @@ func getTestSource(channels int) mix.Source {
 	}
 	return res
 }
+
+// warmUp mixes mono, stereo and nested regions many times, because runtime
+// fills type assertion caches only on about every 1024th call and less often,
+// as they grow (see runtime.typeAssert). There are enough regions to start
+// workers of small pool, that may be nil. So allocation tests could check
+// the first chunks.
+func warmUp(pool *MixPool) {
+	nested := NewSession(rate, false)
+	nested.AddRegion(Region{Source: getTestSource(2), Volume: 1})
+	s := NewSession(rate, false)
+	for i := 0; i < 16; i++ {
+		s.AddRegion(Region{Source: nested, Volume: 1})
+		s.AddRegion(Region{Source: getTestSource(1), Volume: 1})
+	}
+	s.SetMixPool(pool)
+	s.Preallocate(16)
+	for i := 0; i < 20000; i++ {
+		s.Samples(0, mix.Tz(i%6)*16, 16)
+	}
+}
+
+func TestForgetfulRewind(t *testing.T) {
+	s := NewSession(rate, true)
+	s.AddRegion(Region{Source: getTestSource(1), Begin: 0, Volume: 1})
+	s.Samples(0, 0, length/2)
+	if s.Err() != nil {
+		t.Fatal("Unexpected error", s.Err())
+	}
+
+	buf := s.Samples(0, 0, length/4)
+	if s.Err() == nil {
+		t.Error("Rewind of forgetful session is not reported")
+	}
+	if s.Position() != length/2 {
+		t.Error("Position is changed by rewind", s.Position())
+	}
+	for _, v := range buf {
+		if v != 0 {
+			t.Error("Failed seek returned non-silent data", buf)
+			break
+		}
+	}
+	if s.Clone().(*Session).Err() != nil {
+		t.Error("Clone keeps error of original session")
+	}
+}
+
+type failingSource struct {
+	mix.Source
+	err error
+}
+
+func (f failingSource) Err() error {
+	return f.err
+}
+
+func TestSourceError(t *testing.T) {
+	fail := errors.New("fail")
+	nested := NewSession(rate, false)
+	nested.AddRegion(Region{Source: getTestSource(1), Volume: 1})
+	nested.AddRegion(Region{
+		Source: failingSource{getTestSource(2), fail},
+		Begin:  length / 2,
+		Volume: 1,
+	})
+
+	s := NewSession(rate, false)
+	s.AddRegion(Region{Source: nested, Volume: 1})
+	s.Samples(0, 0, length/2)
+	if s.Err() != nil {
+		t.Fatal("Error is reported before failing region", s.Err())
+	}
+	s.Samples(0, length/2, length/2)
+	if err := s.Err(); err == nil || !strings.Contains(err.Error(), "fail") {
+		t.Error("Error of nested source is not propagated:", err)
+	}
+}
+
+func TestOpenEndedRegion(t *testing.T) {
+	s := NewSession(rate, true)
+	err := s.AddRegion(Region{Source: mix.Loop(getTestSource(1)), Volume: 1})
+	if err != nil {
+		t.Fatal("Error while adding open-ended region", err)
+	}
+	err = s.AddRegion(Region{Source: mix.Loop(getTestSource(1)), Offset: 3,
+		Length: mix.Infinite, Volume: 1})
+	if err != nil {
+		t.Fatal("Infinite length with offset is rejected:", err)
+	}
+	err = s.AddRegion(Region{Source: getTestSource(1), Length: mix.Infinite, Volume: 1})
+	if err == nil {
+		t.Error("Infinite length of bounded source is accepted")
+	}
+	if s.Length() != mix.Infinite {
+		t.Error("Session with open-ended region is bounded", s.Length())
+	}
+	for off := mix.Tz(0); off < 100*length; off += length {
+		if buf := s.Samples(0, off, length); buf[length-1] == 0 {
+			t.Fatal("Open-ended region is not playing at", off)
+		}
+	}
+}
+
+func TestEndlessMusic(t *testing.T) {
+	const fade = length / 4
+	next := mix.Loop(getTestSource(1))
+	mus := mix.Loop(getTestSource(2))
+	cur := NewAmbience(next, fade, length).Mutate(nil, 0)
+	res := NewMusic(mus, next, fade, length).Mutate(cur, 2*length)
+	if res.Length() != mix.Infinite {
+		t.Error("Session with endless music is bounded", res.Length())
+	}
+	s := res.(*Session)
+	for off := 2 * length; off < 100*length; off += length {
+		s.Samples(0, mix.Tz(off), length)
+	}
+	if len(s.active) != 1 || s.active[0].Src != mus {
+		t.Error("Only music must play", s.active)
+	}
+}
+
+func TestActionAllocs(t *testing.T) {
+	// Mixing is repeated to warm up type assertion caches (see warmUp).
+	for i := 0; i < 1000; i++ {
+		mixAction()
+	}
+	if n := mixAction(); n != 0 {
+		t.Error("Mixing of action session allocates memory:", n)
+	}
+}
+
+// mixAction mixes crossfade of action sessions and returns number of
+// allocations while mixing.
+func mixAction() uint64 {
+	const fade = length / 4
+	cur := NewAmbience(mix.Loop(getTestSource(1)), fade, length).Mutate(nil, 0)
+	for off := mix.Tz(0); off < 2*length; off += length {
+		cur.Samples(0, off, length)
+		cur.Samples(1, off, length)
+	}
+	next := mix.Loop(getTestSource(1))
+	res := NewMusic(mix.Loop(getTestSource(2)), next, fade, length).Mutate(cur, 2*length)
+
+	// Loops are wrapped inside of chunks.
+	const chunk = length * 3 / 10
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for off := mix.Tz(2 * length); off < 10*length; off += chunk {
+		res.Samples(0, off, chunk)
+		res.Samples(1, off, chunk)
+	}
+	runtime.ReadMemStats(&after)
+	return after.Mallocs - before.Mallocs
+}
+
+// regionList returns regions of current snapshot in order.
+func regionList(s *Session) []*preparedRegion {
+	var res []*preparedRegion
+	s.snapshot().root.each(func(r *preparedRegion) {
+		res = append(res, r)
+	})
+	return res
+}
+
+// numActive returns number of regions, that are playing at current position.
+func numActive(s *Session) int {
+	var a Session
+	s.snapshot().root.active(&a, s.pos)
+	return len(a.active)
+}
+
+// numStarting returns number of regions, that begin at or after current position.
+func numStarting(s *Session) int {
+	var a Session
+	s.snapshot().root.starting(&a, s.pos, mix.Infinite)
+	return len(a.active)
+}
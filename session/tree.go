@@ -0,0 +1,193 @@
+package session
+
+import (
+	"github.com/kikht/mix"
+
+	"sort"
+)
+
+// regionNode is a node of persistent treap of regions ordered by Beg and
+// insertion order. Nodes are never modified after they are published, every
+// change copies path from root to changed node, so different versions of
+// tree share all other nodes. Each node keeps minimal and maximal End of
+// its subtree to find active and completed regions quickly, and maximal
+// seq to find regions inserted after given one.
+type regionNode struct {
+	r              *preparedRegion
+	seq            uint64 // insertion order, also defines treap priority
+	left, right    *regionNode
+	minEnd, maxEnd mix.Tz
+	maxSeq         uint64
+}
+
+func (n *regionNode) priority() uint64 {
+	// Fibonacci hashing gives well mixed priorities for sequential numbers.
+	return n.seq * 0x9E3779B97F4A7C15
+}
+
+func (n *regionNode) less(o *regionNode) bool {
+	if n.r.Beg != o.r.Beg {
+		return n.r.Beg < o.r.Beg
+	}
+	return n.seq < o.seq
+}
+
+// copy returns unpublished copy of n with given children.
+func (n *regionNode) copy(left, right *regionNode) *regionNode {
+	c := &regionNode{r: n.r, seq: n.seq, left: left, right: right}
+	c.update()
+	return c
+}
+
+func (n *regionNode) update() {
+	n.minEnd, n.maxEnd = n.r.End, n.r.End
+	n.maxSeq = n.seq
+	for _, c := range [...]*regionNode{n.left, n.right} {
+		if c == nil {
+			continue
+		}
+		if c.maxSeq > n.maxSeq {
+			n.maxSeq = c.maxSeq
+		}
+		if c.minEnd < n.minEnd {
+			n.minEnd = c.minEnd
+		}
+		if c.maxEnd > n.maxEnd {
+			n.maxEnd = c.maxEnd
+		}
+	}
+}
+
+// insert returns new tree with leaf x added.
+func (n *regionNode) insert(x *regionNode) *regionNode {
+	if n == nil {
+		x.update()
+		return x
+	}
+	if x.less(n) {
+		left := n.left.insert(x)
+		if left.priority() > n.priority() {
+			// Rotate right, left is a fresh copy.
+			left.right = n.copy(left.right, n.right)
+			left.update()
+			return left
+		}
+		return n.copy(left, n.right)
+	}
+	right := n.right.insert(x)
+	if right.priority() > n.priority() {
+		right.left = n.copy(n.left, right.left)
+		right.update()
+		return right
+	}
+	return n.copy(n.left, right)
+}
+
+// merge joins trees a and b, where all regions of a are less than ones of b.
+func merge(a, b *regionNode) *regionNode {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.priority() > b.priority():
+		return a.copy(a.left, merge(a.right, b))
+	default:
+		return b.copy(merge(a, b.left), b.right)
+	}
+}
+
+// forget returns tree without regions, that end before or at pos.
+// Unchanged subtrees are shared.
+func (n *regionNode) forget(pos mix.Tz) *regionNode {
+	if n == nil || n.minEnd > pos {
+		return n
+	}
+	left, right := n.left.forget(pos), n.right.forget(pos)
+	if n.r.End <= pos {
+		return merge(left, right)
+	}
+	if left == n.left && right == n.right {
+		return n
+	}
+	return n.copy(left, right)
+}
+
+// active appends to s.active regions, that are playing at pos:
+// Beg < pos < End.
+func (n *regionNode) active(s *Session, pos mix.Tz) {
+	if n == nil || n.maxEnd <= pos {
+		return
+	}
+	n.left.active(s, pos)
+	if n.r.Beg >= pos {
+		return
+	}
+	if n.r.End > pos {
+		s.active = append(s.active, n.r)
+	}
+	n.right.active(s, pos)
+}
+
+// added appends to s.active regions, that are playing at pos and were
+// inserted after seq. Only paths to such regions are visited.
+func (n *regionNode) added(s *Session, pos mix.Tz, seq uint64) {
+	if n == nil || n.maxSeq <= seq || n.maxEnd <= pos {
+		return
+	}
+	n.left.added(s, pos, seq)
+	if n.r.Beg >= pos {
+		return
+	}
+	if n.seq > seq && n.r.End > pos {
+		s.active = append(s.active, n.r)
+	}
+	n.right.added(s, pos, seq)
+}
+
+// starting appends to s.active regions, that begin in [pos, end).
+func (n *regionNode) starting(s *Session, pos, end mix.Tz) {
+	if n == nil {
+		return
+	}
+	if n.r.Beg >= pos {
+		n.left.starting(s, pos, end)
+		if n.r.Beg >= end {
+			return
+		}
+		s.active = append(s.active, n.r)
+	}
+	n.right.starting(s, pos, end)
+}
+
+// overlap returns maximal number of regions, that are mixed in one chunk
+// of given length: Beg < pos+length and End > pos.
+func (n *regionNode) overlap(length mix.Tz) int {
+	var begs, ends []mix.Tz
+	n.each(func(r *preparedRegion) {
+		begs = append(begs, r.Beg-length+1)
+		ends = append(ends, r.End)
+	})
+	sort.Slice(ends, func(i, j int) bool { return ends[i] < ends[j] })
+	res, cur, j := 0, 0, 0
+	for _, beg := range begs {
+		for ; j < len(ends) && ends[j] <= beg; j++ {
+			cur--
+		}
+		cur++
+		if cur > res {
+			res = cur
+		}
+	}
+	return res
+}
+
+// each calls f for every region in order.
+func (n *regionNode) each(f func(r *preparedRegion)) {
+	if n == nil {
+		return
+	}
+	n.left.each(f)
+	f(n.r)
+	n.right.each(f)
+}
@@ -0,0 +1,235 @@
+package session
+
+import (
+	"github.com/kikht/mix"
+
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func checkTree(t *testing.T, n *regionNode) {
+	t.Helper()
+	var prev *regionNode
+	var walk func(n *regionNode)
+	walk = func(n *regionNode) {
+		if n == nil {
+			return
+		}
+		walk(n.left)
+		if prev != nil && n.less(prev) {
+			t.Fatal("Regions are not sorted", prev.r, n.r)
+		}
+		prev = n
+		for _, c := range [...]*regionNode{n.left, n.right} {
+			if c == nil {
+				continue
+			}
+			if c.priority() > n.priority() {
+				t.Fatal("Heap property is broken at", n.r)
+			}
+			if c.minEnd < n.minEnd || c.maxEnd > n.maxEnd {
+				t.Fatal("Invalid End bounds at", n.r)
+			}
+		}
+		walk(n.right)
+	}
+	walk(n)
+}
+
+func TestRegionTree(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var root *regionNode
+	var versions []*regionNode
+	for i := 0; i < 1000; i++ {
+		beg := mix.Tz(rnd.Intn(10000))
+		r := &preparedRegion{Beg: beg, End: beg + 1 + mix.Tz(rnd.Intn(500))}
+		root = root.insert(&regionNode{r: r, seq: uint64(i + 1)})
+		if i%100 == 0 {
+			versions = append(versions, root)
+		}
+	}
+	checkTree(t, root)
+
+	// Old versions are not changed by new inserts.
+	for i, v := range versions {
+		count := 0
+		v.each(func(*preparedRegion) { count++ })
+		if count != i*100+1 {
+			t.Error("Version", i, "has", count, "regions")
+		}
+	}
+
+	for _, pos := range []mix.Tz{-1, 0, 777, 5000, 10499} {
+		var s Session
+		root.active(&s, pos)
+		expect := 0
+		root.each(func(r *preparedRegion) {
+			if r.Beg < pos && pos < r.End {
+				expect++
+			}
+		})
+		if len(s.active) != expect {
+			t.Error("Invalid number of active regions at", pos, len(s.active), expect)
+		}
+
+		// Regions of versions[5] have seq up to 501.
+		old := make(map[*preparedRegion]bool)
+		versions[5].each(func(r *preparedRegion) { old[r] = true })
+		expect = 0
+		root.each(func(r *preparedRegion) {
+			if !old[r] && r.Beg < pos && pos < r.End {
+				expect++
+			}
+		})
+		s.active = nil
+		root.added(&s, pos, 501)
+		if len(s.active) != expect {
+			t.Error("Invalid number of added regions at", pos, len(s.active), expect)
+		}
+
+		s.active = nil
+		root.starting(&s, pos, pos+100)
+		for _, r := range s.active {
+			if r.Beg < pos || r.Beg >= pos+100 {
+				t.Error("Invalid starting region", r, "at", pos)
+			}
+		}
+	}
+
+	forgotten := root.forget(5000)
+	checkTree(t, forgotten)
+	forgotten.each(func(r *preparedRegion) {
+		if r.End <= 5000 {
+			t.Fatal("Region is not forgotten", r)
+		}
+	})
+	if forgotten.forget(5000) != forgotten {
+		t.Error("Forget without changes copies tree")
+	}
+}
+
+func TestCloneSharesRegions(t *testing.T) {
+	s := NewSession(rate, false)
+	for i := 0; i < 100; i++ {
+		s.AddRegion(Region{Source: getTestSource(1), Begin: mix.Tz(i), Volume: 1})
+	}
+	clone := s.Clone().(*Session)
+	if clone.snapshot() != s.snapshot() {
+		t.Error("Clone does not share regions snapshot")
+	}
+	clone.AddRegion(Region{Source: getTestSource(1), Begin: 50, Volume: 1})
+	if len(regionList(s)) != 100 || len(regionList(clone)) != 101 {
+		t.Error("Edit of clone changed original")
+	}
+}
+
+// getOverlappedSession returns Session, where up to 23 regions are mixed
+// in one chunk of 16 samples.
+func getOverlappedSession() *Session {
+	s := NewSession(rate, false)
+	for i := 0; i < 40; i++ {
+		s.AddRegion(Region{Source: getTestSource(1), Begin: mix.Tz(5 * i), Volume: 1})
+	}
+	return s
+}
+
+func TestPreallocateOverlap(t *testing.T) {
+	const chunk = 16
+	s := getOverlappedSession()
+	if n := s.snapshot().root.overlap(chunk); n != 23 {
+		t.Error("Invalid overlap of regions", n)
+	}
+	s.Preallocate(chunk)
+	warmUp(nil)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for pos := mix.Tz(0); pos < 300+length; pos += chunk {
+		s.Samples(0, pos, chunk)
+		s.Samples(1, pos, chunk)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.Mallocs - before.Mallocs; n != 0 {
+		t.Error("Mixing of overlapped regions allocates memory:", n)
+	}
+}
+
+func TestEditAllocs(t *testing.T) {
+	// Editing is repeated to warm up type assertion caches (see warmUp).
+	warmUp(nil)
+	for i := 0; i < 100; i++ {
+		mixEdited()
+	}
+	s, mallocs := mixEdited()
+	if mallocs != 0 {
+		t.Error("Mixing of edited session allocates memory:", mallocs)
+	}
+	if len(regionList(s)) != 40 {
+		t.Error("Invalid number of regions", len(regionList(s)))
+	}
+}
+
+// mixEdited mixes session, while regions are added to it, and returns number
+// of allocations while mixing.
+func mixEdited() (*Session, uint64) {
+	const chunk = 16
+	s := NewSession(rate, false)
+	s.Preallocate(chunk)
+
+	var before, after runtime.MemStats
+	var mallocs uint64
+	next := 0
+	for pos := mix.Tz(0); pos < 300+length; pos += chunk {
+		// Regions are added while playing, up to 23 in one chunk.
+		for ; next < 40 && mix.Tz(5*next) < pos+chunk; next++ {
+			s.AddRegion(Region{Source: getTestSource(1), Begin: mix.Tz(5 * next), Volume: 1})
+		}
+		runtime.ReadMemStats(&before)
+		s.Samples(0, pos, chunk)
+		s.Samples(1, pos, chunk)
+		runtime.ReadMemStats(&after)
+		mallocs += after.Mallocs - before.Mallocs
+	}
+	return s, mallocs
+}
+
+func TestConcurrentEdit(t *testing.T) {
+	const chunk = 16
+	s := NewSession(rate, true)
+	s.Preallocate(chunk)
+	s.AddRegion(Region{Source: mix.Loop(getTestSource(2)), Volume: 0.5})
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			pos := mix.Tz(atomic.LoadInt64(&s.played))
+			if pos < 0 {
+				pos = 0
+			}
+			s.AddRegion(Region{Source: getTestSource(1), Begin: pos + chunk, Volume: 1})
+			s.Clone().(*Session).AddRegion(Region{Source: getTestSource(1), Volume: 1})
+			s.Regions()
+		}
+	}()
+
+	for pos := mix.Tz(0); pos < 2000*chunk; pos += chunk {
+		s.Samples(0, pos, chunk)
+		s.Samples(1, pos, chunk)
+	}
+	close(done)
+	wg.Wait()
+	if s.Err() != nil {
+		t.Error("Unexpected error", s.Err())
+	}
+}
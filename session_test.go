@@ -2,6 +2,7 @@ package mix
 
 import (
 	"encoding/binary"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -144,6 +145,25 @@ func TestSetPosition(t *testing.T) {
 	}
 }
 
+func TestPreallocate(t *testing.T) {
+	const chunk = 16
+	s := NewSession(rate)
+	for i := 0; i < 40; i++ {
+		s.AddRegion(Region{Source: getTestSource(1), Begin: Tz(5 * i), Volume: 1})
+	}
+	if n := s.overlap(chunk); n != 23 {
+		t.Error("Invalid overlap of regions", n)
+	}
+	s.Preallocate(chunk)
+	active := cap(s.active)
+	for pos := Tz(0); pos < 300+length; pos += chunk {
+		s.Play(chunk)
+		if cap(s.active) != active {
+			t.Fatal("Active regions are reallocated at", pos)
+		}
+	}
+}
+
 func TestSilentSession(t *testing.T) {
 	s := NewSession(rate)
 
@@ -172,7 +192,7 @@ func TestSilentSession(t *testing.T) {
 		t.Error("Error while playing silent session:", err)
 	}
 
-	expectDataSize := uint32(length * blockAlign)
+	expectDataSize := uint32(length * numChannels * Float32.Bits() / 8)
 	expectRiffSize := uint32(riffHeaderSize + expectDataSize)
 	expectLen := int(expectRiffSize + 8)
 
@@ -461,3 +481,31 @@ func getTestSource(channels int) Source {
 	}
 	return res
 }
+
+type failingSource struct {
+	Source
+	err error
+}
+
+func (f failingSource) Err() error {
+	return f.err
+}
+
+func TestPlayError(t *testing.T) {
+	s := NewSession(rate)
+	s.AddRegion(Region{Source: getTestSource(1), Volume: 1})
+	s.AddRegion(Region{
+		Source: failingSource{getTestSource(1), errors.New("fail")},
+		Begin:  length,
+		Volume: 1,
+	})
+	if err := s.Play(length); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := s.Play(length); err == nil {
+		t.Error("Error of source is not returned by Play")
+	}
+	if s.Err() == nil {
+		t.Error("Error of source is not returned by Err")
+	}
+}
@@ -11,13 +11,13 @@ import "C"
 
 import (
 	"github.com/kikht/mix"
-
-	"github.com/rkusa/gm/math32"
+	"github.com/kikht/mix/output"
 
 	"errors"
 	"log"
 	"math"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -28,6 +28,8 @@ const (
 	srcBit      = 1
 	activeBit   = 2
 	numChannels = 2
+
+	sfmlBufferCount = 3 // number of chunks queued by sfSoundStream
 )
 
 func init() {
@@ -36,12 +38,21 @@ func init() {
 }
 
 type Stream struct {
+	id         int
 	state      *uint64
 	sampleRate mix.Tz
 	handle     *C.sfSoundStream
 	sources    [2]mix.Source
 	buffer     []int16
+	converted  [numChannels]mix.Buffer // samples after output stage
+	stage      *output.Stage
 	end        chan struct{}
+	err        atomic.Value // errValue of last error of played source
+}
+
+// errValue wraps errors of different types for atomic.Value.
+type errValue struct {
+	error
 }
 
 var (
@@ -50,11 +61,23 @@ var (
 )
 
 func NewStream(sampleRate mix.Tz) (*Stream, error) {
+	return NewOutputStream(sampleRate, output.Config{})
+}
+
+// NewOutputStream creates Stream, that converts samples by output stage
+// with cfg. Samples are always quantized to 16 bits.
+func NewOutputStream(sampleRate mix.Tz, cfg output.Config) (*Stream, error) {
+	cfg.Bits = 16
 	id := len(streams)
 	stream := &Stream{
+		id:         id,
 		state:      &stateArray[id],
 		sampleRate: sampleRate,
 		buffer:     make([]int16, numChannels*chunkSize),
+		stage:      output.New(cfg, numChannels),
+	}
+	for c := range stream.converted {
+		stream.converted[c] = mix.NewBuffer(chunkSize)
 	}
 	stream.handle = C.cgo_createStream(C.uint(numChannels), C.uint(sampleRate),
 		unsafe.Pointer(stream.state))
@@ -63,16 +86,21 @@ func NewStream(sampleRate mix.Tz) (*Stream, error) {
 	}
 	streams = append(streams, stream)
 	*stream.state = 0
-	//TODO: add destructor to finalize
 	return stream, nil
 }
 
+// streamOf returns Stream by pointer to its state.
+func streamOf(ptr unsafe.Pointer) *Stream {
+	id := (uintptr(ptr) - uintptr(unsafe.Pointer(&stateArray[0]))) /
+		unsafe.Sizeof(stateArray[0])
+	return streams[id]
+}
+
 //export onStreamChunk
 func onStreamChunk(chunk *C.sfSoundStreamChunk, ptr unsafe.Pointer) C.sfBool {
-	id := uintptr(ptr) - uintptr(unsafe.Pointer(&stateArray[0]))
 	statePtr := (*uint64)(ptr)
 	state := atomic.AddUint64(statePtr, chunkSize)
-	stream := streams[id]
+	stream := streamOf(ptr)
 
 	chunk.samples = (*C.sfInt16)(unsafe.Pointer(&stream.buffer[0]))
 	chunk.sampleCount = C.uint(numChannels * chunkSize)
@@ -90,32 +118,54 @@ func onStreamChunk(chunk *C.sfSoundStreamChunk, ptr unsafe.Pointer) C.sfBool {
 	buf := [2]mix.Buffer{
 		src.Samples(0, pos, chunkSize),
 		src.Samples(1, pos, chunkSize)}
+	if err := mix.SourceErr(src); err != nil {
+		log.Println("Error of stream", statePtr, pos, err)
+		stream.err.Store(errValue{err})
+		atomic.StoreUint64(statePtr, state&srcBit)
+		defer close(stream.end)
+		return C.sfFalse
+	}
+	for c := range buf {
+		stream.stage.Process(c, stream.converted[c], buf[c])
+	}
+	left, right := stream.converted[0], stream.converted[1]
 	for i := 0; i < chunkSize; i++ {
-		stream.buffer[2*i] = norm(buf[0][i])
-		stream.buffer[2*i+1] = norm(buf[1][i])
+		stream.buffer[2*i] = int16(left[i] * math.MaxInt16)
+		stream.buffer[2*i+1] = int16(right[i] * math.MaxInt16)
 	}
 	return C.sfTrue
 }
 
 //export onStreamSeek
-func onStreamSeek(time C.sfTime, ptr unsafe.Pointer) {
-	//id := data.(int)
-	//log.Println("Stream seek")
-	//newPos := int64(mix.DurationToTz(time, streams[id].sampleRate)) & posMask
-	//state := &stateArray[id]
-	//for {
-	//	orig := atomic.LoadUint64(state)
-	//	upd := newPos | (orig & stateMask)
-	//	if atomic.CompareAndSwapUint64(state, orig, upd) {
-	//		break
-	//	}
-	//}
+func onStreamSeek(offset C.sfTime, ptr unsafe.Pointer) {
+	d := time.Duration(offset.microseconds) * time.Microsecond
+	newPos := uint64(mix.DurationToTz(d, streamOf(ptr).sampleRate)) & posMask
+	state := (*uint64)(ptr)
+	for {
+		orig := atomic.LoadUint64(state)
+		upd := newPos | (orig &^ posMask)
+		if atomic.CompareAndSwapUint64(state, orig, upd) {
+			break
+		}
+	}
 }
 
+// End returns channel that is closed when played source ends or fails.
 func (s *Stream) End() <-chan struct{} {
 	return s.end
 }
 
+// Err returns the last error, that stopped the stream.
+func (s *Stream) Err() error {
+	err, _ := s.err.Load().(errValue)
+	return err.error
+}
+
+// Stage returns output stage of Stream, e.g. to check clipped samples.
+func (s *Stream) Stage() *output.Stage {
+	return s.stage
+}
+
 func (s *Stream) Play(src mix.Source) {
 	orig := atomic.LoadUint64(s.state)
 	//src bit must be changed only by controller thread
@@ -155,6 +205,47 @@ func (s *Stream) Switch(generator mix.SourceMutator) {
 	}
 }
 
+// Pause pauses SFML sound stream.
+func (s *Stream) Pause() {
+	C.sfSoundStream_pause(s.handle)
+}
+
+// Resume continues playing after Pause.
+func (s *Stream) Resume() {
+	C.sfSoundStream_play(s.handle)
+}
+
+// Seek moves position of played source to pos, rounded down to chunk.
+// SFML drops queued buffers and calls onStreamSeek.
+func (s *Stream) Seek(pos mix.Tz) {
+	us := pos * mix.Tz(time.Second/time.Microsecond) / s.sampleRate
+	C.sfSoundStream_setPlayingOffset(s.handle,
+		C.sfTime{microseconds: C.sfInt64(us)})
+}
+
+// Stop fades out played source during fade samples, then stream stops
+// and closes End channel.
+func (s *Stream) Stop(fade mix.Tz) {
+	if atomic.LoadUint64(s.state)&activeBit == 0 {
+		return
+	}
+	s.Switch(mix.SourceMutatorFunc(func(cur mix.Source, pos mix.Tz) mix.Source {
+		return mix.FadeOut(cur, pos, fade)
+	}))
+}
+
+// Close stops and destroys SFML sound stream.
+func (s *Stream) Close() error {
+	if s.handle == nil {
+		return errors.New("Stream is already closed")
+	}
+	C.sfSoundStream_stop(s.handle)
+	C.sfSoundStream_destroy(s.handle)
+	s.handle = nil
+	streams[s.id] = nil
+	return nil
+}
+
 func (s *Stream) ChunkSize() mix.Tz {
 	return chunkSize
 }
@@ -164,11 +255,21 @@ func (s *Stream) State() (mix.Source, mix.Tz) {
 	return s.sources[state&srcBit], mix.Tz(state & posMask)
 }
 
-func (s *Stream) SampleRate() mix.Tz {
-	return s.sampleRate
+// Position returns position of played samples according to buffers
+// queued in SFML.
+func (s *Stream) Position() mix.Tz {
+	_, pos := s.State()
+	if pos < s.Latency() {
+		return 0
+	}
+	return pos - s.Latency()
+}
+
+// Latency returns size of buffers queued in SFML.
+func (s *Stream) Latency() mix.Tz {
+	return sfmlBufferCount * chunkSize
 }
 
-// simple limiter
-func norm(v float32) int16 {
-	return int16(math.MaxInt16 * v / (1 + math32.Abs(v)))
+func (s *Stream) SampleRate() mix.Tz {
+	return s.sampleRate
 }
@@ -1,6 +1,7 @@
 package mix
 
 import (
+	"math"
 	"time"
 )
 
@@ -16,8 +17,74 @@ type Source interface {
 	Clone() Source
 }
 
+// ConcurrentSource is implemented by Sources, that may report whether their
+// Samples method is safe for use from several goroutines at once.
+type ConcurrentSource interface {
+	Source
+	Concurrent() bool
+}
+
+// IsConcurrent reports whether Samples of src could be called from several
+// goroutines at once. MemSource is always concurrent.
+func IsConcurrent(src Source) bool {
+	switch s := src.(type) {
+	case MemSource:
+		return true
+	case ConcurrentSource:
+		return s.Concurrent()
+	}
+	return false
+}
+
+// ErrorSource is implemented by Sources, that may fail to provide samples,
+// e.g. when they are streamed from disk or network. On failure Samples
+// returns silence and Err reports the first error that happened.
+type ErrorSource interface {
+	Source
+	Err() error
+}
+
+// SourceErr returns error of src, if it implements ErrorSource.
+func SourceErr(src Source) error {
+	if s, ok := src.(ErrorSource); ok {
+		return s.Err()
+	}
+	return nil
+}
+
+// Preallocator is implemented by Sources, that could allocate their buffers
+// in advance, so that reading chunks up to chunkSize samples does not
+// allocate memory. Sources with nested Sources preallocate them too, so
+// Preallocate must not be called while Source or its parts are played.
+type Preallocator interface {
+	Preallocate(chunkSize Tz)
+}
+
+// Preallocate calls src.Preallocate, if src implements Preallocator.
+func Preallocate(src Source, chunkSize Tz) {
+	if p, ok := src.(Preallocator); ok {
+		p.Preallocate(chunkSize)
+	}
+}
+
+// DeepCloner is implemented by Sources with nested Sources, e.g. adapters.
+// DeepClone is Clone, that clones nested Sources with clone, so that nested
+// Sessions are cloned with their regions (see RenderParallel).
+type DeepCloner interface {
+	DeepClone(clone func(Source) Source) Source
+}
+
+// IsUnbounded reports whether src has Infinite length.
+func IsUnbounded(src Source) bool {
+	return src.Length() == Infinite
+}
+
 // Duration returns Length() of Source as time.Duration according to its SampleRate()
+// Unbounded Source has maximum duration.
 func SourceDuration(s Source) time.Duration {
+	if IsUnbounded(s) {
+		return time.Duration(math.MaxInt64)
+	}
 	return time.Duration(s.Length() * Tz(time.Second) / s.SampleRate())
 }
 
@@ -0,0 +1,157 @@
+// Package virtual implements player driven by simulated clock for
+// deterministic tests of controllers and transitions:
+//
+//	p := virtual.NewPlayer(44100, 512, 2)
+//	ctrl := controller.NewSwitchController(p)
+//	ctrl.Action("forest")
+//	p.Advance(44100)
+//	ctrl.Action("thunder")
+//	p.AdvanceDuration(2 * time.Second)
+//	out := p.Output() // rendered 3 seconds of audio
+package virtual
+
+import (
+	"github.com/kikht/mix"
+
+	"sync"
+	"time"
+)
+
+// Player is mix.Player and mix.SwitchPlayer, that renders played source
+// only when its clock is advanced. Rendered samples are collected in memory.
+// Player is safe for concurrent use, so controllers could be used from
+// other goroutines.
+type Player struct {
+	rate      mix.Tz
+	chunkSize mix.Tz
+
+	mu     sync.Mutex
+	src    mix.Source
+	pos    mix.Tz
+	output []mix.Buffer
+	ended  bool
+	err    error
+}
+
+// NewPlayer creates Player with zero clock, that renders numChannels
+// channels by chunks of chunkSize samples.
+func NewPlayer(sampleRate, chunkSize mix.Tz, numChannels int) *Player {
+	return &Player{
+		rate:      sampleRate,
+		chunkSize: chunkSize,
+		output:    make([]mix.Buffer, numChannels),
+	}
+}
+
+// Advance renders n samples of played source and moves clock forward.
+// Source is read by chunks of at most ChunkSize samples, aligned to chunk
+// boundaries, just like audio device does. Silence is rendered when there
+// is no source or it has ended.
+func (p *Player) Advance(n mix.Tz) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for end := p.pos + n; p.pos < end; {
+		length := p.chunkSize - p.pos%p.chunkSize
+		if p.pos+length > end {
+			length = end - p.pos
+		}
+		p.render(length)
+		p.pos += length
+	}
+}
+
+// AdvanceDuration renders d of played source. See Advance.
+func (p *Player) AdvanceDuration(d time.Duration) {
+	p.Advance(mix.DurationToTz(d, p.rate))
+}
+
+func (p *Player) render(length mix.Tz) {
+	src, n := p.src, length
+	if src != nil && p.pos+length >= src.Length() {
+		p.ended = true
+		n = src.Length() - p.pos
+		if n < 0 {
+			n = 0
+		}
+	}
+	for c, out := range p.output {
+		if src != nil && n > 0 {
+			// Mono sources are played on all channels.
+			out = append(out, src.Samples(c%src.NumChannels(), p.pos, n)...)
+		}
+		p.output[c] = append(out, make(mix.Buffer, p.pos+length-mix.Tz(len(out)))...)
+	}
+	if src != nil && p.err == nil {
+		p.err = mix.SourceErr(src)
+	}
+}
+
+// Play replaces played source with src at current clock.
+func (p *Player) Play(src mix.Source) {
+	p.mu.Lock()
+	p.src = src
+	p.ended = false
+	p.mu.Unlock()
+}
+
+// Switch replaces played source with result of mutator, that is called
+// with current clock.
+func (p *Player) Switch(mutator mix.SourceMutator) {
+	p.mu.Lock()
+	p.src = mutator.Mutate(p.src, p.pos)
+	p.ended = false
+	p.mu.Unlock()
+}
+
+// Position returns current clock, i.e. number of rendered samples.
+func (p *Player) Position() mix.Tz {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pos
+}
+
+// Latency returns zero, Play and Switch are applied at current clock.
+func (p *Player) Latency() mix.Tz {
+	return 0
+}
+
+// Output returns all rendered samples since clock zero. Returned buffers
+// are not modified by further rendering.
+func (p *Player) Output() mix.MemSource {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := mix.MemSource{Rate: p.rate, Data: make([]mix.Buffer, len(p.output))}
+	for c, out := range p.output {
+		res.Data[c] = out[0:len(out):len(out)]
+	}
+	return res
+}
+
+// Source returns currently played source.
+func (p *Player) Source() mix.Source {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.src
+}
+
+// Ended reports whether played source has ended.
+func (p *Player) Ended() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ended
+}
+
+// Err returns the first error reported by played sources.
+func (p *Player) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *Player) SampleRate() mix.Tz {
+	return p.rate
+}
+
+func (p *Player) ChunkSize() mix.Tz {
+	return p.chunkSize
+}
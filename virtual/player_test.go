@@ -0,0 +1,198 @@
+package virtual
+
+import (
+	"github.com/kikht/mix"
+	"github.com/kikht/mix/controller"
+
+	"math"
+	"testing"
+)
+
+const rate = 1000
+
+func constSource(v float32, n mix.Tz) mix.MemSource {
+	buf := mix.NewBuffer(n)
+	for i := range buf {
+		buf[i] = v
+	}
+	return mix.MemSource{Rate: rate, Data: []mix.Buffer{buf}}
+}
+
+func TestAdvance(t *testing.T) {
+	p := NewPlayer(rate, 128, 2)
+	p.Advance(100)
+	p.Play(constSource(1, 1000))
+	p.Advance(300)
+	if p.Ended() {
+		t.Error("Source ended too early")
+	}
+	p.Advance(1000)
+	if !p.Ended() || p.Position() != 1400 {
+		t.Error("Invalid state", p.Ended(), p.Position())
+	}
+
+	out := p.Output()
+	if out.Length() != 1400 || out.NumChannels() != 2 {
+		t.Fatal("Invalid output", out.Length(), out.NumChannels())
+	}
+	for c := range out.Data {
+		for i, v := range out.Data[c] {
+			expect := float32(0)
+			if i >= 100 && i < 1000 {
+				expect = 1
+			}
+			if v != expect {
+				t.Fatalf("Invalid sample %d of channel %d: %f, expected %f",
+					i, c, v, expect)
+			}
+		}
+	}
+}
+
+func render(t *testing.T) mix.MemSource {
+	p := NewPlayer(rate, 10, 2)
+	ctrl := controller.NewSwitchController(p)
+	ctrl.AddAmbience("day", mix.Loop(constSource(1, 64)))
+	ctrl.AddAmbience("night", mix.Loop(constSource(-1, 64)))
+	if err := ctrl.Action("day"); err != nil {
+		t.Fatal(err)
+	}
+	p.Advance(500)
+	if err := ctrl.Action("night"); err != nil {
+		t.Fatal(err)
+	}
+	p.Advance(500)
+	if err := p.Err(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	return p.Output()
+}
+
+func TestSwitchController(t *testing.T) {
+	out := render(t)
+	if out.Length() != 1000 {
+		t.Fatal("Invalid output length", out.Length())
+	}
+
+	// Fade is 100ms, that is 100 samples.
+	level := out.Data[0][200]
+	if level <= 0 || out.Data[0][0] != 0 {
+		t.Fatal("Ambience is not faded in", out.Data[0][0:200])
+	}
+	for i, v := range out.Data[0][100:500] {
+		if math.Abs(float64(v-level)) > 1e-6 {
+			t.Fatalf("Unexpected sample %d before switch: %f", i+100, v)
+		}
+	}
+	// Equal-power crossfade of opposite signals is silent in the middle.
+	if v := out.Data[0][550]; math.Abs(float64(v)) > 1e-3 {
+		t.Error("Crossfade is not at position of switch", out.Data[0][500:600])
+	}
+	for i, v := range out.Data[0][600:] {
+		if math.Abs(float64(v+level)) > 1e-6 {
+			t.Fatalf("Unexpected sample %d after switch: %f", i+600, v)
+		}
+	}
+
+	// Rendering is deterministic.
+	again := render(t)
+	for c := range out.Data {
+		for i := range out.Data[c] {
+			if out.Data[c][i] != again.Data[c][i] {
+				t.Fatalf("Sample %d of channel %d differs between renders", i, c)
+			}
+		}
+	}
+}
+
+func TestAheadController(t *testing.T) {
+	p := NewPlayer(rate, 10, 2)
+	ctrl := controller.NewAheadController(p)
+	ctrl.AddAmbience("day", mix.Loop(constSource(1, 64)))
+	ctrl.AddAmbience("night", mix.Loop(constSource(-1, 64)))
+	ctrl.Action("day")
+	p.Advance(500)
+	ctrl.Action("night")
+	p.Advance(500)
+	out := p.Output()
+
+	// Virtual player has no latency, so actions are heard at its position.
+	if out.Data[0][0] != 0 || out.Data[0][1] <= 0 {
+		t.Error("Ambience does not start at 0", out.Data[0][0:10])
+	}
+	if v := out.Data[0][550]; math.Abs(float64(v)) > 1e-3 {
+		t.Error("Crossfade is not in the middle at 550", out.Data[0][500:600])
+	}
+	if v := out.Data[0][499] - out.Data[0][500]; math.Abs(float64(v)) > 1e-6 {
+		t.Error("Crossfade starts too early", out.Data[0][490:510])
+	}
+}
+
+func TestVolume(t *testing.T) {
+	p := NewPlayer(rate, 10, 2)
+	ctrl := controller.NewSwitchController(p)
+	ctrl.AddAmbience("day", mix.Loop(constSource(1, 64)))
+	ctrl.Action("day")
+	p.Advance(500)
+	ctrl.SetVolume(controller.CategoryAmbience, 0.5)
+	ctrl.SetVolume(controller.CategoryMusic, 0)
+	p.Advance(500)
+	out := p.Output()
+
+	if ctrl.Volume(controller.CategoryAmbience) != 0.5 {
+		t.Error("Invalid volume", ctrl.Volume(controller.CategoryAmbience))
+	}
+	// Gain is ramped across chunk of 10 samples.
+	full := out.Data[0][499]
+	if full <= 0 || out.Data[0][510] != full/2 || out.Data[1][999] != full/2 {
+		t.Error("Volume is not applied to playing ambience", out.Data[0][490:520])
+	}
+	if v := out.Data[0][505]; v >= full || v <= full/2 {
+		t.Error("Volume is not ramped", out.Data[0][500:510])
+	}
+}
+
+func TestZones(t *testing.T) {
+	p := NewPlayer(rate, 10, 4)
+	ctrl := controller.NewSwitchController(p)
+	ctrl.AddZone("hall")
+	ctrl.AddZone("bar")
+	if err := ctrl.AddZone("bar"); err == nil {
+		t.Error("Duplicate zone is added")
+	}
+	if err := ctrl.RouteCategory(controller.CategoryEffect, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.RouteSound("bell", "hall"); err != nil {
+		t.Fatal(err)
+	}
+	if ctrl.NumChannels() != 4 || ctrl.ChannelNames()[2] != "bar_L" {
+		t.Fatal("Invalid channels", ctrl.ChannelNames())
+	}
+	ctrl.AddAmbience("day", mix.Loop(constSource(1, 64)))
+	ctrl.AddEffect("shot", constSource(-1, 200))
+	ctrl.AddEffect("bell", constSource(-1, 200))
+	ctrl.Action("day")
+	p.Advance(300)
+	ctrl.Action("shot")
+	p.Advance(300)
+	ctrl.Action("bell")
+	p.Advance(300)
+	out := p.Output()
+
+	hall, bar := out.Data[1], out.Data[3]
+	day := hall[299]
+	if day <= 0 || bar[299] != 0 {
+		t.Fatal("Ambience is not routed to hall", hall[299], bar[299])
+	}
+	if hall[400] != day || bar[400] >= 0 {
+		t.Error("Effect is not routed to bar", hall[400], bar[390:410])
+	}
+	if hall[700] >= day || bar[700] != 0 {
+		t.Error("Sound is not routed to hall", hall[700], bar[700])
+	}
+	// Zones are aligned: effect starts at the same sample in both cases.
+	if hall[600] != day || hall[601] == day || bar[300] != 0 || bar[301] == 0 {
+		t.Error("Zones are not aligned", hall[595:605], bar[295:305])
+	}
+}